@@ -0,0 +1,31 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS distribution
+(
+    id INTEGER PRIMARY KEY,
+    source_account_id INTEGER NOT NULL REFERENCES account(id),
+    holder_ledger_id INTEGER NOT NULL REFERENCES ledger(id),
+    amount INTEGER NOT NULL,
+    memo TEXT,
+    snapshot_at DATETIME NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec')),
+
+    UNIQUE (source_account_id, idempotency_key)
+);
+
+CREATE TABLE IF NOT EXISTS distribution_payout
+(
+    distribution_id INTEGER NOT NULL REFERENCES distribution(id),
+    holder_account_id INTEGER NOT NULL REFERENCES account(id),
+    payout_account_id INTEGER NOT NULL REFERENCES account(id),
+    holder_balance INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    -- NULL when the holder's share rounded down to 0
+    transfer_id INTEGER REFERENCES transfer(id),
+    PRIMARY KEY (distribution_id, holder_account_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS distribution_payout;
+DROP TABLE IF EXISTS distribution;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- JSON object of string keys to string values
+ALTER TABLE transfer ADD COLUMN metadata TEXT;
+
+-- +goose Down
+ALTER TABLE transfer DROP COLUMN metadata;
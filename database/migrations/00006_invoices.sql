@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS invoice
+(
+    id INTEGER PRIMARY KEY,
+    -- Random token used in the payment link, so invoices can't be enumerated
+    token TEXT NOT NULL UNIQUE,
+    account_id INTEGER NOT NULL REFERENCES account(id),
+    amount INTEGER NOT NULL,
+    memo TEXT,
+    status INTEGER NOT NULL,
+    expires_at DATETIME NOT NULL,
+    -- Set once the invoice is paid
+    transfer_id INTEGER REFERENCES transfer(id),
+    paid_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS invoice_account_id_idx ON invoice(account_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS invoice_account_id_idx;
+DROP TABLE IF EXISTS invoice;
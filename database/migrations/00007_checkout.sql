@@ -0,0 +1,20 @@
+-- +goose Up
+ALTER TABLE invoice ADD COLUMN return_url TEXT;
+ALTER TABLE invoice ADD COLUMN cancel_url TEXT;
+
+-- Kept out of the account table so it's never selected by accident
+CREATE TABLE IF NOT EXISTS checkout_secret
+(
+    account_id INTEGER PRIMARY KEY REFERENCES account(id),
+    secret TEXT NOT NULL,
+    -- The secret replaced by the last rotation, which keeps signing
+    -- redirects alongside the current one until it expires
+    previous_secret TEXT,
+    previous_expires_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS checkout_secret;
+ALTER TABLE invoice DROP COLUMN cancel_url;
+ALTER TABLE invoice DROP COLUMN return_url;
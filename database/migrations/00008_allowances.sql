@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS allowance
+(
+    id INTEGER PRIMARY KEY,
+    owner_account_id INTEGER NOT NULL REFERENCES account(id),
+    spender_account_id INTEGER NOT NULL REFERENCES account(id),
+    amount INTEGER NOT NULL,
+    -- NULL when the amount is a lifetime limit rather than per period
+    period_days INTEGER,
+    expires_at DATETIME,
+    -- Amount pulled in the current period (or ever, without a period)
+    spent INTEGER NOT NULL DEFAULT 0,
+    period_start DATETIME NOT NULL,
+    revoked_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS allowance_owner_account_id_idx ON allowance(owner_account_id);
+CREATE INDEX IF NOT EXISTS allowance_spender_account_id_idx ON allowance(spender_account_id);
+
+CREATE TABLE IF NOT EXISTS allowance_pull
+(
+    transfer_id INTEGER PRIMARY KEY REFERENCES transfer(id),
+    allowance_id INTEGER NOT NULL REFERENCES allowance(id),
+    amount INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS allowance_pull_allowance_id_idx ON allowance_pull(allowance_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS allowance_pull_allowance_id_idx;
+DROP TABLE IF EXISTS allowance_pull;
+DROP INDEX IF EXISTS allowance_spender_account_id_idx;
+DROP INDEX IF EXISTS allowance_owner_account_id_idx;
+DROP TABLE IF EXISTS allowance;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- Backs per account transfer listings, which are keyset paginated on id
+CREATE INDEX IF NOT EXISTS transfer_debit_account_id_idx ON transfer(debit_account_id, id);
+CREATE INDEX IF NOT EXISTS transfer_credit_account_id_idx ON transfer(credit_account_id, id);
+
+-- +goose Down
+DROP INDEX IF EXISTS transfer_credit_account_id_idx;
+DROP INDEX IF EXISTS transfer_debit_account_id_idx;
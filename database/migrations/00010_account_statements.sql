@@ -0,0 +1,26 @@
+-- +goose Up
+-- Monthly statements, the documents themselves are kept in the statements
+-- object store under object_name
+CREATE TABLE IF NOT EXISTS account_statement
+(
+    id INTEGER PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id),
+    period_start DATETIME NOT NULL,
+    period_end DATETIME NOT NULL,
+    object_name TEXT NOT NULL,
+    digest TEXT NOT NULL,
+    opening_balance INTEGER NOT NULL,
+    closing_balance INTEGER NOT NULL,
+    -- Closing balance of the previous statement, differing from the opening
+    -- balance if the account was changed outside of transfers
+    previous_closing_balance INTEGER,
+    total_in INTEGER NOT NULL,
+    total_out INTEGER NOT NULL,
+    transfer_count INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec')),
+
+    UNIQUE (account_id, period_start)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS account_statement;
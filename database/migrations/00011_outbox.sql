@@ -0,0 +1,24 @@
+-- +goose Up
+-- Events written in the same transaction as the change they describe, and
+-- published by the outbox relay until acknowledged
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id INTEGER PRIMARY KEY,
+    kind INTEGER NOT NULL,
+    subject TEXT NOT NULL,
+    -- Webhook deliveries only
+    account_id INTEGER REFERENCES account(id),
+    url TEXT,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_error TEXT,
+    published_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox(next_attempt_at) WHERE published_at IS NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS outbox_pending_idx;
+DROP TABLE IF EXISTS outbox;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- Signs webhook deliveries. After a rotation the previous secret signs them
+-- as well until it expires, so receivers can switch over without downtime.
+CREATE TABLE IF NOT EXISTS webhook_secret
+(
+    account_id INTEGER PRIMARY KEY REFERENCES account(id),
+    secret TEXT NOT NULL,
+    previous_secret TEXT,
+    previous_expires_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS webhook_secret;
@@ -0,0 +1,56 @@
+-- +goose Up
+-- An account can have several webhooks, each subscribed to its own events
+CREATE TABLE IF NOT EXISTS webhook_endpoint
+(
+    id INTEGER PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES account(id),
+    url TEXT NOT NULL,
+    events INTEGER NOT NULL, -- Bitmask of the events it's subscribed to
+    enabled INTEGER NOT NULL DEFAULT 1,
+    secret TEXT NOT NULL,
+    previous_secret TEXT,
+    previous_expires_at DATETIME,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS webhook_endpoint_account_idx ON webhook_endpoint(account_id);
+
+-- Existing webhooks get incoming and outgoing transfers, like before, and
+-- keep their secret (or get one, to be seen by rotating it)
+INSERT INTO webhook_endpoint (account_id, url, events, secret, previous_secret, previous_expires_at, updated_at)
+SELECT a.id, a.webhook, 3, COALESCE(s.secret, 'whsec_' || lower(hex(randomblob(20)))), s.previous_secret, s.previous_expires_at, datetime('now', 'subsec')
+FROM account a
+LEFT JOIN webhook_secret s ON s.account_id = a.id
+WHERE a.webhook IS NOT NULL;
+
+ALTER TABLE outbox ADD COLUMN endpoint_id INTEGER;
+
+UPDATE outbox
+SET endpoint_id = (SELECT e.id FROM webhook_endpoint e WHERE e.account_id = outbox.account_id)
+WHERE kind = 1 AND published_at IS NULL;
+
+DROP TABLE IF EXISTS webhook_secret;
+ALTER TABLE account DROP COLUMN webhook;
+
+-- +goose Down
+ALTER TABLE account ADD COLUMN webhook TEXT;
+UPDATE account
+SET webhook = (SELECT e.url FROM webhook_endpoint e WHERE e.account_id = account.id ORDER BY e.id LIMIT 1);
+
+CREATE TABLE IF NOT EXISTS webhook_secret
+(
+    account_id INTEGER PRIMARY KEY REFERENCES account(id),
+    secret TEXT NOT NULL,
+    previous_secret TEXT,
+    previous_expires_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+INSERT INTO webhook_secret (account_id, secret, previous_secret, previous_expires_at)
+SELECT e.account_id, e.secret, e.previous_secret, e.previous_expires_at
+FROM webhook_endpoint e
+WHERE e.id IN (SELECT MIN(id) FROM webhook_endpoint GROUP BY account_id);
+
+ALTER TABLE outbox DROP COLUMN endpoint_id;
+DROP INDEX IF EXISTS webhook_endpoint_account_idx;
+DROP TABLE IF EXISTS webhook_endpoint;
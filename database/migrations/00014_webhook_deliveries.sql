@@ -0,0 +1,30 @@
+-- +goose Up
+-- Every webhook delivery attempt, kept for debugging integrations
+CREATE TABLE IF NOT EXISTS webhook_delivery
+(
+    id INTEGER PRIMARY KEY,
+    endpoint_id INTEGER NOT NULL REFERENCES webhook_endpoint(id) ON DELETE CASCADE,
+    account_id INTEGER NOT NULL REFERENCES account(id),
+    event_id TEXT NOT NULL, -- The payload's id, e.g. transfer-123
+    transfer_id INTEGER, -- Null for events other than transfers
+    attempt INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    request_body TEXT NOT NULL,
+    status_code INTEGER, -- Null when no response was received
+    latency_ms INTEGER NOT NULL,
+    response_body TEXT, -- Truncated
+    error TEXT,
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_endpoint_idx ON webhook_delivery(endpoint_id, id);
+CREATE INDEX IF NOT EXISTS webhook_delivery_account_idx ON webhook_delivery(account_id, id);
+CREATE INDEX IF NOT EXISTS webhook_delivery_created_at_idx ON webhook_delivery(created_at);
+CREATE INDEX IF NOT EXISTS webhook_delivery_event_idx ON webhook_delivery(endpoint_id, event_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS webhook_delivery_event_idx;
+DROP INDEX IF EXISTS webhook_delivery_created_at_idx;
+DROP INDEX IF EXISTS webhook_delivery_account_idx;
+DROP INDEX IF EXISTS webhook_delivery_endpoint_idx;
+DROP TABLE IF EXISTS webhook_delivery;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Consecutive failed delivery attempts, reset by a successful one
+ALTER TABLE webhook_endpoint ADD COLUMN failure_streak INTEGER NOT NULL DEFAULT 0;
+-- Set when the endpoint was disabled automatically, rather than by its owner
+ALTER TABLE webhook_endpoint ADD COLUMN disabled_reason TEXT;
+
+-- +goose Down
+ALTER TABLE webhook_endpoint DROP COLUMN disabled_reason;
+ALTER TABLE webhook_endpoint DROP COLUMN failure_streak;
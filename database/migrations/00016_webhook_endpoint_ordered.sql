@@ -0,0 +1,11 @@
+-- +goose Up
+-- Ordered endpoints get their deliveries one at a time, in transfer order
+ALTER TABLE webhook_endpoint ADD COLUMN ordered INTEGER NOT NULL DEFAULT 0;
+
+-- For holding back an ordered endpoint's outbox entries behind its earlier
+-- ones
+CREATE INDEX IF NOT EXISTS outbox_endpoint_pending_idx ON outbox(endpoint_id, id) WHERE published_at IS NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS outbox_endpoint_pending_idx;
+ALTER TABLE webhook_endpoint DROP COLUMN ordered;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- The payload schema an endpoint gets, 1 being the transfer event alone
+ALTER TABLE webhook_endpoint ADD COLUMN payload_version INTEGER NOT NULL DEFAULT 1;
+-- Whether payloads are wrapped in a CloudEvents envelope
+ALTER TABLE webhook_endpoint ADD COLUMN cloudevents INTEGER NOT NULL DEFAULT 0;
+
+-- What was queued for delivery, to redeliver it in whatever format the
+-- endpoint wants then
+ALTER TABLE webhook_delivery ADD COLUMN payload TEXT;
+
+-- +goose Down
+ALTER TABLE webhook_delivery DROP COLUMN payload;
+ALTER TABLE webhook_endpoint DROP COLUMN cloudevents;
+ALTER TABLE webhook_endpoint DROP COLUMN payload_version;
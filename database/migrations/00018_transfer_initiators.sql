@@ -0,0 +1,17 @@
+-- +goose Up
+-- Who made each transfer, and how. Null for transfers made before they were
+-- recorded
+ALTER TABLE transfer ADD COLUMN initiator_account_id INTEGER REFERENCES account(id); -- Whose permissions or token were used
+ALTER TABLE transfer ADD COLUMN initiator_user_id INTEGER REFERENCES "user"(id);
+ALTER TABLE transfer ADD COLUMN initiator_token_id TEXT; -- Derived from the token, never the token itself
+ALTER TABLE transfer ADD COLUMN channel TEXT; -- app or api
+ALTER TABLE transfer ADD COLUMN request_id TEXT; -- Generated for the request
+ALTER TABLE transfer ADD COLUMN client_request_id TEXT; -- The X-Request-Id the client sent
+
+-- +goose Down
+ALTER TABLE transfer DROP COLUMN client_request_id;
+ALTER TABLE transfer DROP COLUMN request_id;
+ALTER TABLE transfer DROP COLUMN channel;
+ALTER TABLE transfer DROP COLUMN initiator_token_id;
+ALTER TABLE transfer DROP COLUMN initiator_user_id;
+ALTER TABLE transfer DROP COLUMN initiator_account_id;
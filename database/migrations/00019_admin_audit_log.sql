@@ -0,0 +1,42 @@
+-- +goose Up
+-- Append only record of admin actions, also published to the ADMIN_AUDIT
+-- stream through the outbox
+CREATE TABLE IF NOT EXISTS admin_audit_log
+(
+    id INTEGER PRIMARY KEY,
+    action TEXT NOT NULL,
+    -- What was acted on, e.g. "account:42"
+    target TEXT NOT NULL,
+    -- JSON object of changed fields to their before and after values
+    diff TEXT NOT NULL DEFAULT '{}',
+    source_ip TEXT NOT NULL,
+    request_id TEXT,
+    client_request_id TEXT, -- The X-Request-Id the client sent
+    created_at DATETIME NOT NULL DEFAULT (datetime('now', 'subsec'))
+);
+
+CREATE INDEX IF NOT EXISTS admin_audit_log_action_idx ON admin_audit_log(action, id);
+CREATE INDEX IF NOT EXISTS admin_audit_log_target_idx ON admin_audit_log(target, id);
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS admin_audit_log_no_update
+BEFORE UPDATE ON admin_audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'admin_audit_log is append only');
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS admin_audit_log_no_delete
+BEFORE DELETE ON admin_audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'admin_audit_log is append only');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TRIGGER IF EXISTS admin_audit_log_no_delete;
+DROP TRIGGER IF EXISTS admin_audit_log_no_update;
+DROP INDEX IF EXISTS admin_audit_log_target_idx;
+DROP INDEX IF EXISTS admin_audit_log_action_idx;
+DROP TABLE IF EXISTS admin_audit_log;
@@ -59,15 +59,14 @@ END;
 
 -- name: InsertAccount :one
 INSERT
-    INTO account (address, webhook, user_id, debits_pending, debits_posted, credits_pending, credits_posted, ledger_id, code, flags, created_at)
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    INTO account (address, user_id, debits_pending, debits_posted, credits_pending, credits_posted, ledger_id, code, flags, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     RETURNING id;
 
 -- name: InsertAccountWithBalance :one
 INSERT
-    INTO account (address, webhook, user_id, debits_pending, debits_posted, credits_pending, credits_posted, ledger_id, code, flags, created_at)
+    INTO account (address, user_id, debits_pending, debits_posted, credits_pending, credits_posted, ledger_id, code, flags, created_at)
     VALUES (
-        ?,
         ?,
         ?,
         CASE WHEN CAST(sqlc.arg(field) AS TEXT) = 'debits_pending' THEN CAST(sqlc.arg(quantity) AS INTEGER) ELSE 0 END,
@@ -104,11 +103,6 @@ WHERE a.id = ?;
 -- name: GetAccountByAddrAndLedgerId :one
 SELECT * FROM account WHERE address = ? AND ledger_id = ?;
 
--- name: UpdateAccountWebhookById :exec
-UPDATE account
-SET webhook = ?
-WHERE id = ?;
-
 -- name: UpdateAccountUserId :execrows
 UPDATE account
 SET user_id = ?
@@ -186,3 +180,45 @@ SELECT
         ELSE 0 END) AS credits_net
 FROM account a
 WHERE ledger_id = ?;
+
+-- name: UpdateAccountFlags :execrows
+UPDATE account
+SET flags = ?
+WHERE id = ?;
+
+-- name: GetLedgerSupply :one
+SELECT
+    CAST(COALESCE(SUM(a.debits_posted - a.credits_pending - a.credits_posted), 0) AS INTEGER) AS circulating_supply,
+    CAST(COUNT(*) AS INTEGER) AS holder_count
+FROM account a
+WHERE a.ledger_id = ?
+    AND a.code BETWEEN 100 AND 199
+    AND a.debits_posted - a.credits_pending - a.credits_posted > 0;
+
+-- name: GetLedgerBalanceDistribution :many
+-- Buckets holders by the number of digits in their balance (order of magnitude)
+SELECT
+    CAST(LENGTH(CAST(a.debits_posted - a.credits_pending - a.credits_posted AS TEXT)) AS INTEGER) AS magnitude,
+    CAST(COUNT(*) AS INTEGER) AS holders,
+    CAST(SUM(a.debits_posted - a.credits_pending - a.credits_posted) AS INTEGER) AS balance
+FROM account a
+WHERE a.ledger_id = ?
+    AND a.code BETWEEN 100 AND 199
+    AND a.debits_posted - a.credits_pending - a.credits_posted > 0
+GROUP BY magnitude
+ORDER BY magnitude;
+
+-- name: GetLedgerHolders :many
+SELECT
+    a.id,
+    a.address,
+    u.bitcraft_username,
+    CAST(a.debits_posted - a.credits_pending - a.credits_posted AS INTEGER) AS balance
+FROM account a
+LEFT JOIN "user" u ON u.id = a.user_id
+WHERE a.ledger_id = sqlc.arg(ledger_id)
+    AND a.code BETWEEN 100 AND 199
+    AND a.flags & CAST(sqlc.arg(hidden_flags) AS INTEGER) = 0
+    AND a.debits_posted - a.credits_pending - a.credits_posted > 0
+ORDER BY balance DESC, a.id ASC
+LIMIT sqlc.arg(limit) OFFSET sqlc.arg(offset);
@@ -24,6 +24,10 @@ JOIN
 	"user" AS u ON ap.user_id = u.id
 WHERE ap.account_id = sqlc.arg(account_id);
 
+-- name: GetAccountPerm :one
+SELECT * FROM account_permission
+WHERE account_id = ? AND user_id = ?;
+
 -- name: InsertAccountPerm :one
 INSERT
     INTO account_permission (account_id, user_id, permissions, updated_at, created_at)
@@ -47,5 +51,5 @@ WHERE ap.account_id = sqlc.arg(account_id) AND user_id IN (
 
 -- name: UpdateAccountPerm :execrows
 UPDATE account_permission
-SET permissions = ?
+SET permissions = ?, updated_at = ?
 WHERE id = ?;
@@ -0,0 +1,12 @@
+-- name: InsertAdminAuditEntry :one
+INSERT INTO admin_audit_log (action, target, diff, source_ip, request_id, client_request_id, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+RETURNING *;
+
+-- name: GetAdminAuditEntries :many
+SELECT * FROM admin_audit_log
+WHERE (CAST(sqlc.narg('action') AS TEXT) IS NULL OR action = sqlc.narg('action'))
+	AND (CAST(sqlc.narg('target') AS TEXT) IS NULL OR target = sqlc.narg('target'))
+	AND (CAST(sqlc.narg('before_id') AS INTEGER) IS NULL OR id < sqlc.narg('before_id'))
+ORDER BY id DESC
+LIMIT sqlc.arg('limit');
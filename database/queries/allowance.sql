@@ -0,0 +1,40 @@
+-- name: InsertAllowance :one
+INSERT INTO allowance (owner_account_id, spender_account_id, amount, period_days, expires_at, spent, period_start, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    RETURNING id;
+
+-- name: GetAllowanceById :one
+SELECT * FROM allowance WHERE id = ?;
+
+-- name: GetAllowancesByOwnerAccountId :many
+SELECT * FROM allowance
+WHERE owner_account_id = ?
+ORDER BY id DESC
+LIMIT 100;
+
+-- name: GetAllowancesBySpenderAccountId :many
+SELECT * FROM allowance
+WHERE spender_account_id = ?
+ORDER BY id DESC
+LIMIT 100;
+
+-- name: UpdateAllowanceSpent :execrows
+-- Guarded on the previous spent amount, so concurrent pulls can't both
+-- spend the same headroom
+UPDATE allowance
+SET spent = sqlc.arg(spent), period_start = sqlc.arg(period_start)
+WHERE id = sqlc.arg(id) AND spent = sqlc.arg(from_spent);
+
+-- name: UpdateAllowanceRevoked :execrows
+UPDATE allowance SET revoked_at = ?
+WHERE id = ? AND revoked_at IS NULL;
+
+-- name: InsertAllowancePull :exec
+INSERT INTO allowance_pull (transfer_id, allowance_id, amount, created_at)
+    VALUES (?, ?, ?, ?);
+
+-- name: GetAllowancePulls :many
+SELECT * FROM allowance_pull
+WHERE allowance_id = ?
+ORDER BY transfer_id DESC
+LIMIT 100;
@@ -0,0 +1,57 @@
+-- name: GetLedgerBalancesAt :many
+-- Works back from the current posted balances of a ledger's debit accounts,
+-- backing out transfers made after the snapshot, so adjustments made outside
+-- of transfers are kept
+SELECT
+    a.id,
+    CAST(a.debits_posted - a.credits_posted - COALESCE((
+        SELECT SUM(CASE WHEN t.debit_account_id = a.id THEN t.amount ELSE -t.amount END)
+        FROM transfer t
+        WHERE (t.debit_account_id = a.id OR t.credit_account_id = a.id)
+            AND t.created_at > sqlc.arg(snapshot_at)
+    ), 0) AS INTEGER) AS balance
+FROM account a
+WHERE a.ledger_id = sqlc.arg(ledger_id)
+    AND a.code BETWEEN 100 AND 199
+ORDER BY a.id;
+
+-- name: GetDistributionPayoutAccounts :many
+-- Matches holder accounts to the accounts on the payout ledger owned by the
+-- holder's primary user. Addresses aren't matched on, as they're only unique
+-- within a ledger.
+SELECT
+    h.id AS holder_account_id,
+    p.id AS payout_account_id
+FROM account h
+JOIN account p ON p.ledger_id = sqlc.arg(payout_ledger_id)
+    AND p.code BETWEEN 100 AND 199
+    AND p.user_id = h.user_id
+WHERE h.ledger_id = sqlc.arg(holder_ledger_id)
+    AND h.code BETWEEN 100 AND 199;
+
+-- name: InsertDistribution :one
+INSERT INTO distribution (source_account_id, holder_ledger_id, amount, memo, snapshot_at, idempotency_key, request_hash, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    RETURNING id;
+
+-- name: InsertDistributionPayout :exec
+INSERT INTO distribution_payout (distribution_id, holder_account_id, payout_account_id, holder_balance, amount, transfer_id)
+    VALUES (?, ?, ?, ?, ?, ?);
+
+-- name: GetDistributionByKey :one
+SELECT * FROM distribution
+WHERE source_account_id = ? AND idempotency_key = ?;
+
+-- name: GetDistributionById :one
+SELECT * FROM distribution WHERE id = ?;
+
+-- name: GetDistributionsBySourceAccountId :many
+SELECT * FROM distribution
+WHERE source_account_id = ?
+ORDER BY id DESC
+LIMIT 100;
+
+-- name: GetDistributionPayouts :many
+SELECT * FROM distribution_payout
+WHERE distribution_id = ?
+ORDER BY holder_account_id;
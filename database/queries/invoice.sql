@@ -0,0 +1,41 @@
+-- name: InsertInvoice :one
+INSERT INTO invoice (token, account_id, amount, memo, status, expires_at, return_url, cancel_url, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    RETURNING id;
+
+-- name: GetInvoiceById :one
+SELECT * FROM invoice WHERE id = ?;
+
+-- name: GetInvoiceByToken :one
+SELECT * FROM invoice WHERE token = ?;
+
+-- name: GetInvoicesByAccountId :many
+SELECT * FROM invoice
+WHERE account_id = sqlc.arg(account_id)
+    AND (sqlc.narg(status) IS NULL OR status = sqlc.narg(status))
+ORDER BY id DESC
+LIMIT 100;
+
+-- name: UpdateInvoicePaid :execrows
+UPDATE invoice
+SET status = sqlc.arg(status), transfer_id = sqlc.arg(transfer_id), paid_at = sqlc.arg(paid_at)
+WHERE id = sqlc.arg(id) AND status = sqlc.arg(from_status);
+
+-- name: UpdateInvoiceStatus :execrows
+UPDATE invoice
+SET status = sqlc.arg(status)
+WHERE id = sqlc.arg(id) AND status = sqlc.arg(from_status);
+
+-- name: UpsertCheckoutSecret :exec
+-- previous_expires_at only matters once there's a previous_secret, but goes
+-- through VALUES as sqlc doesn't see arguments in DO UPDATE
+INSERT INTO checkout_secret (account_id, secret, previous_expires_at, created_at)
+    VALUES (?, ?, ?, ?)
+    ON CONFLICT (account_id) DO UPDATE SET
+        previous_secret = checkout_secret.secret,
+        previous_expires_at = excluded.previous_expires_at,
+        secret = excluded.secret,
+        created_at = excluded.created_at;
+
+-- name: GetCheckoutSecret :one
+SELECT secret, previous_secret, previous_expires_at FROM checkout_secret WHERE account_id = ?;
@@ -0,0 +1,34 @@
+-- name: InsertOutboxEntry :exec
+INSERT INTO outbox (kind, subject, account_id, endpoint_id, url, payload, next_attempt_at, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetDueOutboxEntries :many
+-- Entries for ordered endpoints wait while an earlier one is being retried
+-- or published
+SELECT * FROM outbox AS o
+WHERE o.published_at IS NULL AND o.next_attempt_at <= sqlc.arg(now)
+	AND NOT (
+		o.endpoint_id IN (SELECT id FROM webhook_endpoint WHERE ordered = 1)
+		AND EXISTS (
+			SELECT 1 FROM outbox AS p
+			WHERE p.endpoint_id = o.endpoint_id AND p.published_at IS NULL
+				AND p.id < o.id AND p.next_attempt_at > sqlc.arg(now)
+		)
+	)
+ORDER BY o.id
+LIMIT sqlc.arg('limit');
+
+-- name: ClaimOutboxEntry :execrows
+-- Leases the entry to one relay, guarded on the attempts it was read with
+UPDATE outbox
+SET attempts = attempts + 1, next_attempt_at = sqlc.arg(lease_until)
+WHERE id = sqlc.arg(id) AND attempts = sqlc.arg(from_attempts) AND published_at IS NULL;
+
+-- name: UpdateOutboxPublished :exec
+UPDATE outbox SET published_at = ?, last_error = NULL WHERE id = ?;
+
+-- name: UpdateOutboxFailed :exec
+UPDATE outbox SET next_attempt_at = ?, last_error = ? WHERE id = ?;
+
+-- name: DeleteOutboxPublishedBefore :execrows
+DELETE FROM outbox WHERE published_at IS NOT NULL AND published_at < ?;
@@ -0,0 +1,27 @@
+-- name: InsertAccountStatement :execrows
+INSERT INTO account_statement (
+    account_id, period_start, period_end, object_name, digest, opening_balance, closing_balance,
+    previous_closing_balance, total_in, total_out, transfer_count, created_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (account_id, period_start) DO NOTHING;
+
+-- name: GetAccountStatementById :one
+SELECT * FROM account_statement WHERE id = ?;
+
+-- name: GetAccountStatements :many
+SELECT * FROM account_statement
+WHERE account_id = ?
+ORDER BY period_start DESC
+LIMIT 100;
+
+-- name: GetLatestAccountStatement :one
+SELECT * FROM account_statement
+WHERE account_id = ?
+ORDER BY period_start DESC
+LIMIT 1;
+
+-- name: GetAccountsPage :many
+SELECT id, created_at FROM account
+WHERE id > sqlc.arg(after_id)
+ORDER BY id
+LIMIT sqlc.arg('limit');
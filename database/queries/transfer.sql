@@ -1,6 +1,7 @@
 -- name: InsertTransfer :one
-INSERT INTO transfer (debit_account_id, credit_account_id, amount, pending_id, ledger_id, code, flags, memo, created_at)
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) returning id;
+INSERT INTO transfer (debit_account_id, credit_account_id, amount, pending_id, ledger_id, code, flags, memo, metadata,
+        initiator_account_id, initiator_user_id, initiator_token_id, channel, request_id, client_request_id, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) returning id;
 
 -- name: GetTransferIdempotency :one
 SELECT account_id, key, transfer_id, request_hash, created_at
@@ -12,6 +13,8 @@ INSERT INTO transfer_idempotency (account_id, key, transfer_id, request_hash, cr
 VALUES (?, ?, ?, ?, ?);
 
 -- name: GetTransfersByAccountId :many
+-- Keyset paginated, newest first. IDs are assigned in created_at order, so
+-- the cursor is the last ID seen.
 SELECT
     tr.*,
     da.address AS debit_address,
@@ -21,9 +24,27 @@ JOIN
 	account AS da ON da.id = tr.debit_account_id
 JOIN
 	account AS ca ON ca.id = tr.credit_account_id
-WHERE debit_account_id = sqlc.arg(account_id) OR credit_account_id = sqlc.arg(account_id)
-ORDER BY datetime(tr.created_at) DESC
-LIMIT 250;
+WHERE (tr.debit_account_id = sqlc.arg(account_id) OR tr.credit_account_id = sqlc.arg(account_id))
+	AND (CAST(sqlc.narg('before_id') AS INTEGER) IS NULL OR tr.id < sqlc.narg('before_id'))
+	AND (CAST(sqlc.narg('debit_account_id') AS INTEGER) IS NULL OR tr.debit_account_id = sqlc.narg('debit_account_id'))
+	AND (CAST(sqlc.narg('credit_account_id') AS INTEGER) IS NULL OR tr.credit_account_id = sqlc.narg('credit_account_id'))
+	AND (CAST(sqlc.narg('counterparty_id') AS INTEGER) IS NULL
+		OR tr.debit_account_id = sqlc.narg('counterparty_id')
+		OR tr.credit_account_id = sqlc.narg('counterparty_id'))
+	AND (CAST(sqlc.narg('min_amount') AS INTEGER) IS NULL OR tr.amount >= sqlc.narg('min_amount'))
+	AND (CAST(sqlc.narg('max_amount') AS INTEGER) IS NULL OR tr.amount <= sqlc.narg('max_amount'))
+	AND (CAST(sqlc.narg('code') AS INTEGER) IS NULL OR tr.code = sqlc.narg('code'))
+	AND (CAST(sqlc.narg('memo') AS TEXT) IS NULL
+		OR instr(lower(tr.memo), lower(sqlc.narg('memo'))) > 0)
+	-- Times are stored as text in the server's zone, so compare in it
+	AND (tr.created_at >= sqlc.narg('created_from') OR sqlc.narg('created_from') IS NULL)
+	AND (tr.created_at < sqlc.narg('created_to') OR sqlc.narg('created_to') IS NULL)
+	AND (CAST(sqlc.narg('metadata_path') AS TEXT) IS NULL
+		OR json_extract(tr.metadata, sqlc.narg('metadata_path')) IS NOT NULL)
+	AND (CAST(sqlc.narg('metadata_value') AS TEXT) IS NULL
+		OR json_extract(tr.metadata, sqlc.narg('metadata_path')) = sqlc.narg('metadata_value'))
+ORDER BY tr.id DESC
+LIMIT sqlc.arg('limit');
 
 -- name: GetTransferById :one
 SELECT * FROM transfer WHERE id = ?;
@@ -32,12 +53,15 @@ SELECT * FROM transfer WHERE id = ?;
 SELECT
     tr.*,
     da.address AS debit_address,
-    ca.address AS credit_address
+    ca.address AS credit_address,
+    iu.bitcraft_username AS initiator_username
 FROM transfer AS tr
 JOIN
 	account AS da ON da.id = tr.debit_account_id
 JOIN
 	account AS ca ON ca.id = tr.credit_account_id
+LEFT JOIN
+	"user" AS iu ON iu.id = tr.initiator_user_id
 WHERE tr.id = ?;
 
 -- name: GetTransfersUserHasPermsOn :many
@@ -47,6 +71,7 @@ SELECT
 	ca.address as credit_addr,
 	du.bitcraft_username as debit_username,
 	cu.bitcraft_username as credit_username,
+	iu.bitcraft_username as initiator_username,
 	l.name as ledger_name,
 	l.asset_scale
 FROM transfer t
@@ -56,10 +81,87 @@ INNER JOIN account da ON da.id = t.debit_account_id
 INNER JOIN account ca ON ca.id = t.credit_account_id
 LEFT JOIN "user" du ON du.id = da.user_id
 LEFT JOIN "user" cu ON cu.id = ca.user_id
+LEFT JOIN "user" iu ON iu.id = t.initiator_user_id
 INNER JOIN account_permission ap ON ap.account_id = a.id
-WHERE ap.user_id = ?
+WHERE ap.user_id = sqlc.arg(user_id)
 	AND (CAST(sqlc.narg('account_id') AS INTEGER) IS NULL
 		OR t.debit_account_id = sqlc.narg('account_id')
 		OR t.credit_account_id = sqlc.narg('account_id'))
-ORDER BY datetime(t.created_at) DESC
-LIMIT 25;
+	AND (CAST(sqlc.narg('before_id') AS INTEGER) IS NULL OR t.id < sqlc.narg('before_id'))
+	AND (CAST(sqlc.narg('after_id') AS INTEGER) IS NULL OR t.id > sqlc.narg('after_id'))
+ORDER BY t.id DESC
+LIMIT sqlc.arg('limit');
+
+-- name: GetStatementTransfers :many
+-- Ascending keyset pages of an account's transfers, for streaming statements
+SELECT
+	tr.id,
+	tr.debit_account_id,
+	tr.credit_account_id,
+	tr.amount,
+	tr.code,
+	tr.memo,
+	tr.created_at,
+	da.address AS debit_address,
+	ca.address AS credit_address,
+	du.bitcraft_username AS debit_username,
+	cu.bitcraft_username AS credit_username,
+	tr.initiator_account_id,
+	tr.initiator_user_id,
+	tr.initiator_token_id,
+	tr.channel,
+	tr.request_id,
+	iu.bitcraft_username AS initiator_username
+FROM transfer AS tr
+JOIN account AS da ON da.id = tr.debit_account_id
+JOIN account AS ca ON ca.id = tr.credit_account_id
+LEFT JOIN "user" du ON du.id = da.user_id
+LEFT JOIN "user" cu ON cu.id = ca.user_id
+LEFT JOIN "user" iu ON iu.id = tr.initiator_user_id
+WHERE (tr.debit_account_id = sqlc.arg(account_id) OR tr.credit_account_id = sqlc.arg(account_id))
+	AND tr.id > sqlc.arg(after_id)
+	AND (tr.created_at >= sqlc.narg('created_from') OR sqlc.narg('created_from') IS NULL)
+	AND (tr.created_at < sqlc.narg('created_to') OR sqlc.narg('created_to') IS NULL)
+ORDER BY tr.id
+LIMIT sqlc.arg('limit');
+
+-- name: GetAccountTransferTotalsSince :one
+-- Totals of an account's transfers from a point in time onwards, used to work
+-- back from the current balance to the balance at that time
+SELECT
+	CAST(COALESCE(SUM(CASE WHEN debit_account_id = sqlc.arg(account_id) THEN amount ELSE 0 END), 0) AS INTEGER) AS debits,
+	CAST(COALESCE(SUM(CASE WHEN credit_account_id = sqlc.arg(account_id) THEN amount ELSE 0 END), 0) AS INTEGER) AS credits
+FROM transfer
+WHERE (debit_account_id = sqlc.arg(account_id) OR credit_account_id = sqlc.arg(account_id))
+	AND (created_at >= sqlc.narg('created_from') OR sqlc.narg('created_from') IS NULL);
+
+-- name: GetJournalTransfers :many
+-- Ascending keyset pages of the transfers on a single account, or on every
+-- account a user has permissions on, for journal exports
+SELECT
+	tr.id,
+	tr.debit_account_id,
+	tr.credit_account_id,
+	tr.amount,
+	tr.ledger_id,
+	tr.code,
+	tr.memo,
+	tr.created_at,
+	da.address AS debit_address,
+	da.code AS debit_code,
+	da.created_at AS debit_created_at,
+	ca.address AS credit_address,
+	ca.code AS credit_code,
+	ca.created_at AS credit_created_at
+FROM transfer AS tr
+JOIN account AS da ON da.id = tr.debit_account_id
+JOIN account AS ca ON ca.id = tr.credit_account_id
+WHERE tr.id > sqlc.arg(after_id)
+	AND (tr.debit_account_id = sqlc.narg('account_id')
+		OR tr.credit_account_id = sqlc.narg('account_id')
+		OR tr.debit_account_id IN (SELECT ap.account_id FROM account_permission ap WHERE ap.user_id = sqlc.narg('user_id'))
+		OR tr.credit_account_id IN (SELECT ap.account_id FROM account_permission ap WHERE ap.user_id = sqlc.narg('user_id')))
+	AND (tr.created_at >= sqlc.narg('created_from') OR sqlc.narg('created_from') IS NULL)
+	AND (tr.created_at < sqlc.narg('created_to') OR sqlc.narg('created_to') IS NULL)
+ORDER BY tr.id
+LIMIT sqlc.arg('limit');
@@ -0,0 +1,94 @@
+-- name: InsertWebhookEndpoint :one
+INSERT INTO webhook_endpoint (account_id, url, events, enabled, ordered, payload_version, cloudevents, secret, updated_at, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    RETURNING *;
+
+-- name: GetWebhookEndpointById :one
+SELECT * FROM webhook_endpoint WHERE id = ?;
+
+-- name: GetAccountWebhookEndpoint :one
+SELECT * FROM webhook_endpoint WHERE id = ? AND account_id = ?;
+
+-- name: GetFirstWebhookEndpoint :one
+SELECT * FROM webhook_endpoint
+WHERE account_id = ?
+ORDER BY id
+LIMIT 1;
+
+-- name: GetWebhookEndpointsByAccountId :many
+SELECT * FROM webhook_endpoint
+WHERE account_id = ?
+ORDER BY id;
+
+-- name: GetEnabledWebhookEndpointsByAccountId :many
+SELECT * FROM webhook_endpoint
+WHERE account_id = ? AND enabled = 1
+ORDER BY id;
+
+-- name: GetOrderedWebhookEndpointIds :many
+SELECT id FROM webhook_endpoint WHERE ordered = 1;
+
+-- name: CountWebhookEndpointsByAccountId :one
+SELECT COUNT(*) FROM webhook_endpoint WHERE account_id = ?;
+
+-- name: UpdateWebhookEndpoint :execrows
+UPDATE webhook_endpoint
+SET url = ?, events = ?, enabled = ?, ordered = ?, payload_version = ?, cloudevents = ?, failure_streak = ?,
+    disabled_reason = ?, updated_at = ?
+WHERE id = ? AND account_id = ?;
+
+-- name: ResetWebhookEndpointFailures :exec
+UPDATE webhook_endpoint SET failure_streak = 0 WHERE id = ?;
+
+-- name: IncrementWebhookEndpointFailures :one
+UPDATE webhook_endpoint
+SET failure_streak = failure_streak + 1
+WHERE id = ?
+RETURNING failure_streak;
+
+-- name: AutoDisableWebhookEndpoint :execrows
+UPDATE webhook_endpoint
+SET enabled = 0, disabled_reason = ?, updated_at = ?
+WHERE id = ? AND enabled = 1;
+
+-- name: RotateWebhookEndpointSecret :execrows
+UPDATE webhook_endpoint
+SET previous_secret = secret,
+    previous_expires_at = sqlc.arg(previous_expires_at),
+    secret = sqlc.arg(secret),
+    updated_at = sqlc.arg(updated_at)
+WHERE id = sqlc.arg(id) AND account_id = sqlc.arg(account_id);
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoint WHERE id = ? AND account_id = ?;
+
+-- name: InsertWebhookDelivery :exec
+INSERT INTO webhook_delivery (
+    endpoint_id, account_id, event_id, transfer_id, attempt, url, payload, request_body, status_code,
+    latency_ms, response_body, error, created_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetWebhookDeliveries :many
+SELECT * FROM webhook_delivery
+WHERE endpoint_id = sqlc.arg(endpoint_id)
+    AND (sqlc.narg(before_id) IS NULL OR id < sqlc.narg(before_id))
+ORDER BY id DESC
+LIMIT sqlc.arg('limit');
+
+-- name: GetAccountWebhookDeliveries :many
+SELECT * FROM webhook_delivery
+WHERE account_id = ?
+ORDER BY id DESC
+LIMIT ?;
+
+-- name: GetAccountWebhookDelivery :one
+SELECT * FROM webhook_delivery WHERE id = ? AND account_id = ?;
+
+-- name: DeleteWebhookDeliveriesBefore :execrows
+DELETE FROM webhook_delivery WHERE created_at < ?;
+
+-- name: GetWebhookDeliveryAttempts :many
+SELECT * FROM webhook_delivery
+WHERE endpoint_id = ? AND event_id = ?
+ORDER BY id DESC
+LIMIT ?;
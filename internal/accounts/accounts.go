@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/url"
 	"strings"
 	"time"
 
@@ -72,6 +71,51 @@ func (sendingAcc AccountCode) IdentifyTrCode(receivingAcc AccountCode) TrCode {
 	}
 }
 
+type AccountFlag uint8
+
+const AccFlagNone AccountFlag = 0
+
+const (
+	// Hides the account from public listings (e.g. ledger holder lists).
+	// The balance still counts towards ledger wide totals.
+	AccFlagPrivate AccountFlag = 1 << iota
+	AccFlagRESERVED2
+	AccFlagRESERVED3
+	AccFlagRESERVED4
+	AccFlagRESERVED5
+	// ...
+)
+
+func (f AccountFlag) Has(flag AccountFlag) bool {
+	return f&flag == flag
+}
+
+// SetAccountFlag sets or clears a flag on an account, returning the updated
+// flags. Should be called within a transaction.
+func SetAccountFlag(ctx context.Context, q *gensql.Queries, accId int64, flag AccountFlag, enabled bool) (AccountFlag, error) {
+	acc, err := q.GetAccountById(ctx, accId)
+	if err != nil {
+		return AccFlagNone, err
+	}
+
+	flags := AccountFlag(acc.Flags)
+	if enabled {
+		flags |= flag
+	} else {
+		flags &^= flag
+	}
+
+	_, err = q.UpdateAccountFlags(ctx, gensql.UpdateAccountFlagsParams{
+		Flags: int64(flags),
+		ID:    accId,
+	})
+	if err != nil {
+		return AccFlagNone, err
+	}
+
+	return flags, nil
+}
+
 var ErrInvalidAccountConfiguration = errors.New("accounts: invalid account configuration")
 var ErrAddressExceedsLength = fmt.Errorf("accounts: address exceeds max length (%v)", MaxAddressLength)
 var ErrDuplicateAddress = fmt.Errorf("accounts: address already taken")
@@ -109,8 +153,7 @@ func CreateAccount(ctx context.Context, q *gensql.Queries, input CreateAccountIn
 
 	// Verify webhook
 	if input.Webhook != nil {
-		_, err := url.ParseRequestURI(*input.Webhook)
-		if err != nil {
+		if err := ValidateWebhookUrl(*input.Webhook); err != nil {
 			return 0, err
 		}
 	}
@@ -128,11 +171,10 @@ func CreateAccount(ctx context.Context, q *gensql.Queries, input CreateAccountIn
 	// Insert the account and account permissions
 	accId, err := q.InsertAccount(ctx, gensql.InsertAccountParams{
 		Address:   input.Address,
-		Webhook:   input.Webhook,
 		UserID:    user,
 		LedgerID:  input.LedgerId,
 		Code:      int64(input.Code),
-		Flags:     0,
+		Flags:     int64(AccFlagNone),
 		CreatedAt: time.Now(),
 	})
 	if err != nil {
@@ -149,6 +191,18 @@ func CreateAccount(ctx context.Context, q *gensql.Queries, input CreateAccountIn
 		return 0, err
 	}
 
+	if input.Webhook != nil {
+		_, err = CreateWebhook(ctx, q, CreateWebhookInput{
+			AccountId: accId,
+			Url:       *input.Webhook,
+			Events:    WebhookEventsTransfers,
+			Enabled:   true,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return accId, nil
 }
 
@@ -0,0 +1,273 @@
+package accounts
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+// Transfers pulled through an allowance carry its ID under this metadata key.
+const AllowanceMetadataKey = "allowanceId"
+
+const MaxAllowancePeriodDays = 366
+
+var ErrAllowanceNotFound = errors.New("allowance: not found")
+var ErrAllowanceInvalid = errors.New("allowance: invalid configuration")
+var ErrAllowanceInactive = errors.New("allowance: revoked or expired")
+var ErrAllowanceExceeded = errors.New("allowance: amount exceeds remaining allowance")
+
+type CreateAllowanceInput struct {
+	OwnerId    int64 // Account being debited
+	SpenderId  int64 // Account allowed to pull from the owner
+	Amount     int64 // Limit, per period if PeriodDays is set
+	PeriodDays *int64
+	ExpiresAt  *time.Time
+}
+
+// CreateAllowance grants the spender permission to pull up to the amount from
+// the owner's account.
+func CreateAllowance(ctx context.Context, q *gensql.Queries, input CreateAllowanceInput) (int64, error) {
+	if input.Amount < 1 {
+		return 0, ErrInvalidQuantity
+	}
+	if input.OwnerId == input.SpenderId {
+		return 0, ErrMatchingSenderReceiver
+	}
+	if input.PeriodDays != nil && (*input.PeriodDays < 1 || *input.PeriodDays > MaxAllowancePeriodDays) {
+		return 0, ErrAllowanceInvalid
+	}
+	now := time.Now()
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(now) {
+		return 0, ErrAllowanceInvalid
+	}
+
+	ownerAcc, err := q.GetAccountById(ctx, input.OwnerId)
+	if err != nil {
+		return 0, err
+	}
+	spenderAcc, err := q.GetAccountById(ctx, input.SpenderId)
+	if err != nil {
+		return 0, err
+	}
+	if ownerAcc.LedgerID != spenderAcc.LedgerID {
+		return 0, ErrIncompatibleLedgers
+	}
+
+	var expiresAt *time.Time
+	if input.ExpiresAt != nil {
+		t := input.ExpiresAt.Round(0)
+		expiresAt = &t
+	}
+
+	return q.InsertAllowance(ctx, gensql.InsertAllowanceParams{
+		OwnerAccountID:   input.OwnerId,
+		SpenderAccountID: input.SpenderId,
+		Amount:           input.Amount,
+		PeriodDays:       input.PeriodDays,
+		ExpiresAt:        expiresAt,
+		Spent:            0,
+		PeriodStart:      now,
+		CreatedAt:        now,
+	})
+}
+
+// RevokeAllowance revokes an allowance granted by accId. Revoking an already
+// revoked allowance is a no-op.
+func RevokeAllowance(ctx context.Context, q *gensql.Queries, accId, allowanceId int64) error {
+	allowance, err := q.GetAllowanceById(ctx, allowanceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAllowanceNotFound
+		}
+		return err
+	}
+	if allowance.OwnerAccountID != accId {
+		return ErrAllowanceNotFound
+	}
+
+	now := time.Now()
+	_, err = q.UpdateAllowanceRevoked(ctx, gensql.UpdateAllowanceRevokedParams{
+		RevokedAt: &now,
+		ID:        allowanceId,
+	})
+	return err
+}
+
+// AllowancePeriod returns the start of the allowance's current period and how
+// much has been spent in it, rolling the period forward if it has elapsed.
+func AllowancePeriod(allowance gensql.Allowance, now time.Time) (time.Time, int64) {
+	if allowance.PeriodDays == nil {
+		return allowance.PeriodStart, allowance.Spent
+	}
+
+	length := time.Duration(*allowance.PeriodDays) * 24 * time.Hour
+	elapsed := now.Sub(allowance.PeriodStart)
+	if elapsed < length {
+		return allowance.PeriodStart, allowance.Spent
+	}
+	// Periods are back to back, so skip over any without pulls
+	return allowance.PeriodStart.Add(elapsed / length * length), 0
+}
+
+// AllowanceRemaining is how much the spender can still pull right now.
+func AllowanceRemaining(allowance gensql.Allowance, now time.Time) int64 {
+	if !IsAllowanceActive(allowance, now) {
+		return 0
+	}
+	_, spent := AllowancePeriod(allowance, now)
+	return max(allowance.Amount-spent, 0)
+}
+
+func IsAllowanceActive(allowance gensql.Allowance, now time.Time) bool {
+	if allowance.RevokedAt != nil {
+		return false
+	}
+	return allowance.ExpiresAt == nil || now.Before(*allowance.ExpiresAt)
+}
+
+type PullTransferInput struct {
+	AllowanceId    int64
+	SpenderId      int64 // Account pulling, receives the transfer
+	Amount         int64
+	Memo           *string
+	Metadata       map[string]string
+	IdempotencyKey string
+	Initiator      Initiator
+}
+
+// PullTransfer creates a transfer from an allowance's owner to its spender,
+// recording it against the allowance. Like CreateTransfer it must be called
+// within a transaction, and replaying an idempotency key returns the original
+// transfer without spending the allowance again.
+func PullTransfer(ctx context.Context, q *gensql.Queries, input PullTransferInput) (CreateTransferResult, error) {
+	var result CreateTransferResult
+
+	allowance, trInput, err := pullTransferInput(ctx, q, input)
+	if err != nil {
+		return result, err
+	}
+
+	trResult, err := CreateTransfer(ctx, q, trInput)
+	if err != nil {
+		return result, err
+	}
+	if !trResult.Created {
+		return trResult, nil
+	}
+
+	// Only charge the allowance for new transfers
+	now := time.Now()
+	if !IsAllowanceActive(allowance, now) {
+		return result, ErrAllowanceInactive
+	}
+	periodStart, spent := AllowancePeriod(allowance, now)
+	if input.Amount > allowance.Amount-spent {
+		return result, ErrAllowanceExceeded
+	}
+
+	rows, err := q.UpdateAllowanceSpent(ctx, gensql.UpdateAllowanceSpentParams{
+		Spent:       spent + input.Amount,
+		PeriodStart: periodStart,
+		ID:          allowance.ID,
+		FromSpent:   allowance.Spent,
+	})
+	if err != nil {
+		return result, err
+	}
+	if rows == 0 {
+		// Another pull spent from the allowance since it was read
+		return result, ErrAllowanceExceeded
+	}
+
+	err = q.InsertAllowancePull(ctx, gensql.InsertAllowancePullParams{
+		TransferID:  trResult.TransferID,
+		AllowanceID: allowance.ID,
+		Amount:      input.Amount,
+		CreatedAt:   now,
+	})
+	if err != nil {
+		return result, err
+	}
+
+	return trResult, nil
+}
+
+// ResolvePullRace looks up the transfer that won an idempotency race
+// (ErrIdempotencyRace) for a pull. It must be called outside of the failed
+// transaction, and returns ErrIdempotencyConflict if the winning request
+// differs.
+func ResolvePullRace(ctx context.Context, q *gensql.Queries, input PullTransferInput) (int64, error) {
+	_, trInput, err := pullTransferInput(ctx, q, input)
+	if err != nil {
+		return 0, err
+	}
+
+	existing, err := q.GetTransferIdempotency(ctx, gensql.GetTransferIdempotencyParams{
+		AccountID: trInput.SendingId,
+		Key:       trInput.IdempotencyKey,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if existing.RequestHash != TransferRequestHash(trInput.ReceivingId, trInput.Amount, trInput.LedgerId, trInput.Memo, trInput.Metadata, trInput.InvoiceId) {
+		return 0, ErrIdempotencyConflict
+	}
+	return existing.TransferID, nil
+}
+
+// pullTransferInput resolves the transfer a pull makes.
+func pullTransferInput(ctx context.Context, q *gensql.Queries, input PullTransferInput) (gensql.Allowance, CreateTransferInput, error) {
+	key := strings.TrimSpace(input.IdempotencyKey)
+	if key == "" {
+		return gensql.Allowance{}, CreateTransferInput{}, ErrIdempotencyKeyRequired
+	}
+	if len(key) > MaxIdempotencyKeyLen {
+		return gensql.Allowance{}, CreateTransferInput{}, ErrIdempotencyKeyInvalid
+	}
+
+	allowance, err := q.GetAllowanceById(ctx, input.AllowanceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return allowance, CreateTransferInput{}, ErrAllowanceNotFound
+		}
+		return allowance, CreateTransferInput{}, err
+	}
+	if allowance.SpenderAccountID != input.SpenderId {
+		return allowance, CreateTransferInput{}, ErrAllowanceNotFound
+	}
+
+	ownerAcc, err := q.GetAccountById(ctx, allowance.OwnerAccountID)
+	if err != nil {
+		return allowance, CreateTransferInput{}, err
+	}
+
+	metadata := maps.Clone(input.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+	metadata[AllowanceMetadataKey] = strconv.FormatInt(allowance.ID, 10)
+
+	// Idempotency keys are scoped to the sending account (the owner), so
+	// namespace the spender's key to keep it from colliding with the owner's.
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d|%s", allowance.ID, key))
+
+	return allowance, CreateTransferInput{
+		SendingId:      allowance.OwnerAccountID,
+		ReceivingId:    allowance.SpenderAccountID,
+		Memo:           input.Memo,
+		Metadata:       metadata,
+		LedgerId:       ownerAcc.LedgerID,
+		Amount:         input.Amount,
+		IdempotencyKey: "pull_" + hex.EncodeToString(sum[:20]),
+		Initiator:      input.Initiator,
+	}, nil
+}
@@ -0,0 +1,159 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+// AdminAction is something done with the admin key, kept in the admin audit
+// log.
+type AdminAction string
+
+const (
+	AdminLedgerCreated       AdminAction = "ledger.created"
+	AdminAccountCreated      AdminAction = "account.created"
+	AdminAddressUpdated      AdminAction = "account.address_updated"
+	AdminBalanceAdjusted     AdminAction = "account.balance_adjusted"
+	AdminUserViewed          AdminAction = "user.viewed"
+	AdminLoginBypassed       AdminAction = "auth.login_bypassed"
+	AdminDeadLetterReplayed  AdminAction = "dead_letter.replayed"
+	AdminDeadLetterDiscarded AdminAction = "dead_letter.discarded"
+)
+
+type AdminAuditInput struct {
+	Action    AdminAction
+	Target    string // What was acted on, e.g. "account:42"
+	Before    any    // Marshalled to JSON, nil when the action created the target
+	After     any    // Marshalled to JSON, nil when the action changed nothing
+	SourceIp  string
+	RequestId *string
+
+	ClientRequestId *string
+}
+
+// AuditChange is a field's JSON value before and after an admin action.
+type AuditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// EventAdminAudit is published for every admin audit log entry, and kept in
+// the ADMIN_AUDIT stream.
+type EventAdminAudit struct {
+	ID        int64                  `json:"id"`
+	Action    AdminAction            `json:"action"`
+	Target    string                 `json:"target"`
+	Diff      map[string]AuditChange `json:"diff"`
+	SourceIp  string                 `json:"sourceIp"`
+	RequestId *string                `json:"requestId"`
+	CreatedAt time.Time              `json:"createdAt"`
+
+	ClientRequestId *string `json:"clientRequestId"`
+}
+
+func (e EventAdminAudit) Subject() string {
+	// admin.audit.{action}
+	return "admin.audit." + string(e.Action)
+}
+
+// RecordAdminAction appends the action to the admin audit log, and its event
+// to the outbox. Call it within the action's transaction, so actions aren't
+// made without a record of them.
+func RecordAdminAction(ctx context.Context, q *gensql.Queries, input AdminAuditInput) error {
+	diff, err := AuditDiff(input.Before, input.After)
+	if err != nil {
+		return err
+	}
+	diffJSON, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	entry, err := q.InsertAdminAuditEntry(ctx, gensql.InsertAdminAuditEntryParams{
+		Action:    string(input.Action),
+		Target:    input.Target,
+		Diff:      string(diffJSON),
+		SourceIp:  input.SourceIp,
+		RequestID: input.RequestId,
+		CreatedAt: now,
+
+		ClientRequestID: truncateRequestId(input.ClientRequestId),
+	})
+	if err != nil {
+		return err
+	}
+
+	e := EventAdminAudit{
+		ID:        entry.ID,
+		Action:    input.Action,
+		Target:    entry.Target,
+		Diff:      diff,
+		SourceIp:  entry.SourceIp,
+		RequestId: entry.RequestID,
+		CreatedAt: entry.CreatedAt,
+
+		ClientRequestId: entry.ClientRequestID,
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return q.InsertOutboxEntry(ctx, gensql.InsertOutboxEntryParams{
+		Kind:          int64(OutboxAuditEvent),
+		Subject:       e.Subject(),
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// AuditDiff compares the top level fields of before and after once
+// marshalled to JSON, returning the ones that changed. Fields missing from
+// either side count as null.
+func AuditDiff(before, after any) (map[string]AuditChange, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := make(map[string]AuditChange)
+	for k, b := range beforeFields {
+		a, ok := afterFields[k]
+		if !ok {
+			a = json.RawMessage("null")
+		}
+		if !bytes.Equal(a, b) {
+			diff[k] = AuditChange{Before: b, After: a}
+		}
+	}
+	for k, a := range afterFields {
+		if _, ok := beforeFields[k]; !ok && !bytes.Equal(a, []byte("null")) {
+			diff[k] = AuditChange{Before: json.RawMessage("null"), After: a}
+		}
+	}
+	return diff, nil
+}
+
+func auditFields(v any) (map[string]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
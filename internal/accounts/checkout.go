@@ -0,0 +1,114 @@
+package accounts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+var ErrCheckoutSecretRequired = errors.New("checkout: account has no checkout secret")
+var ErrCheckoutUrlInvalid = errors.New("checkout: invalid redirect url")
+
+// How long a rotated out checkout secret keeps signing redirects
+const CheckoutSecretOverlap = 24 * time.Hour
+
+// RotateCheckoutSecret generates a new checkout secret for the account. Like
+// webhook secrets, the current one keeps signing redirects alongside it for
+// CheckoutSecretOverlap, replacing any previous secret still doing so.
+func RotateCheckoutSecret(ctx context.Context, q *gensql.Queries, accId int64) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(CheckoutSecretOverlap)
+	secret := uniuri.NewLen(40)
+	err := q.UpsertCheckoutSecret(ctx, gensql.UpsertCheckoutSecretParams{
+		AccountID:         accId,
+		Secret:            secret,
+		CreatedAt:         now,
+		PreviousExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ValidateCheckoutUrl ensures a return or cancel URL is an absolute http(s)
+// URL, so users can't be redirected anywhere else (e.g. javascript:).
+func ValidateCheckoutUrl(raw string) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ErrCheckoutUrlInvalid
+	}
+	return nil
+}
+
+// SignCheckoutResult is the HMAC-SHA256 (hex) of the checkout result, which
+// merchants recompute with their checkout secret to verify a redirect.
+func SignCheckoutResult(secret string, sessionId, transferId, amount, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%d.%d.%d", sessionId, transferId, amount, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckoutReturnUrl builds the signed URL a user is sent back to after paying
+// a checkout session (an invoice with a return URL).
+func CheckoutReturnUrl(ctx context.Context, q *gensql.Queries, inv gensql.Invoice, transferId int64) (string, error) {
+	if inv.ReturnUrl == nil {
+		return "", ErrCheckoutUrlInvalid
+	}
+	u, err := url.Parse(*inv.ReturnUrl)
+	if err != nil {
+		return "", err
+	}
+
+	secrets, err := q.GetCheckoutSecret(ctx, inv.AccountID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrCheckoutSecretRequired
+		}
+		return "", err
+	}
+
+	now := time.Now()
+	timestamp := now.Unix()
+	query := u.Query()
+	query.Set("session_id", strconv.FormatInt(inv.ID, 10))
+	query.Set("transfer_id", strconv.FormatInt(transferId, 10))
+	query.Set("amount", strconv.FormatInt(inv.Amount, 10))
+	query.Set("timestamp", strconv.FormatInt(timestamp, 10))
+	query.Set("signature", SignCheckoutResult(secrets.Secret, inv.ID, transferId, inv.Amount, timestamp))
+	// Also signed with the previous secret, so merchants still on it verify
+	if secrets.PreviousSecret != nil && secrets.PreviousExpiresAt != nil && now.Before(*secrets.PreviousExpiresAt) {
+		query.Add("signature", SignCheckoutResult(*secrets.PreviousSecret, inv.ID, transferId, inv.Amount, timestamp))
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// CheckoutCancelUrl is the URL a user is sent to when backing out of a
+// checkout session. It isn't signed, as it proves nothing.
+func CheckoutCancelUrl(inv gensql.Invoice) (string, error) {
+	if inv.CancelUrl == nil {
+		return "", ErrCheckoutUrlInvalid
+	}
+	u, err := url.Parse(*inv.CancelUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("session_id", strconv.FormatInt(inv.ID, 10))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
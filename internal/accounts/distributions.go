@@ -0,0 +1,289 @@
+package accounts
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+var ErrDistributionNoHolders = errors.New("distribution: no eligible holders")
+var ErrDistributionSnapshotInFuture = errors.New("distribution: snapshot is in the future")
+
+type CreateDistributionInput struct {
+	SourceId       int64 // Account paying out, its ledger is the payout ledger
+	HolderLedgerId int64 // Ledger whose holders receive the distribution
+	Amount         int64 // Total amount to distribute
+	Memo           *string
+	SnapshotAt     *time.Time // Point in time holder balances are taken at, defaults to now
+	IdempotencyKey string
+	Initiator      Initiator // Of each payout's transfer
+}
+
+type DistributionPayout struct {
+	HolderAccId   int64
+	PayoutAccId   int64
+	HolderBalance int64
+	Amount        int64
+}
+
+type DistributionPlan struct {
+	PayoutLedgerId int64
+	SnapshotAt     time.Time
+	Payouts        []DistributionPayout
+	// Holders that couldn't be paid, as their owner has no account on the
+	// payout ledger. These are left out of the pro-rata calculation entirely.
+	Skipped []int64
+}
+
+// PlanDistribution computes who gets paid what for a distribution without
+// writing anything, so it also serves as the dry run.
+//
+// Holder balances are worked back from the current balances to the snapshot,
+// like statements' opening balances. Each holder is paid out to the account on
+// the payout ledger owned by the same primary user.
+func PlanDistribution(ctx context.Context, q *gensql.Queries, input CreateDistributionInput) (DistributionPlan, error) {
+	var plan DistributionPlan
+
+	if input.Amount < 1 {
+		return plan, ErrInvalidQuantity
+	}
+	if input.Memo != nil && len(*input.Memo) > 50 {
+		return plan, ErrMemoExceedsLimit
+	}
+
+	plan.SnapshotAt = time.Now().Round(0)
+	if input.SnapshotAt != nil {
+		if input.SnapshotAt.After(plan.SnapshotAt) {
+			return plan, ErrDistributionSnapshotInFuture
+		}
+		plan.SnapshotAt = input.SnapshotAt.Round(0)
+	}
+
+	sourceAcc, err := q.GetAccountById(ctx, input.SourceId)
+	if err != nil {
+		return plan, err
+	}
+	plan.PayoutLedgerId = sourceAcc.LedgerID
+
+	// Times are stored in the server's zone, so compare in it as well
+	balances, err := q.GetLedgerBalancesAt(ctx, gensql.GetLedgerBalancesAtParams{
+		LedgerID:   input.HolderLedgerId,
+		SnapshotAt: plan.SnapshotAt.In(time.Local),
+	})
+	if err != nil {
+		return plan, err
+	}
+
+	matches, err := q.GetDistributionPayoutAccounts(ctx, gensql.GetDistributionPayoutAccountsParams{
+		PayoutLedgerID: sourceAcc.LedgerID,
+		HolderLedgerID: input.HolderLedgerId,
+	})
+	if err != nil {
+		return plan, err
+	}
+	// Prefer the owner's lowest account id
+	payoutAccs := make(map[int64]gensql.GetDistributionPayoutAccountsRow, len(matches))
+	for _, m := range matches {
+		cur, ok := payoutAccs[m.HolderAccountID]
+		if !ok || m.PayoutAccountID < cur.PayoutAccountID {
+			payoutAccs[m.HolderAccountID] = m
+		}
+	}
+
+	weights := make([]int64, 0, len(balances))
+	for _, bal := range balances {
+		if bal.ID == input.SourceId || bal.Balance <= 0 {
+			continue
+		}
+		payoutAcc, ok := payoutAccs[bal.ID]
+		if !ok || payoutAcc.PayoutAccountID == input.SourceId {
+			plan.Skipped = append(plan.Skipped, bal.ID)
+			continue
+		}
+		plan.Payouts = append(plan.Payouts, DistributionPayout{
+			HolderAccId:   bal.ID,
+			PayoutAccId:   payoutAcc.PayoutAccountID,
+			HolderBalance: bal.Balance,
+		})
+		weights = append(weights, bal.Balance)
+	}
+	if len(plan.Payouts) == 0 {
+		return plan, ErrDistributionNoHolders
+	}
+
+	for i, amount := range allocateProRata(input.Amount, weights) {
+		plan.Payouts[i].Amount = amount
+	}
+
+	return plan, nil
+}
+
+type CreateDistributionResult struct {
+	DistributionID int64
+	Created        bool
+}
+
+// CreateDistribution plans and pays out a distribution as one batch. It must
+// be called within a transaction, so either every payout lands or none do.
+//
+// Replaying the same idempotency key returns the original distribution, and
+// every payout transfer carries its own idempotency key, so a retried
+// distribution never pays a holder twice.
+func CreateDistribution(ctx context.Context, q *gensql.Queries, input CreateDistributionInput) (CreateDistributionResult, error) {
+	var result CreateDistributionResult
+
+	key := strings.TrimSpace(input.IdempotencyKey)
+	if key == "" {
+		return result, ErrIdempotencyKeyRequired
+	}
+	if len(key) > MaxIdempotencyKeyLen {
+		return result, ErrIdempotencyKeyInvalid
+	}
+
+	reqHash := DistributionRequestHash(input.HolderLedgerId, input.Amount, input.SnapshotAt, input.Memo)
+
+	// Idempotent replay / conflict check
+	existing, err := q.GetDistributionByKey(ctx, gensql.GetDistributionByKeyParams{
+		SourceAccountID: input.SourceId,
+		IdempotencyKey:  key,
+	})
+	if err == nil {
+		if existing.RequestHash != reqHash {
+			return result, ErrIdempotencyConflict
+		}
+		result.DistributionID = existing.ID
+		result.Created = false
+		return result, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return result, err
+	}
+
+	plan, err := PlanDistribution(ctx, q, input)
+	if err != nil {
+		return result, err
+	}
+
+	distId, err := q.InsertDistribution(ctx, gensql.InsertDistributionParams{
+		SourceAccountID: input.SourceId,
+		HolderLedgerID:  input.HolderLedgerId,
+		Amount:          input.Amount,
+		Memo:            input.Memo,
+		SnapshotAt:      plan.SnapshotAt,
+		IdempotencyKey:  key,
+		RequestHash:     reqHash,
+		CreatedAt:       time.Now(),
+	})
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			return result, ErrIdempotencyRace
+		}
+		return result, err
+	}
+
+	for _, payout := range plan.Payouts {
+		var trId *int64
+		// Shares that round down to 0 are still recorded, just not transferred
+		if payout.Amount > 0 {
+			trResult, err := CreateTransfer(ctx, q, CreateTransferInput{
+				SendingId:      input.SourceId,
+				ReceivingId:    payout.PayoutAccId,
+				Memo:           input.Memo,
+				Metadata:       map[string]string{"distributionId": strconv.FormatInt(distId, 10)},
+				LedgerId:       plan.PayoutLedgerId,
+				Amount:         payout.Amount,
+				IdempotencyKey: fmt.Sprintf("dist_%d_%d", distId, payout.HolderAccId),
+				Initiator:      input.Initiator,
+			})
+			if err != nil {
+				return result, err
+			}
+			trId = &trResult.TransferID
+		}
+
+		err = q.InsertDistributionPayout(ctx, gensql.InsertDistributionPayoutParams{
+			DistributionID:  distId,
+			HolderAccountID: payout.HolderAccId,
+			PayoutAccountID: payout.PayoutAccId,
+			HolderBalance:   payout.HolderBalance,
+			Amount:          payout.Amount,
+			TransferID:      trId,
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.DistributionID = distId
+	result.Created = true
+	return result, nil
+}
+
+// DistributionRequestHash is the stable fingerprint of a create-distribution
+// intent, used for idempotency conflict detection like TransferRequestHash.
+func DistributionRequestHash(holderLedgerId, amount int64, snapshotAt *time.Time, memo *string) string {
+	m := ""
+	if memo != nil {
+		m = *memo
+	}
+	s := ""
+	if snapshotAt != nil {
+		s = snapshotAt.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d|%d|%s|%s", holderLedgerId, amount, s, m))
+	return hex.EncodeToString(sum[:])
+}
+
+// allocateProRata splits total across weights proportionally using the
+// largest remainder method. Everyone gets the floor of their exact share, then
+// the leftover units go one each to the largest remainders, with ties going
+// to the lower index. The result sums to total unless every weight is zero,
+// in which case nobody gets anything.
+func allocateProRata(total int64, weights []int64) []int64 {
+	amounts := make([]int64, len(weights))
+
+	sum := new(big.Int)
+	for _, w := range weights {
+		sum.Add(sum, big.NewInt(w))
+	}
+	if sum.Sign() == 0 {
+		return amounts
+	}
+
+	bigTotal := big.NewInt(total)
+	remainders := make([]*big.Int, len(weights))
+	leftover := total
+	for i, w := range weights {
+		share, rem := new(big.Int).QuoRem(new(big.Int).Mul(bigTotal, big.NewInt(w)), sum, new(big.Int))
+		amounts[i] = share.Int64()
+		remainders[i] = rem
+		leftover -= amounts[i]
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		if c := remainders[b].Cmp(remainders[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	for _, i := range order[:leftover] {
+		amounts[i]++
+	}
+
+	return amounts
+}
@@ -0,0 +1,61 @@
+package accounts
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAllocateProRata(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{"no holders", 100, nil, []int64{}},
+		{"all zero weights", 100, []int64{0, 0, 0}, []int64{0, 0, 0}},
+		{"single holder", 101, []int64{7}, []int64{101}},
+		{"single holder among zero weights", 101, []int64{0, 7, 0}, []int64{0, 101, 0}},
+		{"exact split", 100, []int64{1, 3}, []int64{25, 75}},
+		{"zero total", 0, []int64{1, 2, 3}, []int64{0, 0, 0}},
+		{"largest remainder wins", 10, []int64{1, 2}, []int64{3, 7}},
+		{"remainder ties go to lower index", 10, []int64{1, 1, 1}, []int64{4, 3, 3}},
+		{"remainder ties skip zero weights", 2, []int64{0, 1, 1, 1}, []int64{0, 1, 1, 0}},
+		{"huge weights", 3, []int64{1 << 62, 1 << 62, 1 << 62}, []int64{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allocateProRata(tt.total, tt.weights)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("allocateProRata(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateProRataSumsToTotal(t *testing.T) {
+	weights := [][]int64{
+		{1},
+		{1, 1, 1},
+		{3, 5, 7, 11},
+		{0, 1, 0, 2},
+		{999_999_937, 1, 2},
+		{1 << 40, 1 << 20, 1},
+	}
+	for _, w := range weights {
+		for _, total := range []int64{0, 1, 2, 7, 100, 1_000_003, 1 << 50} {
+			got := allocateProRata(total, w)
+			var sum int64
+			for _, a := range got {
+				sum += a
+			}
+			if sum != total {
+				t.Errorf("allocateProRata(%d, %v) = %v, sums to %d", total, w, got, sum)
+			}
+			// The same input always splits the same way
+			if again := allocateProRata(total, w); !slices.Equal(got, again) {
+				t.Errorf("allocateProRata(%d, %v) = %v then %v", total, w, got, again)
+			}
+		}
+	}
+}
@@ -7,12 +7,12 @@ import (
 	"time"
 )
 
-type EventPublisher func() error
-
-// WebhookEnqueuer enqueues a durable webhook delivery for a transfer event.
-// Implementations should persist the job (e.g. JetStream) before returning.
+// WebhookEnqueuer enqueues a durable webhook delivery of a transfer or
+// permission event to an endpoint. Implementations should persist the job
+// (e.g. JetStream) before returning, and enqueue it once per dedupeID.
 type WebhookEnqueuer interface {
-	EnqueueTransferWebhook(ctx context.Context, accountID int64, url string, event EventTransfer) error
+	EnqueueTransferWebhook(ctx context.Context, dedupeID string, accountID, endpointID int64, url string, transfer WebhookTransfer) error
+	EnqueuePermissionWebhook(ctx context.Context, dedupeID string, accountID, endpointID int64, url string, event EventAccountPermission) error
 }
 
 type Event interface {
@@ -48,9 +48,10 @@ type EventTransfer struct {
 	LedgerID int64 `json:"ledgerId"`
 
 	// Flags int64 `json:"flags"`
-	Code      TrCode    `json:"code"`
-	Memo      *string   `json:"memo,omitempty"`
-	CreatedAt time.Time `json:"createdAt"`
+	Code      TrCode            `json:"code"`
+	Memo      *string           `json:"memo,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
 }
 
 func (e EventTransfer) Subject() string {
@@ -59,15 +60,48 @@ func (e EventTransfer) Subject() string {
 	return fmt.Sprintf("accounts.transfers.%v.%v", sender, receiver)
 }
 
-type EventAccountPermissionCreated struct {
-	PermissionID int64     `json:"id"`
-	AccountId    int64     `json:"accId"`
-	UserId       int64     `json:"userId"`
-	Permissions  int64     `json:"permissions"`
-	CreatedAt    time.Time `json:"createdAt"`
+type PermissionChange string
+
+const (
+	PermissionCreated  PermissionChange = "permission.created"
+	PermissionUpdated  PermissionChange = "permission.updated"
+	PermissionDeleted  PermissionChange = "permission.deleted"
+	PrimaryUserChanged PermissionChange = "primary_user.changed"
+	TokenCreated       PermissionChange = "token.created"
+	TokensRevoked      PermissionChange = "tokens.revoked"
+)
+
+// EventAccountPermission is published when who can use an account changes:
+// a user's permissions on it, its primary user, or its API tokens.
+type EventAccountPermission struct {
+	ID        string           `json:"id"` // Unique to the change
+	Type      PermissionChange `json:"type"`
+	AccountId int64            `json:"accId"`
+	// The user whose permissions changed, or the new primary user. Nil for
+	// tokens, and when the primary user is cleared
+	UserId      *int64    `json:"userId"`
+	Permissions *int64    `json:"permissions,omitempty"` // The user's permissions, unless deleted
+	Tokens      *int      `json:"tokens,omitempty"`      // How many tokens were created or revoked
+	ChangedBy   int64     `json:"changedBy"`             // The user who made the change
+	CreatedAt   time.Time `json:"createdAt"`
 }
 
-func (e EventAccountPermissionCreated) Subject() string {
+func (e EventAccountPermission) Subject() string {
 	// accounts.permissions.{account_id}
 	return fmt.Sprintf("accounts.permissions.%v", e.AccountId)
 }
+
+// EventWebhookDisabled is published when a webhook endpoint is disabled for
+// failing too many times in a row.
+type EventWebhookDisabled struct {
+	WebhookID     int64     `json:"id"`
+	AccountId     int64     `json:"accId"`
+	Url           string    `json:"url"`
+	FailureStreak int64     `json:"failureStreak"`
+	DisabledAt    time.Time `json:"disabledAt"`
+}
+
+func (e EventWebhookDisabled) Subject() string {
+	// accounts.webhooks.{account_id}
+	return fmt.Sprintf("accounts.webhooks.%v", e.AccountId)
+}
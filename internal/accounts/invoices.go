@@ -0,0 +1,216 @@
+package accounts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+type InvoiceStatus int32
+
+const (
+	InvOpen InvoiceStatus = iota
+	InvPaid
+	InvCancelled
+
+	// Never stored, an open invoice past its expiry is reported as expired
+	InvExpired
+)
+
+func (s InvoiceStatus) String() string {
+	switch s {
+	case InvOpen:
+		return "open"
+	case InvPaid:
+		return "paid"
+	case InvCancelled:
+		return "cancelled"
+	case InvExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseInvoiceStatus is the inverse of InvoiceStatus.String.
+func ParseInvoiceStatus(s string) (InvoiceStatus, bool) {
+	for _, status := range []InvoiceStatus{InvOpen, InvPaid, InvCancelled, InvExpired} {
+		if status.String() == s {
+			return status, true
+		}
+	}
+	return InvOpen, false
+}
+
+// EffectiveInvoiceStatus is the status of the invoice as seen by users,
+// accounting for expiry.
+func EffectiveInvoiceStatus(inv gensql.Invoice, now time.Time) InvoiceStatus {
+	status := InvoiceStatus(inv.Status)
+	if status == InvOpen && !now.Before(inv.ExpiresAt) {
+		return InvExpired
+	}
+	return status
+}
+
+const (
+	DefaultInvoiceExpiry = 7 * 24 * time.Hour
+	MaxInvoiceExpiry     = 90 * 24 * time.Hour
+)
+
+var ErrInvoiceNotFound = errors.New("invoice: not found")
+var ErrInvoiceNotOpen = errors.New("invoice: not open")
+var ErrInvoiceMismatch = errors.New("invoice: transfer doesn't match invoice")
+var ErrInvoiceExpiryInvalid = errors.New("invoice: invalid expiry")
+
+type CreateInvoiceInput struct {
+	AccountId int64 // Account receiving the payment
+	Amount    int64
+	Memo      *string
+	ExpiresAt *time.Time // Defaults to DefaultInvoiceExpiry from now
+
+	// Makes the invoice a checkout session, sending the user back to the
+	// merchant once paid (or cancelled)
+	ReturnUrl *string
+	CancelUrl *string
+}
+
+// CreateInvoice creates an open invoice, returning its ID and the token used
+// in its payment link.
+func CreateInvoice(ctx context.Context, q *gensql.Queries, input CreateInvoiceInput) (int64, string, error) {
+	if input.Amount < 1 {
+		return 0, "", ErrInvalidQuantity
+	}
+	if input.Memo != nil && len(*input.Memo) > 50 {
+		return 0, "", ErrMemoExceedsLimit
+	}
+
+	acc, err := q.GetAccountById(ctx, input.AccountId)
+	if err != nil {
+		return 0, "", err
+	}
+	// Payments to credit accounts aren't allowed through requests
+	if AccountCode(acc.Code).IsCredit() {
+		return 0, "", ErrIncompatibleAccCodes
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(DefaultInvoiceExpiry)
+	if input.ExpiresAt != nil {
+		if !input.ExpiresAt.After(now) || input.ExpiresAt.Sub(now) > MaxInvoiceExpiry {
+			return 0, "", ErrInvoiceExpiryInvalid
+		}
+		expiresAt = *input.ExpiresAt
+	}
+
+	if input.ReturnUrl != nil {
+		if err := ValidateCheckoutUrl(*input.ReturnUrl); err != nil {
+			return 0, "", err
+		}
+		// Redirects can't be signed without a secret
+		_, err := q.GetCheckoutSecret(ctx, input.AccountId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, "", ErrCheckoutSecretRequired
+			}
+			return 0, "", err
+		}
+	}
+	if input.CancelUrl != nil {
+		if err := ValidateCheckoutUrl(*input.CancelUrl); err != nil {
+			return 0, "", err
+		}
+	}
+
+	token := uniuri.NewLen(24)
+	invId, err := q.InsertInvoice(ctx, gensql.InsertInvoiceParams{
+		Token:     token,
+		AccountID: input.AccountId,
+		Amount:    input.Amount,
+		Memo:      input.Memo,
+		Status:    int64(InvOpen),
+		ExpiresAt: expiresAt.Round(0),
+		ReturnUrl: input.ReturnUrl,
+		CancelUrl: input.CancelUrl,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	return invId, token, nil
+}
+
+// CancelInvoice cancels an open invoice belonging to accId.
+func CancelInvoice(ctx context.Context, q *gensql.Queries, accId, invId int64) error {
+	inv, err := q.GetInvoiceById(ctx, invId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvoiceNotFound
+		}
+		return err
+	}
+	if inv.AccountID != accId {
+		return ErrInvoiceNotFound
+	}
+	if EffectiveInvoiceStatus(inv, time.Now()) != InvOpen {
+		return ErrInvoiceNotOpen
+	}
+
+	rows, err := q.UpdateInvoiceStatus(ctx, gensql.UpdateInvoiceStatusParams{
+		Status:     int64(InvCancelled),
+		ID:         invId,
+		FromStatus: int64(InvOpen),
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInvoiceNotOpen
+	}
+	return nil
+}
+
+// InvoiceLink is the path of the page an invoice is paid through.
+func InvoiceLink(token string) string {
+	return "/app/request?invoice=" + token
+}
+
+// settleInvoice marks invoice invId, the transfer's InvoiceId, as paid by
+// transfer trId. The transfer must exactly match the invoice, and the invoice
+// must be open. Called by CreateTransfer within its transaction.
+func settleInvoice(ctx context.Context, q *gensql.Queries, invId int64, trId int64, input CreateTransferInput, now time.Time) error {
+	inv, err := q.GetInvoiceById(ctx, invId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvoiceNotFound
+		}
+		return err
+	}
+
+	if inv.AccountID != input.ReceivingId || inv.Amount != input.Amount {
+		return ErrInvoiceMismatch
+	}
+	if EffectiveInvoiceStatus(inv, now) != InvOpen {
+		return ErrInvoiceNotOpen
+	}
+
+	// Guarded on the status, so an invoice can only ever be paid once
+	rows, err := q.UpdateInvoicePaid(ctx, gensql.UpdateInvoicePaidParams{
+		Status:     int64(InvPaid),
+		TransferID: &trId,
+		PaidAt:     &now,
+		ID:         invId,
+		FromStatus: int64(InvOpen),
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInvoiceNotOpen
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package accounts
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+type JournalFormat string
+
+const (
+	JournalBeancount JournalFormat = "beancount"
+	JournalLedger    JournalFormat = "ledger" // ledger-cli (and hledger)
+)
+
+func ParseJournalFormat(s string) (JournalFormat, bool) {
+	switch JournalFormat(s) {
+	case JournalBeancount, JournalLedger:
+		return JournalFormat(s), true
+	default:
+		return "", false
+	}
+}
+
+// Account that opening balances are posted against.
+const journalOpeningAccount = "Equity:Opening-Balances"
+
+type JournalInput struct {
+	// Exactly one of these, the transfers on a single account or on every
+	// account the user has permissions on
+	AccountId *int64
+	UserId    *int64
+
+	From *time.Time // Inclusive, from the beginning if nil
+	To   *time.Time // Exclusive, until now if nil
+}
+
+// WriteJournal writes the transfers as a plain text double-entry journal.
+// Accounts in scope are Assets (or Liabilities for credit accounts), and
+// their counterparties Equity, named after the ledger and address, with each
+// ledger being its own commodity. Accounts in scope start with an opening
+// balance, so the journal's balances match Stelo's. Like statements, call it
+// within a (read) transaction.
+func WriteJournal(ctx context.Context, q *gensql.Queries, w io.Writer, format JournalFormat, input JournalInput) error {
+	ledgers, err := q.GetAllLedgers(ctx)
+	if err != nil {
+		return err
+	}
+	jLedgers := journalLedgers(ledgers)
+
+	var ownedIds []int64
+	if input.AccountId != nil {
+		ownedIds = append(ownedIds, *input.AccountId)
+	}
+	if input.UserId != nil {
+		accs, err := q.GetAccountsUserHasPerms(ctx, *input.UserId)
+		if err != nil {
+			return err
+		}
+		for _, acc := range accs {
+			ownedIds = append(ownedIds, acc.ID)
+		}
+		slices.Sort(ownedIds)
+	}
+
+	j := &journal{
+		w:       bufio.NewWriter(w),
+		format:  format,
+		ledgers: jLedgers,
+		owned:   make(map[int64]bool, len(ownedIds)),
+		opened:  make(map[int64]bool),
+	}
+	for _, id := range ownedIds {
+		j.owned[id] = true
+	}
+
+	fmt.Fprintf(j.w, "; Stelo Finance journal, exported %s\n", time.Now().UTC().Format(time.RFC3339))
+	if format == JournalBeancount {
+		fmt.Fprintf(j.w, "\n1970-01-01 open %s\n", journalOpeningAccount)
+	}
+
+	for _, id := range ownedIds {
+		stmt, err := OpenStatement(ctx, q, StatementInput{AccountId: id, From: input.From})
+		if err != nil {
+			return err
+		}
+		j.writeOpening(stmt, input.From)
+	}
+
+	var afterId int64
+	for {
+		trs, err := q.GetJournalTransfers(ctx, gensql.GetJournalTransfersParams{
+			AfterID:     afterId,
+			AccountID:   input.AccountId,
+			UserID:      input.UserId,
+			CreatedFrom: input.From,
+			CreatedTo:   input.To,
+			Limit:       statementPageSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, tr := range trs {
+			j.writeTransfer(tr)
+		}
+
+		if err := j.w.Flush(); err != nil {
+			return err
+		}
+		// Send each page on to the client if writing to a response
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+
+		if len(trs) < statementPageSize {
+			return nil
+		}
+		afterId = trs[len(trs)-1].ID
+	}
+}
+
+type journalLedger struct {
+	component string // Part of account names
+	commodity string
+	scale     int64
+}
+
+type journal struct {
+	w       *bufio.Writer
+	format  JournalFormat
+	ledgers map[int64]journalLedger
+	owned   map[int64]bool
+	opened  map[int64]bool // Accounts with a Beancount open directive
+}
+
+// account returns the account's name, writing its open directive first if
+// it hasn't been used yet (Beancount only).
+func (j *journal) account(id, ledgerId int64, address string, code int64, createdAt time.Time) string {
+	root := "Equity"
+	if j.owned[id] {
+		root = "Assets"
+		if AccountCode(code).IsCredit() {
+			root = "Liabilities"
+		}
+	}
+	addr := journalComponent(address, false)
+	if addr == "" {
+		addr = "Acc" + strconv.FormatInt(id, 10)
+	}
+	l := j.ledger(ledgerId)
+	name := root + ":Stelo:" + l.component + ":" + addr
+
+	if j.format == JournalBeancount && !j.opened[id] {
+		j.opened[id] = true
+		fmt.Fprintf(j.w, "\n%s open %s %s\n", journalDate(createdAt, JournalBeancount), name, l.commodity)
+	}
+	return name
+}
+
+func (j *journal) ledger(id int64) journalLedger {
+	if l, ok := j.ledgers[id]; ok {
+		return l
+	}
+	idStr := strconv.FormatInt(id, 10)
+	return journalLedger{component: "Ledger" + idStr, commodity: "L" + idStr}
+}
+
+func (j *journal) writeOpening(stmt *Statement, from *time.Time) {
+	acc := stmt.Account
+	name := j.account(acc.ID, acc.LedgerID, acc.Address, acc.Code, acc.CreatedAt)
+	if stmt.OpeningBalance == 0 {
+		return
+	}
+
+	// The posting is a debit, so negate the balance of credit accounts
+	amount := stmt.OpeningBalance
+	if AccountCode(acc.Code).IsCredit() {
+		amount = -amount
+	}
+	date := acc.CreatedAt
+	if from != nil && from.After(date) {
+		date = *from
+	}
+
+	l := j.ledger(acc.LedgerID)
+	j.writeEntry(date, nil, "Opening balance", nil, [2]string{name, journalOpeningAccount}, amount, l)
+}
+
+func (j *journal) writeTransfer(tr gensql.GetJournalTransfersRow) {
+	debit := j.account(tr.DebitAccountID, tr.LedgerID, tr.DebitAddress, tr.DebitCode, tr.DebitCreatedAt)
+	credit := j.account(tr.CreditAccountID, tr.LedgerID, tr.CreditAddress, tr.CreditCode, tr.CreditCreatedAt)
+
+	desc := "Transfer"
+	if tr.Memo != nil && *tr.Memo != "" {
+		desc = *tr.Memo
+	}
+	code := tr.Code
+	j.writeEntry(tr.CreatedAt, &tr.ID, desc, &code, [2]string{debit, credit}, tr.Amount, j.ledger(tr.LedgerID))
+}
+
+// writeEntry writes a transaction debiting the first account and crediting
+// the second.
+func (j *journal) writeEntry(date time.Time, trId *int64, desc string, code *int64, accs [2]string, amount int64, l journalLedger) {
+	desc = journalText(desc)
+	debit := FormatAmount(amount, l.scale)
+	credit := FormatAmount(-amount, l.scale)
+
+	switch j.format {
+	case JournalBeancount:
+		fmt.Fprintf(j.w, "\n%s * \"%s\"\n", journalDate(date, JournalBeancount), strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(desc))
+		if trId != nil {
+			fmt.Fprintf(j.w, "  transfer: \"%d\"\n", *trId)
+		}
+		if code != nil {
+			fmt.Fprintf(j.w, "  code: \"%d\"\n", *code)
+		}
+		fmt.Fprintf(j.w, "  %s  %s %s\n", accs[0], debit, l.commodity)
+		fmt.Fprintf(j.w, "  %s  %s %s\n", accs[1], credit, l.commodity)
+	case JournalLedger:
+		commodity := l.commodity
+		// Commodities with anything but letters must be quoted
+		if strings.ContainsFunc(commodity, func(r rune) bool { return r < 'A' || r > 'Z' }) {
+			commodity = `"` + commodity + `"`
+		}
+		fmt.Fprintf(j.w, "\n%s *", journalDate(date, JournalLedger))
+		if trId != nil {
+			fmt.Fprintf(j.w, " (%d)", *trId)
+		}
+		fmt.Fprintf(j.w, " %s\n", desc)
+		if code != nil {
+			fmt.Fprintf(j.w, "    ; code: %d\n", *code)
+		}
+		fmt.Fprintf(j.w, "    %s  %s %s\n", accs[0], debit, commodity)
+		fmt.Fprintf(j.w, "    %s  %s %s\n", accs[1], credit, commodity)
+	}
+}
+
+// journalLedgers names every ledger's account component and commodity,
+// making sure no two ledgers end up with the same.
+func journalLedgers(ledgers []gensql.Ledger) map[int64]journalLedger {
+	slices.SortFunc(ledgers, func(a, b gensql.Ledger) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	jLedgers := make(map[int64]journalLedger, len(ledgers))
+	components := make(map[string]bool, len(ledgers))
+	commodities := make(map[string]bool, len(ledgers))
+	for _, l := range ledgers {
+		idStr := strconv.FormatInt(l.ID, 10)
+
+		component := journalComponent(l.Name, true)
+		if component == "" || components[component] {
+			component += "Ledger" + idStr
+		}
+		components[component] = true
+
+		// Beancount commodities are 2 to 24 capital letters or digits,
+		// starting with a letter
+		commodity := strings.Map(func(r rune) rune {
+			r = unicode.ToUpper(r)
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return -1
+		}, l.Name)
+		if commodity == "" || commodity[0] < 'A' || commodity[0] > 'Z' {
+			commodity = "L" + commodity
+		}
+		commodity = commodity[:min(len(commodity), 24)]
+		if len(commodity) < 2 || commodities[commodity] {
+			commodity = commodity[:min(len(commodity), 24-len(idStr))] + idStr
+		}
+		commodities[commodity] = true
+
+		jLedgers[l.ID] = journalLedger{
+			component: component,
+			commodity: commodity,
+			scale:     l.AssetScale,
+		}
+	}
+	return jLedgers
+}
+
+// journalComponent makes a name usable in an account name, keeping only
+// letters and digits. With title, each word is capitalized ("hex coin" is
+// "HexCoin"), otherwise the whole name is.
+func journalComponent(name string, title bool) string {
+	var b strings.Builder
+	startOfWord := true
+	for _, r := range name {
+		isLetter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isLetter && (r < '0' || r > '9') {
+			startOfWord = true
+			continue
+		}
+		if !title || startOfWord {
+			r = unicode.ToUpper(r)
+		}
+		b.WriteRune(r)
+		startOfWord = false
+	}
+	return b.String()
+}
+
+// journalText puts text on a single line.
+func journalText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+func journalDate(t time.Time, format JournalFormat) string {
+	if format == JournalLedger {
+		return t.UTC().Format("2006/01/02")
+	}
+	return t.UTC().Format(time.DateOnly)
+}
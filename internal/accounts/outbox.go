@@ -0,0 +1,159 @@
+package accounts
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+type OutboxKind int64
+
+const (
+	OutboxEvent             OutboxKind = iota // Published on its subject
+	OutboxWebhook                             // Enqueued as a webhook delivery
+	OutboxLiveEvent                           // Published on its subject, to live subscribers only
+	OutboxPermissionWebhook                   // Enqueued as a permission webhook delivery
+	OutboxAuditEvent                          // Published on its subject to the ADMIN_AUDIT stream
+)
+
+// OutboxNotifier wakes the outbox relay once entries are committed, so they
+// go out without waiting for its next poll.
+type OutboxNotifier interface {
+	Notify()
+}
+
+// insertTransferOutbox writes the transfer's event, and a webhook delivery for
+// each enabled endpoint subscribed to it, to the outbox. Called by
+// CreateTransfer within its transaction, so the transfer and its events commit
+// (or not) together.
+func insertTransferOutbox(ctx context.Context, q *gensql.Queries, e EventTransfer, senderId, receiverId int64) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	err = q.InsertOutboxEntry(ctx, gensql.InsertOutboxEntryParams{
+		Kind:          int64(OutboxEvent),
+		Subject:       e.Subject(),
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Endpoints (and their URLs) are snapshotted now, at commit time
+	targets := []struct {
+		accId int64
+		event WebhookEvent
+	}{
+		{senderId, WebhookEventTransferOutgoing},
+		{receiverId, WebhookEventTransferIncoming},
+	}
+	queued := make(map[int64]bool)
+	var details map[int64]TransferDetails
+	for _, t := range targets {
+		endpoints, err := q.GetEnabledWebhookEndpointsByAccountId(ctx, t.accId)
+		if err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			if !WebhookEvent(endpoint.Events).Has(t.event) || queued[endpoint.ID] {
+				continue
+			}
+			queued[endpoint.ID] = true
+
+			// Only looked up for transfers with webhooks to deliver
+			if details == nil {
+				details, err = loadTransferDetails(ctx, q, e, senderId, receiverId)
+				if err != nil {
+					return err
+				}
+			}
+			d := details[t.accId]
+
+			if err := insertWebhookOutbox(ctx, q, WebhookTransfer{e, &d}, endpoint, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func insertWebhookOutbox(ctx context.Context, q *gensql.Queries, t WebhookTransfer, endpoint gensql.WebhookEndpoint, now time.Time) error {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return q.InsertOutboxEntry(ctx, gensql.InsertOutboxEntryParams{
+		Kind:          int64(OutboxWebhook),
+		Subject:       t.Subject(),
+		AccountID:     &endpoint.AccountID,
+		EndpointID:    &endpoint.ID,
+		Url:           &endpoint.Url,
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// insertPermissionOutbox writes the permission change's event, and a webhook
+// delivery for each of the account's enabled endpoints subscribed to
+// permission.changed, to the outbox. Called within the change's transaction,
+// like insertTransferOutbox.
+func insertPermissionOutbox(ctx context.Context, q *gensql.Queries, e EventAccountPermission) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// Not kept in the TRANSFERS stream, so only seen by live subscribers
+	err = q.InsertOutboxEntry(ctx, gensql.InsertOutboxEntryParams{
+		Kind:          int64(OutboxLiveEvent),
+		Subject:       e.Subject(),
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := q.GetEnabledWebhookEndpointsByAccountId(ctx, e.AccountId)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if !WebhookEvent(endpoint.Events).Has(WebhookEventPermission) {
+			continue
+		}
+		if err := insertPermissionWebhookOutbox(ctx, q, e, endpoint, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertPermissionWebhookOutbox(ctx context.Context, q *gensql.Queries, e EventAccountPermission, endpoint gensql.WebhookEndpoint, now time.Time) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return q.InsertOutboxEntry(ctx, gensql.InsertOutboxEntryParams{
+		Kind:          int64(OutboxPermissionWebhook),
+		Subject:       e.Subject(),
+		AccountID:     &endpoint.AccountID,
+		EndpointID:    &endpoint.ID,
+		Url:           &endpoint.Url,
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
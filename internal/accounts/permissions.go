@@ -1,5 +1,15 @@
 package accounts
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
 type Permission uint64
 
 const PermNone Permission = 0
@@ -56,3 +66,117 @@ func (p Permission) HasPerms(perms ...Permission) bool {
 
 	return true
 }
+
+// SetAccountUserPerms gives the user perms on the account, or changes the ones
+// they have, and records the change as an EventAccountPermission. changedBy
+// is the user making the change. Call within a transaction, and notify the
+// outbox once committed.
+func SetAccountUserPerms(ctx context.Context, q *gensql.Queries, accId, userId int64, perms Permission, changedBy int64) error {
+	now := time.Now()
+	p := int64(perms)
+	evt := newPermissionEvent(accId, changedBy, now)
+	evt.UserId = &userId
+	evt.Permissions = &p
+
+	existing, err := q.GetAccountPerm(ctx, gensql.GetAccountPermParams{
+		AccountID: accId,
+		UserID:    userId,
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = q.InsertAccountPerm(ctx, gensql.InsertAccountPermParams{
+			AccountID:   accId,
+			UserID:      userId,
+			Permissions: p,
+			UpdatedAt:   now,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+		evt.Type = PermissionCreated
+	case err != nil:
+		return err
+	case existing.Permissions == p:
+		return nil
+	default:
+		_, err = q.UpdateAccountPerm(ctx, gensql.UpdateAccountPermParams{
+			Permissions: p,
+			UpdatedAt:   now,
+			ID:          existing.ID,
+		})
+		if err != nil {
+			return err
+		}
+		evt.Type = PermissionUpdated
+	}
+
+	return insertPermissionOutbox(ctx, q, evt)
+}
+
+// RemoveAccountUser removes the user's perms on the account, like
+// SetAccountUserPerms. Returns sql.ErrNoRows if they have none.
+func RemoveAccountUser(ctx context.Context, q *gensql.Queries, accId, userId, changedBy int64) error {
+	rows, err := q.DeleteAccountPerm(ctx, gensql.DeleteAccountPermParams{
+		AccountID: accId,
+		UserID:    userId,
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	evt := newPermissionEvent(accId, changedBy, time.Now())
+	evt.Type = PermissionDeleted
+	evt.UserId = &userId
+	return insertPermissionOutbox(ctx, q, evt)
+}
+
+// SetPrimaryUser sets (or with nil, clears) the account's primary user, like
+// SetAccountUserPerms. Returns sql.ErrNoRows if there's no account.
+func SetPrimaryUser(ctx context.Context, q *gensql.Queries, accId int64, userId *int64, changedBy int64) error {
+	acc, err := q.GetAccountById(ctx, accId)
+	if err != nil {
+		return err
+	}
+	if (acc.UserID == nil && userId == nil) || (acc.UserID != nil && userId != nil && *acc.UserID == *userId) {
+		return nil
+	}
+
+	rows, err := q.UpdateAccountUserId(ctx, gensql.UpdateAccountUserIdParams{
+		UserID: userId,
+		ID:     accId,
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	evt := newPermissionEvent(accId, changedBy, time.Now())
+	evt.Type = PrimaryUserChanged
+	evt.UserId = userId
+	return insertPermissionOutbox(ctx, q, evt)
+}
+
+// RecordTokenChange records API tokens for the account being created or
+// revoked (TokenCreated or TokensRevoked), which are kept outside the
+// database, like SetAccountUserPerms.
+func RecordTokenChange(ctx context.Context, q *gensql.Queries, accId int64, change PermissionChange, tokens int, changedBy int64) error {
+	evt := newPermissionEvent(accId, changedBy, time.Now())
+	evt.Type = change
+	evt.Tokens = &tokens
+	return insertPermissionOutbox(ctx, q, evt)
+}
+
+func newPermissionEvent(accId, changedBy int64, now time.Time) EventAccountPermission {
+	return EventAccountPermission{
+		ID:        "evt_" + uniuri.NewLen(20),
+		AccountId: accId,
+		ChangedBy: changedBy,
+		CreatedAt: now,
+	}
+}
@@ -0,0 +1,303 @@
+package accounts
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+// Transfers are read in pages of this size, so statements of any length can
+// be streamed without loading the whole history.
+const statementPageSize = 500
+
+type StatementInput struct {
+	AccountId int64
+	From      *time.Time // Inclusive, from the beginning if nil
+	To        *time.Time // Exclusive, until now if nil
+}
+
+type Statement struct {
+	Input          StatementInput
+	Account        gensql.GetAccountAndLedgerByIdRow
+	OpeningBalance int64 // Posted balance just before the first row
+}
+
+type StatementRow struct {
+	TransferID           int64
+	CreatedAt            time.Time
+	Code                 TrCode
+	CounterpartyID       int64
+	CounterpartyAddress  string
+	CounterpartyUsername *string
+	Amount               int64 // Signed, positive when the balance went up
+	Balance              int64 // Running balance after this transfer
+	Memo                 *string
+	// Who made the transfer, only set if it was made by this account
+	InitiatorUserId   *int64
+	InitiatorUsername *string
+	InitiatorTokenId  *string
+	Channel           *string
+	RequestId         *string
+}
+
+// OpenStatement loads the account and works out its opening balance. The
+// opening balance is worked back from the current balance, so it includes
+// any adjustments made outside of transfers. Call it and Each within the same
+// (read) transaction for a consistent statement.
+func OpenStatement(ctx context.Context, q *gensql.Queries, input StatementInput) (*Statement, error) {
+	acc, err := q.GetAccountAndLedgerById(ctx, input.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	since, err := q.GetAccountTransferTotalsSince(ctx, gensql.GetAccountTransferTotalsSinceParams{
+		AccountID:   input.AccountId,
+		CreatedFrom: input.From,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var balance, change int64
+	if AccountCode(acc.Code).IsDebit() {
+		balance = acc.DebitsPosted - acc.CreditsPosted
+		change = since.Debits - since.Credits
+	} else {
+		balance = acc.CreditsPosted - acc.DebitsPosted
+		change = since.Credits - since.Debits
+	}
+
+	return &Statement{
+		Input:          input,
+		Account:        acc,
+		OpeningBalance: balance - change,
+	}, nil
+}
+
+// Each calls fn for every transfer in the statement, oldest first.
+func (s *Statement) Each(ctx context.Context, q *gensql.Queries, fn func(StatementRow) error) error {
+	isDebit := AccountCode(s.Account.Code).IsDebit()
+	balance := s.OpeningBalance
+	var afterId int64
+	for {
+		trs, err := q.GetStatementTransfers(ctx, gensql.GetStatementTransfersParams{
+			AccountID:   s.Input.AccountId,
+			AfterID:     afterId,
+			CreatedFrom: s.Input.From,
+			CreatedTo:   s.Input.To,
+			Limit:       statementPageSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, tr := range trs {
+			row := StatementRow{
+				TransferID: tr.ID,
+				CreatedAt:  tr.CreatedAt,
+				Code:       TrCode(tr.Code),
+				Memo:       tr.Memo,
+			}
+
+			onDebitSide := tr.DebitAccountID == s.Input.AccountId
+			if onDebitSide {
+				row.CounterpartyID = tr.CreditAccountID
+				row.CounterpartyAddress = tr.CreditAddress
+				row.CounterpartyUsername = tr.CreditUsername
+			} else {
+				row.CounterpartyID = tr.DebitAccountID
+				row.CounterpartyAddress = tr.DebitAddress
+				row.CounterpartyUsername = tr.DebitUsername
+			}
+			if tr.InitiatorAccountID != nil && *tr.InitiatorAccountID == s.Input.AccountId {
+				row.InitiatorUserId = tr.InitiatorUserID
+				row.InitiatorUsername = tr.InitiatorUsername
+				row.InitiatorTokenId = tr.InitiatorTokenID
+				row.Channel = tr.Channel
+				row.RequestId = tr.RequestID
+			}
+			if onDebitSide == isDebit {
+				row.Amount = tr.Amount
+			} else {
+				row.Amount = -tr.Amount
+			}
+			balance += row.Amount
+			row.Balance = balance
+
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+
+		if len(trs) < statementPageSize {
+			return nil
+		}
+		afterId = trs[len(trs)-1].ID
+	}
+}
+
+type StatementWriter interface {
+	WriteRow(row StatementRow) error
+	// Flush writes any buffered rows to the underlying writer.
+	Flush() error
+}
+
+// NewStatementWriter returns a StatementWriter for the format ("csv" or
+// "ndjson"), or false if the format isn't supported.
+func NewStatementWriter(w io.Writer, format string, assetScale int64) (StatementWriter, bool) {
+	switch format {
+	case "csv":
+		return newCSVStatementWriter(w, assetScale), true
+	case "ndjson":
+		return &ndjsonStatementWriter{enc: json.NewEncoder(w), scale: assetScale}, true
+	default:
+		return nil, false
+	}
+}
+
+type csvStatementWriter struct {
+	w           *csv.Writer
+	scale       int64
+	wroteHeader bool
+}
+
+func newCSVStatementWriter(w io.Writer, assetScale int64) *csvStatementWriter {
+	return &csvStatementWriter{w: csv.NewWriter(w), scale: assetScale}
+}
+
+func (c *csvStatementWriter) writeHeader() error {
+	if c.wroteHeader {
+		return nil
+	}
+	c.wroteHeader = true
+	return c.w.Write([]string{"transfer_id", "created_at", "code", "counterparty_id", "counterparty_address", "counterparty_username", "amount", "balance", "memo", "initiator_user_id", "initiator_username", "initiator_token_id", "channel", "request_id"})
+}
+
+func (c *csvStatementWriter) WriteRow(row StatementRow) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	username, memo := "", ""
+	if row.CounterpartyUsername != nil {
+		username = *row.CounterpartyUsername
+	}
+	if row.Memo != nil {
+		memo = *row.Memo
+	}
+	initUserId := ""
+	if row.InitiatorUserId != nil {
+		initUserId = strconv.FormatInt(*row.InitiatorUserId, 10)
+	}
+	return c.w.Write([]string{
+		strconv.FormatInt(row.TransferID, 10),
+		row.CreatedAt.UTC().Format(time.RFC3339),
+		strconv.FormatInt(int64(row.Code), 10),
+		strconv.FormatInt(row.CounterpartyID, 10),
+		row.CounterpartyAddress,
+		csvSafe(username),
+		FormatAmount(row.Amount, c.scale),
+		FormatAmount(row.Balance, c.scale),
+		csvSafe(memo),
+		initUserId,
+		csvSafe(derefOr(row.InitiatorUsername)),
+		derefOr(row.InitiatorTokenId),
+		derefOr(row.Channel),
+		csvSafe(derefOr(row.RequestId)),
+	})
+}
+
+func (c *csvStatementWriter) Flush() error {
+	// Empty statements still get a header
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// derefOr returns the string, or empty if nil.
+func derefOr(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// csvSafe stops user provided text from being run as a formula when the CSV
+// is opened in a spreadsheet.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+type ndjsonStatementWriter struct {
+	enc   *json.Encoder
+	scale int64
+}
+
+func (n *ndjsonStatementWriter) WriteRow(row StatementRow) error {
+	// Amounts are strings so the scaled decimals are exact
+	return n.enc.Encode(struct {
+		TransferID           int64     `json:"transferId"`
+		CreatedAt            time.Time `json:"createdAt"`
+		Code                 TrCode    `json:"code"`
+		CounterpartyID       int64     `json:"counterpartyId"`
+		CounterpartyAddress  string    `json:"counterpartyAddress"`
+		CounterpartyUsername *string   `json:"counterpartyUsername"`
+		Amount               string    `json:"amount"`
+		Balance              string    `json:"balance"`
+		Memo                 *string   `json:"memo"`
+		InitiatorUserId      *int64    `json:"initiatorUserId"`
+		InitiatorUsername    *string   `json:"initiatorUsername"`
+		InitiatorTokenId     *string   `json:"initiatorTokenId"`
+		Channel              *string   `json:"channel"`
+		RequestId            *string   `json:"requestId"`
+	}{
+		TransferID:           row.TransferID,
+		CreatedAt:            row.CreatedAt.UTC(),
+		Code:                 row.Code,
+		CounterpartyID:       row.CounterpartyID,
+		CounterpartyAddress:  row.CounterpartyAddress,
+		CounterpartyUsername: row.CounterpartyUsername,
+		Amount:               FormatAmount(row.Amount, n.scale),
+		Balance:              FormatAmount(row.Balance, n.scale),
+		Memo:                 row.Memo,
+		InitiatorUserId:      row.InitiatorUserId,
+		InitiatorUsername:    row.InitiatorUsername,
+		InitiatorTokenId:     row.InitiatorTokenId,
+		Channel:              row.Channel,
+		RequestId:            row.RequestId,
+	})
+}
+
+func (n *ndjsonStatementWriter) Flush() error { return nil }
+
+// FormatAmount formats an integer amount as an exact decimal string using the
+// ledger's asset scale, e.g. -12345 with a scale of 2 is "-123.45".
+func FormatAmount(amount int64, assetScale int64) string {
+	if assetScale <= 0 {
+		return strconv.FormatInt(amount, 10)
+	}
+
+	sign := ""
+	abs := uint64(amount)
+	if amount < 0 {
+		sign = "-"
+		abs = -abs
+	}
+	digits := strconv.FormatUint(abs, 10)
+	if pad := int(assetScale) + 1 - len(digits); pad > 0 {
+		digits = strings.Repeat("0", pad) + digits
+	}
+	split := len(digits) - int(assetScale)
+	return sign + digits[:split] + "." + digits[split:]
+}
@@ -11,7 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/nats-io/nats.go"
 	"github.com/stelofinance/stelofinance/database/gensql"
 	"modernc.org/sqlite"
 	sqlite3 "modernc.org/sqlite/lib"
@@ -74,6 +73,12 @@ const (
 
 const MaxIdempotencyKeyLen = 64
 
+const (
+	MaxMetadataKeys     = 16
+	MaxMetadataKeyLen   = 40
+	MaxMetadataValueLen = 256
+)
+
 var ErrInvalidQuantity = errors.New("transfer: invalid quantity")
 var ErrInvalidBalance = errors.New("transfer: invalid balance")
 var ErrIncompatibleAccCodes = errors.New("transaction: incompatible account codes")
@@ -84,25 +89,61 @@ var ErrIdempotencyKeyRequired = errors.New("transfer: idempotency key required")
 var ErrIdempotencyKeyInvalid = errors.New("transfer: idempotency key invalid")
 var ErrIdempotencyConflict = errors.New("transfer: idempotency key conflict")
 var ErrIdempotencyRace = errors.New("transfer: idempotency key race")
+var ErrMetadataInvalid = errors.New("transfer: metadata invalid")
 
 type CreateTransferInput struct {
 	SendingId      int64
 	ReceivingId    int64
 	Memo           *string
+	Metadata       map[string]string
 	LedgerId       int64
 	Amount         int64
 	IdempotencyKey string
+	Initiator      Initiator
+	InvoiceId      *int64 // Invoice the transfer pays, settled with it
+}
+
+type TransferChannel string
+
+const (
+	ChannelApp TransferChannel = "app"
+	ChannelAPI TransferChannel = "api"
+)
+
+// Max length of client request IDs kept.
+const MaxRequestIdLength = 64
+
+// truncateRequestId cuts a client request ID to MaxRequestIdLength.
+func truncateRequestId(reqId *string) *string {
+	if reqId == nil || len(*reqId) <= MaxRequestIdLength {
+		return reqId
+	}
+	cut := (*reqId)[:MaxRequestIdLength]
+	return &cut
+}
+
+// Initiator is who made a transfer: a user, or an account's API token, acting
+// for an account.
+type Initiator struct {
+	AccountId int64 // Whose permissions or token were used
+	UserId    *int64
+	TokenId   *string
+	Channel   TransferChannel
+	RequestId *string // Generated for the request
+	// The X-Request-Id the client sent, cut to MaxRequestIdLength
+	ClientRequestId *string
 }
 
 type CreateTransferResult struct {
 	TransferID int64
 	Created    bool
-	Publish    EventPublisher
 }
 
-func CreateTransfer(ctx context.Context, q *gensql.Queries, nc *nats.Conn, webhooks WebhookEnqueuer, input CreateTransferInput) (CreateTransferResult, error) {
-	noop := func() error { return nil }
-	result := CreateTransferResult{Publish: noop}
+// CreateTransfer must be called within a transaction. Its event and webhook
+// deliveries are written to the outbox in that transaction, so notify the
+// outbox relay once committed.
+func CreateTransfer(ctx context.Context, q *gensql.Queries, input CreateTransferInput) (CreateTransferResult, error) {
+	var result CreateTransferResult
 
 	key := strings.TrimSpace(input.IdempotencyKey)
 	if key == "" {
@@ -125,7 +166,12 @@ func CreateTransfer(ctx context.Context, q *gensql.Queries, nc *nats.Conn, webho
 		return result, ErrMemoExceedsLimit
 	}
 
-	reqHash := TransferRequestHash(input.ReceivingId, input.Amount, input.LedgerId, input.Memo)
+	metadata, err := EncodeMetadata(input.Metadata)
+	if err != nil {
+		return result, err
+	}
+
+	reqHash := TransferRequestHash(input.ReceivingId, input.Amount, input.LedgerId, input.Memo, input.Metadata, input.InvoiceId)
 
 	// Idempotent replay / conflict check
 	existing, err := q.GetTransferIdempotency(ctx, gensql.GetTransferIdempotencyParams{
@@ -196,7 +242,7 @@ func CreateTransfer(ctx context.Context, q *gensql.Queries, nc *nats.Conn, webho
 	}
 
 	// Create transfer record
-	trId, err := q.InsertTransfer(ctx, gensql.InsertTransferParams{
+	trParams := gensql.InsertTransferParams{
 		DebitAccountID:  debitId,
 		CreditAccountID: creditId,
 		Amount:          input.Amount,
@@ -205,12 +251,31 @@ func CreateTransfer(ctx context.Context, q *gensql.Queries, nc *nats.Conn, webho
 		Code:            int64(trC),
 		Flags:           int64(TrFlagNone),
 		Memo:            input.Memo,
+		Metadata:        metadata,
 		CreatedAt:       now,
-	})
+	}
+	if init := input.Initiator; init.Channel != "" {
+		channel := string(init.Channel)
+		trParams.Channel = &channel
+		trParams.InitiatorUserID = init.UserId
+		trParams.InitiatorTokenID = init.TokenId
+		trParams.RequestID = init.RequestId
+		trParams.ClientRequestID = truncateRequestId(init.ClientRequestId)
+		if init.AccountId != 0 {
+			trParams.InitiatorAccountID = &init.AccountId
+		}
+	}
+	trId, err := q.InsertTransfer(ctx, trParams)
 	if err != nil {
 		return result, err
 	}
 
+	if input.InvoiceId != nil {
+		if err := settleInvoice(ctx, q, *input.InvoiceId, trId, input, now); err != nil {
+			return result, err
+		}
+	}
+
 	err = q.InsertTransferIdempotency(ctx, gensql.InsertTransferIdempotencyParams{
 		AccountID:   input.SendingId,
 		Key:         key,
@@ -235,53 +300,91 @@ func CreateTransfer(ctx context.Context, q *gensql.Queries, nc *nats.Conn, webho
 		LedgerID:    input.LedgerId,
 		Code:        trC,
 		Memo:        input.Memo,
+		Metadata:    input.Metadata,
 		CreatedAt:   now,
 	}
 
-	// Snapshot webhook URLs at commit time for durable delivery.
-	var sendWebhook, recvWebhook *string
-	if sendingAcc.Webhook != nil {
-		u := *sendingAcc.Webhook
-		sendWebhook = &u
-	}
-	if receivingAcc.Webhook != nil {
-		u := *receivingAcc.Webhook
-		recvWebhook = &u
-	}
-
-	publisher := func() error {
-		var errGrp error
-		errGrp = errors.Join(errGrp, PublishEvent(nc, trEvnt))
-
-		if webhooks != nil {
-			if sendWebhook != nil {
-				errGrp = errors.Join(errGrp, webhooks.EnqueueTransferWebhook(context.Background(), sendingAcc.ID, *sendWebhook, trEvnt))
-			}
-			if recvWebhook != nil {
-				errGrp = errors.Join(errGrp, webhooks.EnqueueTransferWebhook(context.Background(), receivingAcc.ID, *recvWebhook, trEvnt))
-			}
-		}
-
-		return errGrp
+	if err := insertTransferOutbox(ctx, q, trEvnt, sendingAcc.ID, receivingAcc.ID); err != nil {
+		return result, err
 	}
 
 	result.TransferID = trId
 	result.Created = true
-	result.Publish = publisher
 	return result, nil
 }
 
 // TransferRequestHash is the stable fingerprint of a create-transfer intent.
 // Used for idempotency conflict detection (same key, different payload → 409).
-func TransferRequestHash(receivingId, amount, ledgerId int64, memo *string) string {
+func TransferRequestHash(receivingId, amount, ledgerId int64, memo *string, metadata map[string]string, invoiceId *int64) string {
 	m := ""
 	if memo != nil {
 		m = *memo
 	}
-	sum := sha256.Sum256(fmt.Appendf(nil, "%d|%d|%d|%s", receivingId, amount, ledgerId, m))
+	fingerprint := fmt.Appendf(nil, "%d|%d|%d|%s", receivingId, amount, ledgerId, m)
+	// Only appended when set, so hashes of requests without metadata are unchanged.
+	// json.Marshal sorts map keys, making it canonical.
+	if len(metadata) > 0 {
+		md, _ := json.Marshal(metadata)
+		fingerprint = fmt.Appendf(fingerprint, "|%s", md)
+	}
+	if invoiceId != nil {
+		fingerprint = fmt.Appendf(fingerprint, "|inv:%d", *invoiceId)
+	}
+	sum := sha256.Sum256(fingerprint)
 	return hex.EncodeToString(sum[:])
 }
 
+// EncodeMetadata validates transfer metadata and encodes it for storage.
+// Empty metadata is stored as nil.
+func EncodeMetadata(metadata map[string]string) (*string, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	if len(metadata) > MaxMetadataKeys {
+		return nil, ErrMetadataInvalid
+	}
+	for k, v := range metadata {
+		if !IsValidMetadataKey(k) || len(v) > MaxMetadataValueLen {
+			return nil, ErrMetadataInvalid
+		}
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	str := string(data)
+	return &str, nil
+}
+
+// DecodeMetadata decodes stored transfer metadata, returning nil if unset.
+func DecodeMetadata(metadata *string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(*metadata), &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// IsValidMetadataKey reports whether key is 1-MaxMetadataKeyLen characters
+// of A-Z, a-z, 0-9, '_' or '-'.
+func IsValidMetadataKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxMetadataKeyLen {
+		return false
+	}
+	return !strings.ContainsFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+	})
+}
+
+// MetadataPath is the JSON path of a metadata key, for filtering in queries.
+func MetadataPath(key string) string {
+	return fmt.Sprintf("$.%q", key)
+}
+
 func isUniqueConstraintError(err error) bool {
 	var sqliteErr *sqlite.Error
 	if !errors.As(err, &sqliteErr) {
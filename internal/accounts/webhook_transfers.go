@@ -0,0 +1,116 @@
+package accounts
+
+import (
+	"context"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+// WebhookTransfer is a transfer queued for delivery to a webhook: its event,
+// and what's needed for payloads after v1.
+type WebhookTransfer struct {
+	EventTransfer
+	// Nil for deliveries queued before payloads had details
+	Details *TransferDetails `json:"details,omitempty"`
+}
+
+type TransferDirection string
+
+const (
+	TransferIncoming TransferDirection = "incoming"
+	TransferOutgoing TransferDirection = "outgoing"
+)
+
+type TransferParty struct {
+	AccountId int64   `json:"accountId"`
+	Address   string  `json:"address"`
+	Username  *string `json:"username"` // Of the account's primary user, if it has one
+}
+
+type TransferLedger struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Code  int64  `json:"code"`
+	Scale int64  `json:"scale"`
+}
+
+// TransferDetails describe a transfer as one of its accounts saw it.
+type TransferDetails struct {
+	Direction TransferDirection `json:"direction"`
+	Sender    TransferParty     `json:"sender"`
+	Receiver  TransferParty     `json:"receiver"`
+	Ledger    TransferLedger    `json:"ledger"`
+	Balance   int64             `json:"balance"` // Of the account, after the transfer
+}
+
+// loadTransferDetails gets a transfer's details for the sender and receiver,
+// by account ID. Their balances are the current ones, so call it right after
+// the transfer, in its transaction.
+func loadTransferDetails(ctx context.Context, q *gensql.Queries, e EventTransfer, senderId, receiverId int64) (map[int64]TransferDetails, error) {
+	sender, senderBal, err := loadTransferParty(ctx, q, senderId)
+	if err != nil {
+		return nil, err
+	}
+	receiver, receiverBal, err := loadTransferParty(ctx, q, receiverId)
+	if err != nil {
+		return nil, err
+	}
+	l, err := q.GetLedger(ctx, e.LedgerID)
+	if err != nil {
+		return nil, err
+	}
+	ledger := TransferLedger{
+		Id:    l.ID,
+		Name:  l.Name,
+		Code:  l.Code,
+		Scale: l.AssetScale,
+	}
+
+	return map[int64]TransferDetails{
+		senderId: {
+			Direction: TransferOutgoing,
+			Sender:    sender,
+			Receiver:  receiver,
+			Ledger:    ledger,
+			Balance:   senderBal,
+		},
+		receiverId: {
+			Direction: TransferIncoming,
+			Sender:    sender,
+			Receiver:  receiver,
+			Ledger:    ledger,
+			Balance:   receiverBal,
+		},
+	}, nil
+}
+
+func loadTransferParty(ctx context.Context, q *gensql.Queries, accId int64) (TransferParty, int64, error) {
+	acc, err := q.GetAccountWithUsernameById(ctx, accId)
+	if err != nil {
+		return TransferParty{}, 0, err
+	}
+
+	// Same as the account's balance in the API
+	bal := acc.DebitsPosted - (acc.CreditsPosted + acc.CreditsPending)
+	if AccountCode(acc.Code).IsCredit() {
+		bal = acc.CreditsPosted - (acc.DebitsPosted + acc.DebitsPending)
+	}
+
+	return TransferParty{
+		AccountId: acc.ID,
+		Address:   acc.Address,
+		Username:  acc.BitcraftUsername,
+	}, bal, nil
+}
+
+// TransferDetailsFor gets the transfer's details as the account saw it, for
+// deliveries queued without them. Its balance is the current one, not the one
+// after the transfer.
+func TransferDetailsFor(ctx context.Context, q *gensql.Queries, e EventTransfer, accId int64) (TransferDetails, error) {
+	senderId, receiverId := DetermineSenderReceiver(e.Code, e.CreditAccId, e.DebitAccId)
+	details, err := loadTransferDetails(ctx, q, e, senderId, receiverId)
+	if err != nil {
+		return TransferDetails{}, err
+	}
+	return details[accId], nil
+}
@@ -0,0 +1,410 @@
+package accounts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+var ErrWebhookNotFound = errors.New("webhooks: endpoint not found")
+var ErrWebhookDeliveryNotFound = errors.New("webhooks: delivery not found")
+var ErrWebhookUrlInvalid = errors.New("webhooks: invalid url")
+var ErrWebhookEventsInvalid = errors.New("webhooks: invalid events")
+var ErrTooManyWebhooks = errors.New("webhooks: too many endpoints")
+var ErrWebhookPayloadVersionInvalid = errors.New("webhooks: invalid payload version")
+var ErrWebhookPingRequired = errors.New("webhooks: endpoint disabled for failing must respond to a ping")
+
+const MaxWebhooksPerAccount = 10
+
+// Payload versions a webhook endpoint can choose from.
+const (
+	WebhookPayloadV1 = 1 // The transfer event alone
+	WebhookPayloadV2 = 2 // Versioned, with the transfer's details
+)
+
+func validWebhookPayloadVersion(v int64) bool {
+	return v == WebhookPayloadV1 || v == WebhookPayloadV2
+}
+
+// Endpoints are disabled automatically after this many failed delivery
+// attempts in a row, so they stop holding up deliveries to healthy ones.
+const WebhookFailureThreshold = 50
+
+// Reason set on endpoints disabled for failing WebhookFailureThreshold times.
+const WebhookDisabledFailures = "failures"
+
+type WebhookHealth string
+
+const (
+	WebhookHealthy  WebhookHealth = "healthy"
+	WebhookDegraded WebhookHealth = "degraded" // The last delivery attempt failed
+	WebhookDisabled WebhookHealth = "disabled"
+)
+
+// After a rotation, deliveries are signed with the previous webhook secret
+// as well for this long.
+const WebhookSecretOverlap = 24 * time.Hour
+
+// WebhookEvent is a bitmask of the events a webhook endpoint is subscribed to.
+type WebhookEvent uint64
+
+const WebhookEventNone WebhookEvent = 0
+
+const (
+	WebhookEventTransferIncoming WebhookEvent = 1 << iota
+	WebhookEventTransferOutgoing
+	WebhookEventPermission
+	WebhookEventPending // Pending transfers aren't implemented yet, so never sent
+)
+
+// Sent to webhooks set before endpoints could choose their events.
+const WebhookEventsTransfers = WebhookEventTransferIncoming | WebhookEventTransferOutgoing
+
+var webhookEventNames = []struct {
+	event WebhookEvent
+	name  string
+}{
+	{WebhookEventTransferIncoming, "transfer.incoming"},
+	{WebhookEventTransferOutgoing, "transfer.outgoing"},
+	{WebhookEventPermission, "permission.changed"},
+	{WebhookEventPending, "transfer.pending"},
+}
+
+// ParseWebhookEvents parses event names (e.g. "transfer.incoming") into a
+// WebhookEvent, or false if any isn't known.
+func ParseWebhookEvents(names []string) (WebhookEvent, bool) {
+	events := WebhookEventNone
+outer:
+	for _, name := range names {
+		for _, e := range webhookEventNames {
+			if e.name == name {
+				events |= e.event
+				continue outer
+			}
+		}
+		return WebhookEventNone, false
+	}
+	return events, true
+}
+
+func (e WebhookEvent) Has(event WebhookEvent) bool {
+	return e&event == event
+}
+
+// Names returns the names of the events, in a fixed order.
+func (e WebhookEvent) Names() []string {
+	names := make([]string, 0, len(webhookEventNames))
+	for _, n := range webhookEventNames {
+		if e.Has(n.event) {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + uniuri.NewLen(40)
+}
+
+// ValidateWebhookUrl ensures a webhook URL is an absolute http(s) URL.
+func ValidateWebhookUrl(raw string) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ErrWebhookUrlInvalid
+	}
+	return nil
+}
+
+type CreateWebhookInput struct {
+	AccountId int64
+	Url       string
+	Events    WebhookEvent
+	Enabled   bool
+	Ordered   bool
+
+	PayloadVersion int64 // Defaults to WebhookPayloadV1
+	CloudEvents    bool  // Wrap payloads in a CloudEvents envelope
+}
+
+// CreateWebhook adds a webhook endpoint to the account, with a newly
+// generated secret. The returned endpoint is the only time its secret is
+// shown.
+func CreateWebhook(ctx context.Context, q *gensql.Queries, input CreateWebhookInput) (gensql.WebhookEndpoint, error) {
+	if err := ValidateWebhookUrl(input.Url); err != nil {
+		return gensql.WebhookEndpoint{}, err
+	}
+	if input.Events == WebhookEventNone {
+		return gensql.WebhookEndpoint{}, ErrWebhookEventsInvalid
+	}
+	if input.PayloadVersion == 0 {
+		input.PayloadVersion = WebhookPayloadV1
+	}
+	if !validWebhookPayloadVersion(input.PayloadVersion) {
+		return gensql.WebhookEndpoint{}, ErrWebhookPayloadVersionInvalid
+	}
+
+	count, err := q.CountWebhookEndpointsByAccountId(ctx, input.AccountId)
+	if err != nil {
+		return gensql.WebhookEndpoint{}, err
+	}
+	if count >= MaxWebhooksPerAccount {
+		return gensql.WebhookEndpoint{}, ErrTooManyWebhooks
+	}
+
+	now := time.Now()
+	return q.InsertWebhookEndpoint(ctx, gensql.InsertWebhookEndpointParams{
+		AccountID:      input.AccountId,
+		Url:            input.Url,
+		Events:         int64(input.Events),
+		Enabled:        boolToInt(input.Enabled),
+		Ordered:        boolToInt(input.Ordered),
+		PayloadVersion: input.PayloadVersion,
+		Cloudevents:    boolToInt(input.CloudEvents),
+		Secret:         newWebhookSecret(),
+		UpdatedAt:      now,
+		CreatedAt:      now,
+	})
+}
+
+type UpdateWebhookInput struct {
+	AccountId int64
+	Id        int64
+	Url       *string
+	Events    *WebhookEvent
+	Enabled   *bool
+	Ordered   *bool
+
+	PayloadVersion *int64
+	CloudEvents    *bool
+
+	// Pinged is set once the endpoint just responded to a ping, which
+	// endpoints disabled for failing need before they're enabled again.
+	Pinged bool
+}
+
+// UpdateWebhook changes the fields of the endpoint that are set.
+func UpdateWebhook(ctx context.Context, q *gensql.Queries, input UpdateWebhookInput) (gensql.WebhookEndpoint, error) {
+	e, err := q.GetAccountWebhookEndpoint(ctx, gensql.GetAccountWebhookEndpointParams{
+		ID:        input.Id,
+		AccountID: input.AccountId,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, ErrWebhookNotFound
+		}
+		return e, err
+	}
+
+	if input.Url != nil {
+		if err := ValidateWebhookUrl(*input.Url); err != nil {
+			return e, err
+		}
+		e.Url = *input.Url
+	}
+	if input.Events != nil {
+		if *input.Events == WebhookEventNone {
+			return e, ErrWebhookEventsInvalid
+		}
+		e.Events = int64(*input.Events)
+	}
+	if input.Enabled != nil {
+		if *input.Enabled && e.DisabledReason != nil {
+			if !input.Pinged {
+				return e, ErrWebhookPingRequired
+			}
+			// Only a successful ping clears why the endpoint was disabled
+			e.DisabledReason = nil
+		}
+		// Re-enabling gives endpoints disabled for failing a fresh start
+		if *input.Enabled && e.Enabled == 0 {
+			e.FailureStreak = 0
+		}
+		e.Enabled = boolToInt(*input.Enabled)
+	}
+	if input.Ordered != nil {
+		e.Ordered = boolToInt(*input.Ordered)
+	}
+	if input.PayloadVersion != nil {
+		if !validWebhookPayloadVersion(*input.PayloadVersion) {
+			return e, ErrWebhookPayloadVersionInvalid
+		}
+		e.PayloadVersion = *input.PayloadVersion
+	}
+	if input.CloudEvents != nil {
+		e.Cloudevents = boolToInt(*input.CloudEvents)
+	}
+	e.UpdatedAt = time.Now()
+
+	_, err = q.UpdateWebhookEndpoint(ctx, gensql.UpdateWebhookEndpointParams{
+		Url:            e.Url,
+		Events:         e.Events,
+		Enabled:        e.Enabled,
+		Ordered:        e.Ordered,
+		PayloadVersion: e.PayloadVersion,
+		Cloudevents:    e.Cloudevents,
+		FailureStreak:  e.FailureStreak,
+		DisabledReason: e.DisabledReason,
+		UpdatedAt:      e.UpdatedAt,
+		ID:             e.ID,
+		AccountID:      e.AccountID,
+	})
+	return e, err
+}
+
+// WebhookEndpointHealth is the health of the endpoint, from whether it's
+// enabled and its failure streak.
+func WebhookEndpointHealth(e gensql.WebhookEndpoint) WebhookHealth {
+	switch {
+	case e.Enabled == 0:
+		return WebhookDisabled
+	case e.FailureStreak > 0:
+		return WebhookDegraded
+	default:
+		return WebhookHealthy
+	}
+}
+
+// RecordWebhookAttempt updates the endpoint's failure streak after a
+// delivery attempt, disabling it once the streak reaches
+// WebhookFailureThreshold. Returns the new streak, and whether this attempt
+// disabled the endpoint.
+func RecordWebhookAttempt(ctx context.Context, q *gensql.Queries, e gensql.WebhookEndpoint, ok bool) (int64, bool, error) {
+	if ok {
+		if e.FailureStreak == 0 {
+			return 0, false, nil
+		}
+		return 0, false, q.ResetWebhookEndpointFailures(ctx, e.ID)
+	}
+
+	streak, err := q.IncrementWebhookEndpointFailures(ctx, e.ID)
+	if err != nil || streak < WebhookFailureThreshold {
+		return streak, false, err
+	}
+
+	reason := WebhookDisabledFailures
+	rows, err := q.AutoDisableWebhookEndpoint(ctx, gensql.AutoDisableWebhookEndpointParams{
+		DisabledReason: &reason,
+		UpdatedAt:      time.Now(),
+		ID:             e.ID,
+	})
+	return streak, rows == 1, err
+}
+
+// RotateWebhookSecret generates a new secret for the endpoint. The current
+// one keeps signing deliveries alongside it for WebhookSecretOverlap,
+// replacing any previous secret still doing so.
+func RotateWebhookSecret(ctx context.Context, q *gensql.Queries, accId, endpointId int64) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(WebhookSecretOverlap)
+	secret := newWebhookSecret()
+	rows, err := q.RotateWebhookEndpointSecret(ctx, gensql.RotateWebhookEndpointSecretParams{
+		PreviousExpiresAt: &expiresAt,
+		Secret:            secret,
+		UpdatedAt:         now,
+		ID:                endpointId,
+		AccountID:         accId,
+	})
+	if err != nil {
+		return "", err
+	}
+	if rows == 0 {
+		return "", ErrWebhookNotFound
+	}
+	return secret, nil
+}
+
+// RedeliverWebhook sends the event of a logged delivery to its endpoint
+// again, at the endpoint's current URL and in its current payload format.
+// Like transfers, the delivery goes through the outbox, so notify it once
+// committed.
+func RedeliverWebhook(ctx context.Context, q *gensql.Queries, accId, endpointId, deliveryId int64) error {
+	d, err := q.GetAccountWebhookDelivery(ctx, gensql.GetAccountWebhookDeliveryParams{
+		ID:        deliveryId,
+		AccountID: accId,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrWebhookDeliveryNotFound
+		}
+		return err
+	}
+	if d.EndpointID != endpointId {
+		return ErrWebhookDeliveryNotFound
+	}
+
+	endpoint, err := q.GetAccountWebhookEndpoint(ctx, gensql.GetAccountWebhookEndpointParams{
+		ID:        d.EndpointID,
+		AccountID: accId,
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrWebhookNotFound
+		}
+		return err
+	}
+
+	// Deliveries logged before payloads had versions only have the v1 body
+	payload := d.RequestBody
+	if d.Payload != nil {
+		payload = *d.Payload
+	}
+	var p WebhookPermission
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return err
+	}
+	if p.Permission != nil {
+		return insertPermissionWebhookOutbox(ctx, q, *p.Permission, endpoint, time.Now())
+	}
+	var t WebhookTransfer
+	if err := json.Unmarshal([]byte(payload), &t); err != nil {
+		return err
+	}
+	return insertWebhookOutbox(ctx, q, t, endpoint, time.Now())
+}
+
+// WebhookPermission is how permission deliveries are kept in the delivery
+// log, to tell them apart from transfers.
+type WebhookPermission struct {
+	Permission *EventAccountPermission `json:"permission"`
+}
+
+// SignWebhook is the HMAC-SHA256 (hex) of "{timestamp}.{body}", which
+// receivers recompute with their webhook secret to verify a delivery.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSignatureHeader builds the Stelo-Signature header for a delivery,
+// "t={timestamp},v1={signature}", with a second v1 signature while a
+// previous secret is still active.
+func WebhookSignatureHeader(e gensql.WebhookEndpoint, now time.Time, body []byte) string {
+	timestamp := now.Unix()
+	var b strings.Builder
+	fmt.Fprintf(&b, "t=%d,v1=%s", timestamp, SignWebhook(e.Secret, timestamp, body))
+	if e.PreviousSecret != nil && e.PreviousExpiresAt != nil && now.Before(*e.PreviousExpiresAt) {
+		fmt.Fprintf(&b, ",v1=%s", SignWebhook(*e.PreviousSecret, timestamp, body))
+	}
+	return b.String()
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package accounts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+// newTestQueries returns queries against a freshly migrated sqlite db.
+func newTestQueries(t *testing.T) *gensql.Queries {
+	t.Helper()
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	env := map[string]string{
+		"GOOSE_DBSTRING": dbFile,
+		"GOOSE_DRIVER":   "sqlite3",
+	}
+	if err := database.RunMigrations(context.Background(), func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+
+	dbConn, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		t.Fatalf("opening db: %v", err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	return gensql.New(dbConn)
+}
+
+func TestUpdateWebhookKeepsDisabledReasonUntilPinged(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueries(t)
+
+	e, err := CreateWebhook(ctx, q, CreateWebhookInput{
+		AccountId: 1,
+		Url:       "https://example.com/hook",
+		Events:    WebhookEventTransferIncoming,
+		Enabled:   true,
+	})
+	if err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	reason := WebhookDisabledFailures
+	if _, err := q.AutoDisableWebhookEndpoint(ctx, gensql.AutoDisableWebhookEndpointParams{
+		DisabledReason: &reason,
+		UpdatedAt:      time.Now(),
+		ID:             e.ID,
+	}); err != nil {
+		t.Fatalf("auto disabling webhook: %v", err)
+	}
+
+	enabled, disabled := true, false
+
+	// Disabling an auto disabled endpoint again mustn't forget why it was
+	e, err = UpdateWebhook(ctx, q, UpdateWebhookInput{AccountId: 1, Id: e.ID, Enabled: &disabled})
+	if err != nil {
+		t.Fatalf("disabling webhook: %v", err)
+	}
+	if e.DisabledReason == nil || *e.DisabledReason != reason {
+		t.Fatalf("disabled reason = %v, want %q", e.DisabledReason, reason)
+	}
+
+	_, err = UpdateWebhook(ctx, q, UpdateWebhookInput{AccountId: 1, Id: e.ID, Enabled: &enabled})
+	if !errors.Is(err, ErrWebhookPingRequired) {
+		t.Fatalf("enabling without ping: err = %v, want %v", err, ErrWebhookPingRequired)
+	}
+
+	e, err = UpdateWebhook(ctx, q, UpdateWebhookInput{AccountId: 1, Id: e.ID, Enabled: &enabled, Pinged: true})
+	if err != nil {
+		t.Fatalf("enabling after ping: %v", err)
+	}
+	if e.Enabled != 1 || e.DisabledReason != nil || e.FailureStreak != 0 {
+		t.Fatalf("after pinged enable: enabled = %d, reason = %v, streak = %d", e.Enabled, e.DisabledReason, e.FailureStreak)
+	}
+}
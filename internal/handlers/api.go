@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -12,13 +16,15 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/stelofinance/stelofinance/database"
 	"github.com/stelofinance/stelofinance/database/gensql"
 	"github.com/stelofinance/stelofinance/internal/accounts"
 	"github.com/stelofinance/stelofinance/internal/sessions"
+	"github.com/stelofinance/stelofinance/internal/webhooks"
 )
 
-func CreateLedger(db *database.Database) http.HandlerFunc {
+func CreateLedger(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Input struct {
 			Name  string `json:"name" validate:"required"`
@@ -37,7 +43,15 @@ func CreateLedger(db *database.Database) http.HandlerFunc {
 
 		// TODO: Actually validate ledger codes
 
-		_, err := db.Q.InsertLedger(r.Context(), gensql.InsertLedgerParams{
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
+
+		ledgerId, err := qtx.InsertLedger(r.Context(), gensql.InsertLedgerParams{
 			Name:       body.Name,
 			AssetScale: body.Scale,
 			Code:       body.Code,
@@ -47,6 +61,20 @@ func CreateLedger(db *database.Database) http.HandlerFunc {
 			return
 		}
 
+		err = accounts.RecordAdminAction(r.Context(), qtx, adminAudit(r, accounts.AdminLedgerCreated, fmt.Sprintf("ledger:%d", ledgerId), nil, body))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
@@ -97,7 +125,136 @@ func LedgerAudit(db *database.Database) http.HandlerFunc {
 	}
 }
 
-func User(db *database.Database) http.HandlerFunc {
+const (
+	defaultHoldersLimit = 25
+	maxHoldersLimit     = 100
+)
+
+func LedgerHolders(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ledgerId, err := strconv.ParseInt(chi.URLParam(r, "ledger_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Optional holder list pagination
+		listHolders := r.URL.Query().Get("holders") == "true"
+		limit := int64(defaultHoldersLimit)
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			limit, err = strconv.ParseInt(limitStr, 10, 64)
+			if err != nil || limit < 1 || limit > maxHoldersLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		var offset int64
+		if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+			offset, err = strconv.ParseInt(offsetStr, 10, 64)
+			if err != nil || offset < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		ledger, err := db.Q.GetLedger(r.Context(), ledgerId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		supply, err := db.Q.GetLedgerSupply(r.Context(), ledgerId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		dist, err := db.Q.GetLedgerBalanceDistribution(r.Context(), ledgerId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		type Bucket struct {
+			Min     int64 `json:"min"`
+			Max     int64 `json:"max"`
+			Holders int64 `json:"holders"`
+			Balance int64 `json:"balance"`
+		}
+		type Holder struct {
+			AccountID int64   `json:"accountId"`
+			Address   string  `json:"address"`
+			Username  *string `json:"username"`
+			Balance   int64   `json:"balance"`
+		}
+		type Response struct {
+			LedgerID          int64    `json:"ledgerId"`
+			AssetScale        int64    `json:"assetScale"`
+			CirculatingSupply int64    `json:"circulatingSupply"`
+			HolderCount       int64    `json:"holderCount"`
+			Distribution      []Bucket `json:"distribution"`
+			Holders           []Holder `json:"holders"`
+		}
+
+		rsp := Response{
+			LedgerID:          ledger.ID,
+			AssetScale:        ledger.AssetScale,
+			CirculatingSupply: supply.CirculatingSupply,
+			HolderCount:       supply.HolderCount,
+			Distribution:      make([]Bucket, 0, len(dist)),
+		}
+		for _, b := range dist {
+			// Buckets are by digit count, so magnitude n covers [10^(n-1), 10^n - 1]
+			bucketMin := int64(math.Pow10(int(b.Magnitude - 1)))
+			bucketMax := int64(math.MaxInt64)
+			if b.Magnitude < 19 {
+				bucketMax = int64(math.Pow10(int(b.Magnitude))) - 1
+			}
+			rsp.Distribution = append(rsp.Distribution, Bucket{
+				Min:     bucketMin,
+				Max:     bucketMax,
+				Holders: b.Holders,
+				Balance: b.Balance,
+			})
+		}
+
+		if listHolders {
+			holders, err := db.Q.GetLedgerHolders(r.Context(), gensql.GetLedgerHoldersParams{
+				LedgerID:    ledgerId,
+				HiddenFlags: int64(accounts.AccFlagPrivate),
+				Limit:       limit,
+				Offset:      offset,
+			})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rsp.Holders = make([]Holder, 0, len(holders))
+			for _, h := range holders {
+				rsp.Holders = append(rsp.Holders, Holder{
+					AccountID: h.ID,
+					Address:   h.Address,
+					Username:  h.BitcraftUsername,
+					Balance:   h.Balance,
+				})
+			}
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func User(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userId, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
 		if err != nil {
@@ -114,6 +271,15 @@ func User(db *database.Database) http.HandlerFunc {
 			return
 		}
 
+		err = accounts.RecordAdminAction(r.Context(), db.Q, adminAudit(r, accounts.AdminUserViewed, fmt.Sprintf("user:%d", userId), nil, nil))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
 		data, err := json.Marshal(user)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -169,7 +335,7 @@ func Accounts(db *database.Database) http.HandlerFunc {
 	}
 }
 
-func CreateAccount(db *database.Database) http.HandlerFunc {
+func CreateAccount(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Input struct {
 			Addr     string  `json:"addr"`
@@ -195,7 +361,9 @@ func CreateAccount(db *database.Database) http.HandlerFunc {
 		}
 		defer tx.Rollback()
 
-		_, err = accounts.CreateAccount(r.Context(), db.Q.WithTx(tx), accounts.CreateAccountInput{
+		qtx := db.Q.WithTx(tx)
+
+		accId, err := accounts.CreateAccount(r.Context(), qtx, accounts.CreateAccountInput{
 			OwnerId:  body.OwnerId,
 			Address:  body.Addr,
 			Webhook:  body.Webhook,
@@ -207,13 +375,30 @@ func CreateAccount(db *database.Database) http.HandlerFunc {
 			return
 		}
 
-		tx.Commit()
+		acc, err := qtx.GetAccountById(r.Context(), accId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = accounts.RecordAdminAction(r.Context(), qtx, adminAudit(r, accounts.AdminAccountCreated, fmt.Sprintf("account:%d", accId), nil, acc))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
 
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
-func UpdateAddress(db *database.Database) http.HandlerFunc {
+func UpdateAddress(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accIdStr := chi.URLParam(r, "account_id")
 		accId, err := strconv.ParseInt(accIdStr, 10, 64)
@@ -235,24 +420,58 @@ func UpdateAddress(db *database.Database) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Q.UpdateAccountAddress(r.Context(), gensql.UpdateAccountAddressParams{
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
+
+		before, err := qtx.GetAccountById(r.Context(), accId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := qtx.UpdateAccountAddress(r.Context(), gensql.UpdateAccountAddressParams{
 			Address: body.Addr,
 			ID:      accId,
 		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		if rows == 0 {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+
+		after := before
+		after.Address = body.Addr
+		err = accounts.RecordAdminAction(r.Context(), qtx, adminAudit(r, accounts.AdminAddressUpdated, fmt.Sprintf("account:%d", accId), before, after))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func PatchBalance(db *database.Database) http.HandlerFunc {
+func PatchBalance(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accIdStr := chi.URLParam(r, "account_id")
 		accId, err := strconv.ParseInt(accIdStr, 10, 64)
@@ -274,7 +493,15 @@ func PatchBalance(db *database.Database) http.HandlerFunc {
 			return
 		}
 
-		acc, err := db.Q.GetAccountById(r.Context(), accId)
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
+
+		acc, err := qtx.GetAccountById(r.Context(), accId)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				w.WriteHeader(http.StatusNotFound)
@@ -287,24 +514,24 @@ func PatchBalance(db *database.Database) http.HandlerFunc {
 		var rows int64 = 0
 		if accounts.AccountCode(acc.Code).IsDebit() {
 			if body.AdjustBy > 0 {
-				rows, err = db.Q.UpdateDebitsPosted(r.Context(), gensql.UpdateDebitsPostedParams{
+				rows, err = qtx.UpdateDebitsPosted(r.Context(), gensql.UpdateDebitsPostedParams{
 					Quantity: body.AdjustBy,
 					ID:       accId,
 				})
 			} else {
-				rows, err = db.Q.UpdateCreditsPosted(r.Context(), gensql.UpdateCreditsPostedParams{
+				rows, err = qtx.UpdateCreditsPosted(r.Context(), gensql.UpdateCreditsPostedParams{
 					Quantity: -body.AdjustBy,
 					ID:       accId,
 				})
 			}
 		} else {
 			if body.AdjustBy > 0 {
-				rows, err = db.Q.UpdateCreditsPosted(r.Context(), gensql.UpdateCreditsPostedParams{
+				rows, err = qtx.UpdateCreditsPosted(r.Context(), gensql.UpdateCreditsPostedParams{
 					Quantity: body.AdjustBy,
 					ID:       accId,
 				})
 			} else {
-				rows, err = db.Q.UpdateDebitsPosted(r.Context(), gensql.UpdateDebitsPostedParams{
+				rows, err = qtx.UpdateDebitsPosted(r.Context(), gensql.UpdateDebitsPostedParams{
 					Quantity: -body.AdjustBy,
 					ID:       accId,
 				})
@@ -319,6 +546,25 @@ func PatchBalance(db *database.Database) http.HandlerFunc {
 			return
 		}
 
+		after, err := qtx.GetAccountById(r.Context(), accId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		err = accounts.RecordAdminAction(r.Context(), qtx, adminAudit(r, accounts.AdminBalanceAdjusted, fmt.Sprintf("account:%d", accId), acc, after))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -372,16 +618,127 @@ func Account(db *database.Database) http.HandlerFunc {
 	}
 }
 
-// TODO: Allow offset and limit query params
+const (
+	defaultTransfersLimit = 250
+	maxTransfersLimit     = 500
+)
+
 func Transfers(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accData := sessions.GetAccount(r.Context())
+		query := r.URL.Query()
+
+		params := gensql.GetTransfersByAccountIdParams{
+			AccountID: accData.Id,
+			Limit:     defaultTransfersLimit,
+		}
+
+		// Parses an optional int64 query param, returning false if invalid
+		parseInt := func(name string, dst **int64) bool {
+			if !query.Has(name) {
+				return true
+			}
+			num, err := strconv.ParseInt(query.Get(name), 10, 64)
+			if err != nil {
+				return false
+			}
+			*dst = &num
+			return true
+		}
+		// Same as parseInt, but for RFC 3339 times
+		parseTime := func(name string, dst **time.Time) bool {
+			if !query.Has(name) {
+				return true
+			}
+			t, err := time.Parse(time.RFC3339, query.Get(name))
+			if err != nil {
+				return false
+			}
+			// Times are stored in the server's zone, so compare in it as well
+			t = t.In(time.Local)
+			*dst = &t
+			return true
+		}
+
+		var limit *int64
+		if !parseInt("limit", &limit) ||
+			!parseInt("cursor", &params.BeforeID) ||
+			!parseInt("counterparty", &params.CounterpartyID) ||
+			!parseInt("minAmount", &params.MinAmount) ||
+			!parseInt("maxAmount", &params.MaxAmount) ||
+			!parseInt("code", &params.Code) ||
+			!parseTime("from", &params.CreatedFrom) ||
+			!parseTime("to", &params.CreatedTo) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if limit != nil {
+			if *limit < 1 || *limit > maxTransfersLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params.Limit = *limit
+		}
+		if query.Has("memo") {
+			memo := query.Get("memo")
+			params.Memo = &memo
+		}
+
+		// Whether funds went in or out depends on the side of the account's
+		// normal balance
+		if query.Has("direction") {
+			acc, err := db.Q.GetAccountById(r.Context(), accData.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			isDebit := accounts.AccountCode(acc.Code).IsDebit()
+			switch query.Get("direction") {
+			case "in":
+				if isDebit {
+					params.DebitAccountID = &accData.Id
+				} else {
+					params.CreditAccountID = &accData.Id
+				}
+			case "out":
+				if isDebit {
+					params.CreditAccountID = &accData.Id
+				} else {
+					params.DebitAccountID = &accData.Id
+				}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		if query.Has("metadataKey") {
+			key := query.Get("metadataKey")
+			if !accounts.IsValidMetadataKey(key) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			path := accounts.MetadataPath(key)
+			params.MetadataPath = &path
+			if query.Has("metadataValue") {
+				value := query.Get("metadataValue")
+				params.MetadataValue = &value
+			}
+		}
 
-		trs, err := db.Q.GetTransfersByAccountId(r.Context(), accData.Id)
+		// Fetch one extra to know if there's a next page
+		limitCount := params.Limit
+		params.Limit++
+
+		trs, err := db.Q.GetTransfersByAccountId(r.Context(), params)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		if int64(len(trs)) > limitCount {
+			trs = trs[:limitCount]
+			w.Header().Set("Next-Cursor", strconv.FormatInt(trs[len(trs)-1].ID, 10))
+		}
 
 		type ResponseRow struct {
 			ID int64 `json:"id"`
@@ -394,8 +751,9 @@ func Transfers(db *database.Database) http.HandlerFunc {
 			CreditAddr  string `json:"creditAddr"`
 
 			// PendingID       *int64    `json:"pendingId"`
-			Code int32   `json:"code"`
-			Memo *string `json:"memo,omitempty"`
+			Code     int32             `json:"code"`
+			Memo     *string           `json:"memo,omitempty"`
+			Metadata map[string]string `json:"metadata,omitempty"`
 			// Flags     uint8     `json:"flags"`
 			CreatedAt time.Time `json:"createdAt"`
 		}
@@ -413,6 +771,7 @@ func Transfers(db *database.Database) http.HandlerFunc {
 				CreditAddr:  t.CreditAddress,
 				Code:        int32(t.Code),
 				Memo:        t.Memo,
+				Metadata:    accounts.DecodeMetadata(t.Metadata),
 				CreatedAt:   t.CreatedAt,
 			})
 		}
@@ -451,37 +810,7 @@ func Transfer(db *database.Database) http.HandlerFunc {
 			return
 		}
 
-		type Response struct {
-			ID int64 `json:"id"`
-
-			DebitAccId  int64  `json:"debitAccId"`
-			CreditAccId int64  `json:"creditAccId"`
-			Amount      int64  `json:"amount"`
-			LedgerID    int64  `json:"ledgerId"`
-			DebitAddr   string `json:"debitAddr"`
-			CreditAddr  string `json:"creditAddr"`
-
-			// PendingID       *int64    `json:"pendingId"`
-			Code int32   `json:"code"`
-			Memo *string `json:"memo,omitempty"`
-			// Flags     uint8     `json:"flags"`
-			CreatedAt time.Time `json:"createdAt"`
-		}
-
-		rsp := Response{
-			ID:          tr.ID,
-			DebitAccId:  tr.DebitAccountID,
-			CreditAccId: tr.CreditAccountID,
-			Amount:      tr.Amount,
-			LedgerID:    tr.LedgerID,
-			DebitAddr:   tr.DebitAddress,
-			CreditAddr:  tr.CreditAddress,
-			Code:        int32(tr.Code),
-			Memo:        tr.Memo,
-			CreatedAt:   tr.CreatedAt,
-		}
-
-		data, err := json.Marshal(rsp)
+		data, err := json.Marshal(newTransferResponse(tr, accData.Id))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -492,7 +821,7 @@ func Transfer(db *database.Database) http.HandlerFunc {
 	}
 }
 
-func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.WebhookEnqueuer) http.HandlerFunc {
+func CreateTransfer(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accData := sessions.GetAccount(r.Context())
 
@@ -503,10 +832,12 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 		}
 
 		type Input struct {
-			ReceivingId int64   `json:"receivingId" validate:"required"`
-			Memo        *string `json:"memo"`
-			LedgerId    int64   `json:"ledgerId" validate:"required"`
-			Amount      int64   `json:"amount" validate:"min=1"`
+			ReceivingId int64             `json:"receivingId" validate:"required"`
+			Memo        *string           `json:"memo"`
+			Metadata    map[string]string `json:"metadata"`
+			LedgerId    int64             `json:"ledgerId" validate:"required"`
+			Amount      int64             `json:"amount" validate:"min=1"`
+			InvoiceId   *int64            `json:"invoiceId"`
 		}
 		var body Input
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -525,17 +856,21 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 		}
 		defer tx.Rollback()
 
-		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), nc, webhooks, accounts.CreateTransferInput{
+		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), accounts.CreateTransferInput{
 			SendingId:      accData.Id,
 			ReceivingId:    body.ReceivingId,
 			Memo:           body.Memo,
+			Metadata:       body.Metadata,
 			LedgerId:       body.LedgerId,
 			Amount:         body.Amount,
 			IdempotencyKey: idemKey,
+			Initiator:      transferInitiator(r, accData.Id),
+			InvoiceId:      body.InvoiceId,
 		})
 		if err != nil {
 			switch {
-			case errors.Is(err, accounts.ErrIdempotencyConflict):
+			case errors.Is(err, accounts.ErrIdempotencyConflict),
+				errors.Is(err, accounts.ErrInvoiceNotOpen):
 				w.WriteHeader(http.StatusConflict)
 				return
 			case errors.Is(err, accounts.ErrIdempotencyRace):
@@ -549,7 +884,7 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				if existing.RequestHash != accounts.TransferRequestHash(body.ReceivingId, body.Amount, body.LedgerId, body.Memo) {
+				if existing.RequestHash != accounts.TransferRequestHash(body.ReceivingId, body.Amount, body.LedgerId, body.Memo, body.Metadata, body.InvoiceId) {
 					w.WriteHeader(http.StatusConflict)
 					return
 				}
@@ -561,6 +896,9 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 				errors.Is(err, accounts.ErrIncompatibleAccCodes),
 				errors.Is(err, accounts.ErrIncompatibleLedgers),
 				errors.Is(err, accounts.ErrMemoExceedsLimit),
+				errors.Is(err, accounts.ErrMetadataInvalid),
+				errors.Is(err, accounts.ErrInvoiceNotFound),
+				errors.Is(err, accounts.ErrInvoiceMismatch),
 				errors.Is(err, accounts.ErrIdempotencyKeyRequired),
 				errors.Is(err, accounts.ErrIdempotencyKeyInvalid):
 				w.WriteHeader(http.StatusBadRequest)
@@ -575,8 +913,8 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if trResult.Created {
-			go trResult.Publish()
+		if trResult.Created && outbox != nil {
+			outbox.Notify()
 		}
 
 		status := http.StatusOK
@@ -587,27 +925,39 @@ func CreateTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 	}
 }
 
-func writeTransferJSON(w http.ResponseWriter, db *database.Database, r *http.Request, trID int64, status int) {
-	tr, err := db.Q.GetTransferWithAddrsById(r.Context(), trID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+type transferInitiatorResponse struct {
+	UserId    *int64  `json:"userId"`
+	Username  *string `json:"username"`
+	TokenId   *string `json:"tokenId"`
+	Channel   *string `json:"channel"`
+	RequestId *string `json:"requestId"`
 
-	type Response struct {
-		ID          int64     `json:"id"`
-		DebitAccId  int64     `json:"debitAccId"`
-		CreditAccId int64     `json:"creditAccId"`
-		Amount      int64     `json:"amount"`
-		LedgerID    int64     `json:"ledgerId"`
-		DebitAddr   string    `json:"debitAddr"`
-		CreditAddr  string    `json:"creditAddr"`
-		Code        int32     `json:"code"`
-		Memo        *string   `json:"memo,omitempty"`
-		CreatedAt   time.Time `json:"createdAt"`
-	}
+	ClientRequestId *string `json:"clientRequestId"`
+}
+
+type transferResponse struct {
+	ID int64 `json:"id"`
+
+	DebitAccId  int64  `json:"debitAccId"`
+	CreditAccId int64  `json:"creditAccId"`
+	Amount      int64  `json:"amount"`
+	LedgerID    int64  `json:"ledgerId"`
+	DebitAddr   string `json:"debitAddr"`
+	CreditAddr  string `json:"creditAddr"`
+
+	// PendingID       *int64    `json:"pendingId"`
+	Code     int32             `json:"code"`
+	Memo     *string           `json:"memo,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Flags     uint8     `json:"flags"`
+	CreatedAt time.Time                  `json:"createdAt"`
+	Initiator *transferInitiatorResponse `json:"initiator"`
+}
 
-	rsp := Response{
+// newTransferResponse is the transfer as seen by the account, which only
+// sees who made it if it was made from that account.
+func newTransferResponse(tr gensql.GetTransferWithAddrsByIdRow, accId int64) transferResponse {
+	rsp := transferResponse{
 		ID:          tr.ID,
 		DebitAccId:  tr.DebitAccountID,
 		CreditAccId: tr.CreditAccountID,
@@ -617,87 +967,2211 @@ func writeTransferJSON(w http.ResponseWriter, db *database.Database, r *http.Req
 		CreditAddr:  tr.CreditAddress,
 		Code:        int32(tr.Code),
 		Memo:        tr.Memo,
+		Metadata:    accounts.DecodeMetadata(tr.Metadata),
 		CreatedAt:   tr.CreatedAt,
 	}
+	if tr.InitiatorAccountID != nil && *tr.InitiatorAccountID == accId {
+		rsp.Initiator = &transferInitiatorResponse{
+			UserId:    tr.InitiatorUserID,
+			Username:  tr.InitiatorUsername,
+			TokenId:   tr.InitiatorTokenID,
+			Channel:   tr.Channel,
+			RequestId: tr.RequestID,
 
-	data, err := json.Marshal(rsp)
+			ClientRequestId: tr.ClientRequestID,
+		}
+	}
+	return rsp
+}
+
+func writeTransferJSON(w http.ResponseWriter, db *database.Database, r *http.Request, trID int64, status int) {
+	tr, err := db.Q.GetTransferWithAddrsById(r.Context(), trID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(data)
+	accData := sessions.GetAccount(r.Context())
+	writeJSON(w, newTransferResponse(tr, accData.Id), status)
 }
 
-func GetWebhook(db *database.Database) http.HandlerFunc {
+// Statement streams the account's transfers for a date range as CSV or
+// NDJSON. Shared by the API and the app, as both put the account in context.
+func Statement(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accData := sessions.GetAccount(r.Context())
+		query := r.URL.Query()
 
-		accResult, err := db.Q.GetAccountById(r.Context(), accData.Id)
+		input := accounts.StatementInput{AccountId: accData.Id}
+		var ok bool
+		input.From, input.To, ok = parseExportRange(query)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		format := query.Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		contentType := "text/csv; charset=utf-8"
+		if format == "ndjson" {
+			contentType = "application/x-ndjson"
+		}
+
+		// A read transaction keeps the opening balance and rows consistent
+		tx, err := db.Pool.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
 
-		data, err := json.Marshal(accResult.Webhook)
+		stmt, err := accounts.OpenStatement(r.Context(), qtx, input)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(data)
-	}
-}
-
-func PutWebhook(db *database.Database) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		accData := sessions.GetAccount(r.Context())
-
-		type Input struct {
-			Webhook string `json:"webhook"`
-		}
-		var body Input
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sw, ok := accounts.NewStatementWriter(w, format, stmt.Account.AssetScale)
+		if !ok {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		// Verify webhook is URL
-		_, err := url.ParseRequestURI(body.Webhook)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%d.%s"`, accData.Id, format))
+		w.Header().Set("X-Opening-Balance", accounts.FormatAmount(stmt.OpeningBalance, stmt.Account.AssetScale))
+
+		flusher, _ := w.(http.Flusher)
+		rows := 0
+		err = stmt.Each(r.Context(), qtx, func(row accounts.StatementRow) error {
+			if err := sw.WriteRow(row); err != nil {
+				return err
+			}
+			rows++
+			if rows%100 == 0 {
+				if err := sw.Flush(); err != nil {
+					return err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// Too late for a status, cut the response short so it's
+			// obviously incomplete
+			panic(http.ErrAbortHandler)
+		}
+		sw.Flush()
+	}
+}
+
+// parseExportRange parses the from and to query params of exports. Accepts
+// RFC 3339 times, or dates (UTC), where a date used as the end of the range
+// includes that whole day.
+func parseExportRange(query url.Values) (*time.Time, *time.Time, bool) {
+	parseTime := func(name string, endOfDay bool) (*time.Time, bool) {
+		if !query.Has(name) {
+			return nil, true
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			t, err = time.Parse(time.DateOnly, query.Get(name))
+			if err != nil {
+				return nil, false
+			}
+			if endOfDay {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		// Times are stored in the server's zone, so compare in it as well
+		t = t.In(time.Local)
+		return &t, true
+	}
+
+	from, ok := parseTime("from", false)
+	if !ok {
+		return nil, nil, false
+	}
+	to, ok := parseTime("to", true)
+	if !ok {
+		return nil, nil, false
+	}
+	if from != nil && to != nil && !to.After(*from) {
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// Journal exports the account's transfers as a Beancount or ledger-cli
+// journal.
+func Journal(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+		writeJournal(w, r, db, accounts.JournalInput{AccountId: &accData.Id}, fmt.Sprintf("journal-%d", accData.Id))
+	}
+}
+
+func writeJournal(w http.ResponseWriter, r *http.Request, db *database.Database, input accounts.JournalInput, filename string) {
+	query := r.URL.Query()
+
+	var ok bool
+	input.From, input.To, ok = parseExportRange(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	format, ok := accounts.ParseJournalFormat(query.Get("format"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Pool.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ext := "ledger"
+	if format == accounts.JournalBeancount {
+		ext = "beancount"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, ext))
+
+	err = accounts.WriteJournal(r.Context(), db.Q.WithTx(tx), w, format, input)
+	if err != nil {
+		// Too late for a status, cut the response short so it's obviously
+		// incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type archivedStatementResponse struct {
+	ID                     int64     `json:"id"`
+	PeriodStart            time.Time `json:"periodStart"`
+	PeriodEnd              time.Time `json:"periodEnd"`
+	OpeningBalance         int64     `json:"openingBalance"`
+	ClosingBalance         int64     `json:"closingBalance"`
+	PreviousClosingBalance *int64    `json:"previousClosingBalance"`
+	TotalIn                int64     `json:"totalIn"`
+	TotalOut               int64     `json:"totalOut"`
+	TransferCount          int64     `json:"transferCount"`
+	Digest                 string    `json:"digest"`
+	CreatedAt              time.Time `json:"createdAt"`
+}
+
+func ArchivedStatements(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		stmts, err := db.Q.GetAccountStatements(r.Context(), accData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rsp := make([]archivedStatementResponse, 0, len(stmts))
+		for _, s := range stmts {
+			rsp = append(rsp, archivedStatementResponse{
+				ID:                     s.ID,
+				PeriodStart:            s.PeriodStart.UTC(),
+				PeriodEnd:              s.PeriodEnd.UTC(),
+				OpeningBalance:         s.OpeningBalance,
+				ClosingBalance:         s.ClosingBalance,
+				PreviousClosingBalance: s.PreviousClosingBalance,
+				TotalIn:                s.TotalIn,
+				TotalOut:               s.TotalOut,
+				TransferCount:          s.TransferCount,
+				Digest:                 s.Digest,
+				CreatedAt:              s.CreatedAt,
+			})
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// ArchivedStatement downloads a monthly statement from the object store.
+// Shared by the API and the app, as both put the account in context.
+func ArchivedStatement(db *database.Database, statementsOS jetstream.ObjectStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		stmtId, err := strconv.ParseInt(chi.URLParam(r, "statement_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		stmt, err := db.Q.GetAccountStatementById(r.Context(), stmtId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if stmt.AccountID != accData.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		obj, err := statementsOS.Get(r.Context(), stmt.ObjectName)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer obj.Close()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%d-%s.json"`, accData.Id, stmt.PeriodStart.UTC().Format("2006-01")))
+		io.Copy(w, obj)
+	}
+}
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 500
+	maxEventsWait      = 60 * time.Second
+	// Even without waiting, events already in the stream take a moment to
+	// be delivered
+	minEventsWait      = 250 * time.Millisecond
+	eventsSSEKeepAlive = 15 * time.Second
+	eventsSSERetry     = 3 * time.Second
+)
+
+type accountEvent struct {
+	Seq  uint64          `json:"seq"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func transferEvent(msg jetstream.Msg) (accountEvent, bool) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return accountEvent{}, false
+	}
+	return accountEvent{
+		Seq:  meta.Sequence.Stream,
+		Type: "transfer",
+		Data: msg.Data(),
+	}, true
+}
+
+// accountTransfers reads the account's transfer events from the TRANSFERS
+// stream, after the sequence or, with fromNew, only those published from now
+// on. The iterator is stopped once the request is done.
+func accountTransfers(ctx context.Context, transfersStream jetstream.Stream, accId int64, after uint64, fromNew bool, batch int) (jetstream.MessagesContext, error) {
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{
+			fmt.Sprintf("accounts.transfers.%d.*", accId),
+			fmt.Sprintf("accounts.transfers.*.%d", accId),
+		},
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	}
+	if fromNew {
+		cfg.DeliverPolicy = jetstream.DeliverNewPolicy
+	} else if after > 0 {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = after + 1
+	}
+	cons, err := transfersStream.OrderedConsumer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	it, err := cons.Messages(jetstream.PullMaxMessages(batch))
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, it.Stop)
+	return it, nil
+}
+
+// writeAccountEventsSSE sends transfer events from the iterator, and any
+// live events (published on core NATS, so without a sequence), as SSE until
+// the client goes away. Transfer events have their sequence as their ID, so
+// reconnecting clients can resume with Last-Event-ID.
+func writeAccountEventsSSE(w http.ResponseWriter, r *http.Request, it jetstream.MessagesContext, live <-chan *nats.Msg) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsSSERetry.Milliseconds())
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	msgs := make(chan jetstream.Msg)
+	go func() {
+		defer close(msgs)
+		for {
+			msg, err := it.Next()
+			if err != nil {
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(eventsSSEKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case msg := <-live:
+			// The subject is accounts.{type}s.{...}
+			evtType := strings.TrimSuffix(strings.Split(msg.Subject, ".")[1], "s")
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evtType, msg.Data)
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			evt, ok := transferEvent(msg)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.Seq, evt.Type, evt.Data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// AccountEvents replays the account's transfer events from the TRANSFERS
+// stream after a sequence, as a (long-polled) JSON batch or, for clients
+// accepting text/event-stream, as SSE that keeps going with new events.
+func AccountEvents(transfersStream jetstream.Stream) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+		query := r.URL.Query()
+		isSSE := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+		var after uint64
+		afterStr := query.Get("after")
+		// Reconnecting EventSources resume from the last ID they saw
+		if afterStr == "" && isSSE {
+			afterStr = r.Header.Get("Last-Event-ID")
+		}
+		if afterStr != "" {
+			var err error
+			after, err = strconv.ParseUint(afterStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := int64(defaultEventsLimit)
+		if query.Has("limit") {
+			var err error
+			limit, err = strconv.ParseInt(query.Get("limit"), 10, 64)
+			if err != nil || limit < 1 || limit > maxEventsLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		var wait time.Duration
+		if query.Has("wait") {
+			secs, err := strconv.ParseInt(query.Get("wait"), 10, 64)
+			if err != nil || secs < 0 || time.Duration(secs)*time.Second > maxEventsWait {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			wait = time.Duration(secs) * time.Second
+		}
+
+		it, err := accountTransfers(r.Context(), transfersStream, accData.Id, after, false, int(limit))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer it.Stop()
+
+		if isSSE {
+			writeAccountEventsSSE(w, r, it, nil)
+			return
+		}
+
+		// Wait for the first event, then take whatever else is pending
+		timer := time.AfterFunc(max(wait, minEventsWait), it.Stop)
+		defer timer.Stop()
+
+		type Response struct {
+			Events []accountEvent `json:"events"`
+			Next   uint64         `json:"next"` // Pass as after for the next batch
+		}
+		rsp := Response{
+			Events: make([]accountEvent, 0),
+			Next:   after,
+		}
+		for int64(len(rsp.Events)) < limit {
+			msg, err := it.Next()
+			if err != nil {
+				break
+			}
+			evt, ok := transferEvent(msg)
+			if !ok {
+				break
+			}
+			rsp.Events = append(rsp.Events, evt)
+			rsp.Next = evt.Seq
+
+			meta, _ := msg.Metadata()
+			if meta.NumPending == 0 {
+				break
+			}
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// AccountStream pushes the account's events as SSE as they happen: transfers,
+// changes to who has permissions on the account, and webhooks being disabled.
+// Clients reconnecting with Last-Event-ID (or after) first get the transfers
+// they missed, otherwise it starts from now.
+func AccountStream(transfersStream jetstream.Stream, nc *nats.Conn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		afterStr := r.Header.Get("Last-Event-ID")
+		if afterStr == "" {
+			afterStr = r.URL.Query().Get("after")
+		}
+		var after uint64
+		if afterStr != "" {
+			var err error
+			after, err = strconv.ParseUint(afterStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Subscribe first, so nothing is missed while the consumer starts.
+		// accounts.*.{id} gets the account's permission and webhook events.
+		liveChan := make(chan *nats.Msg, 16)
+		liveSub, err := nc.ChanSubscribe(fmt.Sprintf("accounts.*.%v", accData.Id), liveChan)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer liveSub.Unsubscribe()
+
+		it, err := accountTransfers(r.Context(), transfersStream, accData.Id, after, afterStr == "", defaultEventsLimit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer it.Stop()
+
+		writeAccountEventsSSE(w, r, it, liveChan)
+	}
+}
+
+type webhookResponse struct {
+	ID             int64                  `json:"id"`
+	Url            string                 `json:"url"`
+	Events         []string               `json:"events"`
+	Enabled        bool                   `json:"enabled"`
+	Ordered        bool                   `json:"ordered"`
+	PayloadVersion int64                  `json:"payloadVersion"`
+	CloudEvents    bool                   `json:"cloudEvents"`
+	Health         accounts.WebhookHealth `json:"health"`
+	FailureStreak  int64                  `json:"failureStreak"`
+	DisabledReason *string                `json:"disabledReason"`
+	Secret         *string                `json:"secret,omitempty"` // Only when created
+	UpdatedAt      time.Time              `json:"updatedAt"`
+	CreatedAt      time.Time              `json:"createdAt"`
+}
+
+func newWebhookResponse(e gensql.WebhookEndpoint) webhookResponse {
+	return webhookResponse{
+		ID:             e.ID,
+		Url:            e.Url,
+		Events:         accounts.WebhookEvent(e.Events).Names(),
+		Enabled:        e.Enabled != 0,
+		Ordered:        e.Ordered != 0,
+		PayloadVersion: e.PayloadVersion,
+		CloudEvents:    e.Cloudevents != 0,
+		Health:         accounts.WebhookEndpointHealth(e),
+		FailureStreak:  e.FailureStreak,
+		DisabledReason: e.DisabledReason,
+		UpdatedAt:      e.UpdatedAt,
+		CreatedAt:      e.CreatedAt,
+	}
+}
+
+// webhookFromRequest gets the webhook endpoint in the path or, for the
+// /webhook routes from before accounts could have several, the account's
+// first endpoint.
+func webhookFromRequest(r *http.Request, q *gensql.Queries, accId int64) (gensql.WebhookEndpoint, error) {
+	idStr := chi.URLParam(r, "webhook_id")
+	if idStr == "" {
+		e, err := q.GetFirstWebhookEndpoint(r.Context(), accId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, accounts.ErrWebhookNotFound
+		}
+		return e, err
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return gensql.WebhookEndpoint{}, accounts.ErrWebhookNotFound
+	}
+	e, err := q.GetAccountWebhookEndpoint(r.Context(), gensql.GetAccountWebhookEndpointParams{
+		ID:        id,
+		AccountID: accId,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, accounts.ErrWebhookNotFound
+	}
+	return e, err
+}
+
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, accounts.ErrWebhookNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, accounts.ErrWebhookUrlInvalid),
+		errors.Is(err, accounts.ErrWebhookEventsInvalid),
+		errors.Is(err, accounts.ErrWebhookPayloadVersionInvalid):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, accounts.ErrTooManyWebhooks),
+		errors.Is(err, accounts.ErrWebhookPingRequired):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func GetWebhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		var webhook *string
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err == nil {
+			webhook = &e.Url
+		} else if !errors.Is(err, accounts.ErrWebhookNotFound) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, webhook, http.StatusOK)
+	}
+}
+
+func PutWebhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			Webhook string `json:"webhook"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
+
+		// Update the first endpoint, or create one getting transfers like
+		// webhooks always have
+		type Response struct {
+			Secret *string `json:"secret"`
+		}
+		var rsp Response
+		e, err := webhookFromRequest(r, qtx, accData.Id)
+		switch {
+		case err == nil:
+			_, err = accounts.UpdateWebhook(r.Context(), qtx, accounts.UpdateWebhookInput{
+				AccountId: accData.Id,
+				Id:        e.ID,
+				Url:       &body.Webhook,
+			})
+		case errors.Is(err, accounts.ErrWebhookNotFound):
+			e, err = accounts.CreateWebhook(r.Context(), qtx, accounts.CreateWebhookInput{
+				AccountId: accData.Id,
+				Url:       body.Webhook,
+				Events:    accounts.WebhookEventsTransfers,
+				Enabled:   true,
+			})
+			// The secret is only ever shown here, when it's first generated
+			rsp.Secret = &e.Secret
+		}
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, rsp, http.StatusOK)
+	}
+}
+
+func DeleteWebhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			// Nothing to delete is fine for the /webhook route
+			if errors.Is(err, accounts.ErrWebhookNotFound) && chi.URLParam(r, "webhook_id") == "" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			writeWebhookError(w, err)
+			return
+		}
+
+		_, err = db.Q.DeleteWebhookEndpoint(r.Context(), gensql.DeleteWebhookEndpointParams{
+			ID:        e.ID,
+			AccountID: accData.Id,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func RotateWebhookSecret(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		secret, err := accounts.RotateWebhookSecret(r.Context(), db.Q, accData.Id, e.ID)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		type Response struct {
+			Secret                  string    `json:"secret"`
+			PreviousSecretExpiresAt time.Time `json:"previousSecretExpiresAt"`
+		}
+		writeJSON(w, Response{
+			Secret:                  secret,
+			PreviousSecretExpiresAt: time.Now().Add(accounts.WebhookSecretOverlap),
+		}, http.StatusOK)
+	}
+}
+
+func Webhooks(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		endpoints, err := db.Q.GetWebhookEndpointsByAccountId(r.Context(), accData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rsp := make([]webhookResponse, 0, len(endpoints))
+		for _, e := range endpoints {
+			rsp = append(rsp, newWebhookResponse(e))
+		}
+		writeJSON(w, rsp, http.StatusOK)
+	}
+}
+
+func Webhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		writeJSON(w, newWebhookResponse(e), http.StatusOK)
+	}
+}
+
+func CreateWebhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			Url            string   `json:"url" validate:"required"`
+			Events         []string `json:"events"`
+			Enabled        *bool    `json:"enabled"`
+			Ordered        bool     `json:"ordered"`
+			PayloadVersion int64    `json:"payloadVersion"`
+			CloudEvents    bool     `json:"cloudEvents"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if validate.Struct(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		events := accounts.WebhookEventsTransfers
+		if body.Events != nil {
+			var ok bool
+			events, ok = accounts.ParseWebhookEvents(body.Events)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		enabled := body.Enabled == nil || *body.Enabled
+
+		e, err := accounts.CreateWebhook(r.Context(), db.Q, accounts.CreateWebhookInput{
+			AccountId:      accData.Id,
+			Url:            body.Url,
+			Events:         events,
+			Enabled:        enabled,
+			Ordered:        body.Ordered,
+			PayloadVersion: body.PayloadVersion,
+			CloudEvents:    body.CloudEvents,
+		})
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		rsp := newWebhookResponse(e)
+		rsp.Secret = &e.Secret
+		writeJSON(w, rsp, http.StatusCreated)
+	}
+}
+
+func UpdateWebhook(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type Input struct {
+			Url            *string  `json:"url"`
+			Events         []string `json:"events"`
+			Enabled        *bool    `json:"enabled"`
+			Ordered        *bool    `json:"ordered"`
+			PayloadVersion *int64   `json:"payloadVersion"`
+			CloudEvents    *bool    `json:"cloudEvents"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		input := accounts.UpdateWebhookInput{
+			AccountId:      accData.Id,
+			Id:             id,
+			Url:            body.Url,
+			Enabled:        body.Enabled,
+			Ordered:        body.Ordered,
+			PayloadVersion: body.PayloadVersion,
+			CloudEvents:    body.CloudEvents,
+		}
+		if body.Events != nil {
+			events, ok := accounts.ParseWebhookEvents(body.Events)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			input.Events = &events
+		}
+
+		e, err := accounts.UpdateWebhook(r.Context(), db.Q, input)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		writeJSON(w, newWebhookResponse(e), http.StatusOK)
+	}
+}
+
+type webhookTestResponse struct {
+	Ok           bool    `json:"ok"`         // Responded with a 2xx status
+	StatusCode   *int    `json:"statusCode"` // Null when there was no response
+	LatencyMs    int64   `json:"latencyMs"`
+	ResponseBody *string `json:"responseBody"`
+	Error        *string `json:"error"`
+}
+
+func newWebhookTestResponse(res webhooks.TestResult, err error) webhookTestResponse {
+	rsp := webhookTestResponse{
+		Ok:        testOk(res, err),
+		LatencyMs: res.Latency.Milliseconds(),
+	}
+	if res.StatusCode != 0 {
+		rsp.StatusCode = &res.StatusCode
+		rsp.ResponseBody = &res.ResponseBody
+	}
+	if err != nil {
+		msg := err.Error()
+		rsp.Error = &msg
+	}
+	return rsp
+}
+
+func testOk(res webhooks.TestResult, err error) bool {
+	return err == nil && res.StatusCode >= 200 && res.StatusCode < 300
+}
+
+// TestWebhook sends the webhook a test event and responds with how it
+// responded. The request body is optional, and defaults to a ping.
+func TestWebhook(db *database.Database, webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			Event *string `json:"event"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		event := accounts.WebhookEventNone
+		if body.Event != nil && *body.Event != "ping" {
+			var ok bool
+			event, ok = accounts.ParseWebhookEvents([]string{*body.Event})
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		res, err := webhookSvc.Test(r.Context(), e, event)
+		if errors.Is(err, webhooks.ErrTestEventUnsupported) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, newWebhookTestResponse(res, err), http.StatusOK)
+	}
+}
+
+// EnableWebhook enables a webhook, once it responds to a ping with a 2xx
+// status.
+func EnableWebhook(db *database.Database, webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		res, err := webhookSvc.Ping(r.Context(), e)
+		if !testOk(res, err) {
+			writeJSON(w, newWebhookTestResponse(res, err), http.StatusUnprocessableEntity)
+			return
+		}
+
+		enabled := true
+		e, err = accounts.UpdateWebhook(r.Context(), db.Q, accounts.UpdateWebhookInput{
+			AccountId: accData.Id,
+			Id:        e.ID,
+			Enabled:   &enabled,
+			Pinged:    true,
+		})
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		writeJSON(w, newWebhookResponse(e), http.StatusOK)
+	}
+}
+
+const (
+	defaultWebhookDeliveriesLimit = 50
+	maxWebhookDeliveriesLimit     = 100
+)
+
+type webhookDeliveryResponse struct {
+	ID           int64     `json:"id"`
+	WebhookID    int64     `json:"webhookId"`
+	EventID      string    `json:"eventId"`
+	TransferID   *int64    `json:"transferId"` // Null for events other than transfers
+	Attempt      int64     `json:"attempt"`
+	Url          string    `json:"url"`
+	RequestBody  string    `json:"requestBody"`
+	StatusCode   *int64    `json:"statusCode"`
+	LatencyMs    int64     `json:"latencyMs"`
+	ResponseBody *string   `json:"responseBody"`
+	Error        *string   `json:"error"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func newWebhookDeliveryResponse(d gensql.WebhookDelivery) webhookDeliveryResponse {
+	return webhookDeliveryResponse{
+		ID:           d.ID,
+		WebhookID:    d.EndpointID,
+		EventID:      d.EventID,
+		TransferID:   d.TransferID,
+		Attempt:      d.Attempt,
+		Url:          d.Url,
+		RequestBody:  d.RequestBody,
+		StatusCode:   d.StatusCode,
+		LatencyMs:    d.LatencyMs,
+		ResponseBody: d.ResponseBody,
+		Error:        d.Error,
+		CreatedAt:    d.CreatedAt,
+	}
+}
+
+func WebhookDeliveries(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+		query := r.URL.Query()
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+
+		params := gensql.GetWebhookDeliveriesParams{
+			EndpointID: e.ID,
+			Limit:      defaultWebhookDeliveriesLimit,
+		}
+		if query.Has("limit") {
+			limit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+			if err != nil || limit < 1 || limit > maxWebhookDeliveriesLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params.Limit = limit
+		}
+		if query.Has("before") {
+			before, err := strconv.ParseInt(query.Get("before"), 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params.BeforeID = &before
+		}
+
+		deliveries, err := db.Q.GetWebhookDeliveries(r.Context(), params)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rsp := make([]webhookDeliveryResponse, 0, len(deliveries))
+		for _, d := range deliveries {
+			rsp = append(rsp, newWebhookDeliveryResponse(d))
+		}
+		writeJSON(w, rsp, http.StatusOK)
+	}
+}
+
+func WebhookDelivery(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		e, err := webhookFromRequest(r, db.Q, accData.Id)
+		if err != nil {
+			writeWebhookError(w, err)
+			return
+		}
+		deliveryId, err := strconv.ParseInt(chi.URLParam(r, "delivery_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		d, err := db.Q.GetAccountWebhookDelivery(r.Context(), gensql.GetAccountWebhookDeliveryParams{
+			ID:        deliveryId,
+			AccountID: accData.Id,
+		})
+		if err != nil || d.EndpointID != e.ID {
+			if err == nil || errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, newWebhookDeliveryResponse(d), http.StatusOK)
+	}
+}
+
+func RedeliverWebhook(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		webhookId, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deliveryId, err := strconv.ParseInt(chi.URLParam(r, "delivery_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = accounts.RedeliverWebhook(r.Context(), db.Q, accData.Id, webhookId, deliveryId)
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrWebhookNotFound),
+				errors.Is(err, accounts.ErrWebhookDeliveryNotFound):
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+const (
+	defaultDeadLettersLimit = 50
+	maxDeadLettersLimit     = 100
+)
+
+// deadLetterAccount is the account dead letters are limited to: the token's
+// account, or for admins the optional account_id query parameter (zero for
+// all accounts).
+func deadLetterAccount(r *http.Request) (int64, error) {
+	if accData := sessions.GetAccount(r.Context()); accData != nil {
+		return accData.Id, nil
+	}
+	if !r.URL.Query().Has("account_id") {
+		return 0, nil
+	}
+	return strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+}
+
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, webhooks.ErrDeadLetterNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, webhooks.ErrEndpointUnavailable):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func DeadLetters(webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		accId, err := deadLetterAccount(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultDeadLettersLimit
+		if query.Has("limit") {
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > maxDeadLettersLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		var after uint64
+		if query.Has("after") {
+			after, err = strconv.ParseUint(query.Get("after"), 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		dls, err := webhookSvc.DeadLetters(r.Context(), accId, after, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, dls, http.StatusOK)
+	}
+}
+
+func DeadLetter(webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accId, err := deadLetterAccount(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseUint(chi.URLParam(r, "dead_letter_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dl, err := webhookSvc.DeadLetter(r.Context(), accId, id)
+		if err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+		writeJSON(w, dl, http.StatusOK)
+	}
+}
+
+func ReplayDeadLetter(db *database.Database, webhookSvc *webhooks.Service, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accId, err := deadLetterAccount(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseUint(chi.URLParam(r, "dead_letter_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := webhookSvc.ReplayDeadLetter(r.Context(), accId, id); err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+
+		// Admins' are recorded once they're made, as the DLQ isn't in the
+		// database's transaction
+		if sessions.GetAccount(r.Context()) == nil {
+			err = accounts.RecordAdminAction(r.Context(), db.Q, adminAudit(r, accounts.AdminDeadLetterReplayed, fmt.Sprintf("dead_letter:%d", id), nil, nil))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if outbox != nil {
+				outbox.Notify()
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func DiscardDeadLetter(db *database.Database, webhookSvc *webhooks.Service, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accId, err := deadLetterAccount(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseUint(chi.URLParam(r, "dead_letter_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := webhookSvc.DiscardDeadLetter(r.Context(), accId, id); err != nil {
+			writeDeadLetterError(w, err)
+			return
+		}
+
+		// Admins' are recorded once they're made, as the DLQ isn't in the
+		// database's transaction
+		if sessions.GetAccount(r.Context()) == nil {
+			err = accounts.RecordAdminAction(r.Context(), db.Q, adminAudit(r, accounts.AdminDeadLetterDiscarded, fmt.Sprintf("dead_letter:%d", id), nil, nil))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if outbox != nil {
+				outbox.Notify()
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+const (
+	defaultAdminAuditLimit = 100
+	maxAdminAuditLimit     = 500
+)
+
+func AdminAudit(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		params := gensql.GetAdminAuditEntriesParams{
+			Limit: defaultAdminAuditLimit,
+		}
+		if query.Has("action") {
+			action := query.Get("action")
+			params.Action = &action
+		}
+		if query.Has("target") {
+			target := query.Get("target")
+			params.Target = &target
+		}
+		if query.Has("before") {
+			before, err := strconv.ParseInt(query.Get("before"), 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params.BeforeID = &before
+		}
+		if query.Has("limit") {
+			limit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+			if err != nil || limit < 1 || limit > maxAdminAuditLimit {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			params.Limit = limit
+		}
+
+		entries, err := db.Q.GetAdminAuditEntries(r.Context(), params)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rsp := make([]accounts.EventAdminAudit, 0, len(entries))
+		for _, entry := range entries {
+			var diff map[string]accounts.AuditChange
+			if err := json.Unmarshal([]byte(entry.Diff), &diff); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rsp = append(rsp, accounts.EventAdminAudit{
+				ID:        entry.ID,
+				Action:    accounts.AdminAction(entry.Action),
+				Target:    entry.Target,
+				Diff:      diff,
+				SourceIp:  entry.SourceIp,
+				RequestId: entry.RequestID,
+				CreatedAt: entry.CreatedAt,
+
+				ClientRequestId: entry.ClientRequestID,
+			})
+		}
+		writeJSON(w, rsp, http.StatusOK)
+	}
+}
+
+func PutPrivacy(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			Private bool `json:"private"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = accounts.SetAccountFlag(r.Context(), db.Q.WithTx(tx), accData.Id, accounts.AccFlagPrivate, body.Private)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type distributionPayoutResponse struct {
+	HolderAccId   int64  `json:"holderAccId"`
+	PayoutAccId   int64  `json:"payoutAccId"`
+	HolderBalance int64  `json:"holderBalance"`
+	Amount        int64  `json:"amount"`
+	TransferID    *int64 `json:"transferId"`
+}
+
+type distributionResponse struct {
+	ID             int64                        `json:"id"`
+	SourceAccId    int64                        `json:"sourceAccId"`
+	HolderLedgerID int64                        `json:"holderLedgerId"`
+	Amount         int64                        `json:"amount"`
+	Memo           *string                      `json:"memo,omitempty"`
+	SnapshotAt     time.Time                    `json:"snapshotAt"`
+	CreatedAt      time.Time                    `json:"createdAt"`
+	Payouts        []distributionPayoutResponse `json:"payouts,omitempty"`
+}
+
+func CreateDistribution(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			HolderLedgerId int64      `json:"holderLedgerId" validate:"required"`
+			Amount         int64      `json:"amount" validate:"min=1"`
+			Memo           *string    `json:"memo"`
+			SnapshotAt     *time.Time `json:"snapshotAt"`
+			DryRun         bool       `json:"dryRun"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if validate.Struct(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		input := accounts.CreateDistributionInput{
+			SourceId:       accData.Id,
+			HolderLedgerId: body.HolderLedgerId,
+			Amount:         body.Amount,
+			Memo:           body.Memo,
+			SnapshotAt:     body.SnapshotAt,
+			IdempotencyKey: strings.TrimSpace(r.Header.Get("Idempotency-Key")),
+			Initiator:      transferInitiator(r, accData.Id),
+		}
+
+		if body.DryRun {
+			plan, err := accounts.PlanDistribution(r.Context(), db.Q, input)
+			if err != nil {
+				switch {
+				case errors.Is(err, accounts.ErrInvalidQuantity),
+					errors.Is(err, accounts.ErrMemoExceedsLimit),
+					errors.Is(err, accounts.ErrDistributionNoHolders),
+					errors.Is(err, accounts.ErrDistributionSnapshotInFuture):
+					w.WriteHeader(http.StatusBadRequest)
+				default:
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				return
+			}
+
+			type Response struct {
+				HolderLedgerID int64                        `json:"holderLedgerId"`
+				PayoutLedgerID int64                        `json:"payoutLedgerId"`
+				Amount         int64                        `json:"amount"`
+				SnapshotAt     time.Time                    `json:"snapshotAt"`
+				Payouts        []distributionPayoutResponse `json:"payouts"`
+				Skipped        []int64                      `json:"skipped"`
+			}
+			rsp := Response{
+				HolderLedgerID: body.HolderLedgerId,
+				PayoutLedgerID: plan.PayoutLedgerId,
+				Amount:         body.Amount,
+				SnapshotAt:     plan.SnapshotAt,
+				Payouts:        make([]distributionPayoutResponse, 0, len(plan.Payouts)),
+				Skipped:        make([]int64, 0, len(plan.Skipped)),
+			}
+			for _, p := range plan.Payouts {
+				rsp.Payouts = append(rsp.Payouts, distributionPayoutResponse{
+					HolderAccId:   p.HolderAccId,
+					PayoutAccId:   p.PayoutAccId,
+					HolderBalance: p.HolderBalance,
+					Amount:        p.Amount,
+				})
+			}
+			rsp.Skipped = append(rsp.Skipped, plan.Skipped...)
+
+			data, err := json.Marshal(rsp)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+
+		if input.IdempotencyKey == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		distResult, err := accounts.CreateDistribution(r.Context(), db.Q.WithTx(tx), input)
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrIdempotencyConflict):
+				w.WriteHeader(http.StatusConflict)
+				return
+			case errors.Is(err, accounts.ErrIdempotencyRace):
+				// Roll back our partial write, then resolve against the winning claim.
+				_ = tx.Rollback()
+				existing, lookupErr := db.Q.GetDistributionByKey(r.Context(), gensql.GetDistributionByKeyParams{
+					SourceAccountID: accData.Id,
+					IdempotencyKey:  input.IdempotencyKey,
+				})
+				if lookupErr != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if existing.RequestHash != accounts.DistributionRequestHash(body.HolderLedgerId, body.Amount, body.SnapshotAt, body.Memo) {
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+				writeDistributionJSON(w, db, r, existing.ID, http.StatusOK)
+				return
+			case errors.Is(err, accounts.ErrInvalidBalance),
+				errors.Is(err, accounts.ErrInvalidQuantity),
+				errors.Is(err, accounts.ErrIncompatibleAccCodes),
+				errors.Is(err, accounts.ErrMemoExceedsLimit),
+				errors.Is(err, accounts.ErrDistributionNoHolders),
+				errors.Is(err, accounts.ErrDistributionSnapshotInFuture),
+				errors.Is(err, accounts.ErrIdempotencyKeyRequired),
+				errors.Is(err, accounts.ErrIdempotencyKeyInvalid):
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if distResult.Created && outbox != nil {
+			outbox.Notify()
+		}
+
+		status := http.StatusOK
+		if distResult.Created {
+			status = http.StatusCreated
+		}
+		writeDistributionJSON(w, db, r, distResult.DistributionID, status)
+	}
+}
+
+func Distributions(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		dists, err := db.Q.GetDistributionsBySourceAccountId(r.Context(), accData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rsp := make([]distributionResponse, 0, len(dists))
+		for _, d := range dists {
+			rsp = append(rsp, distributionResponse{
+				ID:             d.ID,
+				SourceAccId:    d.SourceAccountID,
+				HolderLedgerID: d.HolderLedgerID,
+				Amount:         d.Amount,
+				Memo:           d.Memo,
+				SnapshotAt:     d.SnapshotAt,
+				CreatedAt:      d.CreatedAt,
+			})
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func Distribution(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		distId, err := strconv.ParseInt(chi.URLParam(r, "distribution_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dist, err := db.Q.GetDistributionById(r.Context(), distId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Don't allow reading other's distribution(s)
+		if dist.SourceAccountID != accData.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeDistributionJSON(w, db, r, dist.ID, http.StatusOK)
+	}
+}
+
+func writeDistributionJSON(w http.ResponseWriter, db *database.Database, r *http.Request, distID int64, status int) {
+	dist, err := db.Q.GetDistributionById(r.Context(), distID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payouts, err := db.Q.GetDistributionPayouts(r.Context(), distID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rsp := distributionResponse{
+		ID:             dist.ID,
+		SourceAccId:    dist.SourceAccountID,
+		HolderLedgerID: dist.HolderLedgerID,
+		Amount:         dist.Amount,
+		Memo:           dist.Memo,
+		SnapshotAt:     dist.SnapshotAt,
+		CreatedAt:      dist.CreatedAt,
+		Payouts:        make([]distributionPayoutResponse, 0, len(payouts)),
+	}
+	for _, p := range payouts {
+		rsp.Payouts = append(rsp.Payouts, distributionPayoutResponse{
+			HolderAccId:   p.HolderAccountID,
+			PayoutAccId:   p.PayoutAccountID,
+			HolderBalance: p.HolderBalance,
+			Amount:        p.Amount,
+			TransferID:    p.TransferID,
+		})
+	}
+
+	data, err := json.Marshal(rsp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+type invoiceResponse struct {
+	ID         int64      `json:"id"`
+	AccountID  int64      `json:"accountId"`
+	Amount     int64      `json:"amount"`
+	Memo       *string    `json:"memo,omitempty"`
+	Status     string     `json:"status"`
+	Link       string     `json:"link"`
+	ReturnUrl  *string    `json:"returnUrl,omitempty"`
+	CancelUrl  *string    `json:"cancelUrl,omitempty"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	TransferID *int64     `json:"transferId,omitempty"`
+	PaidAt     *time.Time `json:"paidAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func newInvoiceResponse(inv gensql.Invoice, now time.Time) invoiceResponse {
+	return invoiceResponse{
+		ID:         inv.ID,
+		AccountID:  inv.AccountID,
+		Amount:     inv.Amount,
+		Memo:       inv.Memo,
+		Status:     accounts.EffectiveInvoiceStatus(inv, now).String(),
+		Link:       accounts.InvoiceLink(inv.Token),
+		ReturnUrl:  inv.ReturnUrl,
+		CancelUrl:  inv.CancelUrl,
+		ExpiresAt:  inv.ExpiresAt,
+		TransferID: inv.TransferID,
+		PaidAt:     inv.PaidAt,
+		CreatedAt:  inv.CreatedAt,
+	}
+}
+
+func CreateInvoice(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		type Input struct {
+			Amount    int64      `json:"amount" validate:"min=1"`
+			Memo      *string    `json:"memo"`
+			ExpiresAt *time.Time `json:"expiresAt"`
+			ReturnUrl *string    `json:"returnUrl"`
+			CancelUrl *string    `json:"cancelUrl"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if validate.Struct(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		invId, _, err := accounts.CreateInvoice(r.Context(), db.Q, accounts.CreateInvoiceInput{
+			AccountId: accData.Id,
+			Amount:    body.Amount,
+			Memo:      body.Memo,
+			ExpiresAt: body.ExpiresAt,
+			ReturnUrl: body.ReturnUrl,
+			CancelUrl: body.CancelUrl,
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrInvalidQuantity),
+				errors.Is(err, accounts.ErrMemoExceedsLimit),
+				errors.Is(err, accounts.ErrIncompatibleAccCodes),
+				errors.Is(err, accounts.ErrInvoiceExpiryInvalid),
+				errors.Is(err, accounts.ErrCheckoutUrlInvalid),
+				errors.Is(err, accounts.ErrCheckoutSecretRequired):
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeInvoiceJSON(w, db, r, invId, http.StatusCreated)
+	}
+}
+
+func Invoices(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		params := gensql.GetInvoicesByAccountIdParams{
+			AccountID: accData.Id,
+		}
+		var filter *accounts.InvoiceStatus
+		if r.URL.Query().Has("status") {
+			status, ok := accounts.ParseInvoiceStatus(r.URL.Query().Get("status"))
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter = &status
+
+			// Expired invoices are stored as open
+			stored := int64(status)
+			if status == accounts.InvExpired {
+				stored = int64(accounts.InvOpen)
+			}
+			params.Status = &stored
+		}
+
+		invs, err := db.Q.GetInvoicesByAccountId(r.Context(), params)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		rsp := make([]invoiceResponse, 0, len(invs))
+		for _, inv := range invs {
+			if filter != nil && accounts.EffectiveInvoiceStatus(inv, now) != *filter {
+				continue
+			}
+			rsp = append(rsp, newInvoiceResponse(inv, now))
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func Invoice(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		invId, err := strconv.ParseInt(chi.URLParam(r, "invoice_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		inv, err := db.Q.GetInvoiceById(r.Context(), invId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Don't allow reading other's invoice(s)
+		if inv.AccountID != accData.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeInvoiceJSON(w, db, r, inv.ID, http.StatusOK)
+	}
+}
+
+func CancelInvoice(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		invId, err := strconv.ParseInt(chi.URLParam(r, "invoice_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = accounts.CancelInvoice(r.Context(), db.Q, accData.Id, invId)
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrInvoiceNotFound):
+				w.WriteHeader(http.StatusNotFound)
+			case errors.Is(err, accounts.ErrInvoiceNotOpen):
+				w.WriteHeader(http.StatusConflict)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeInvoiceJSON(w, db, r, invId, http.StatusOK)
+	}
+}
+
+func writeInvoiceJSON(w http.ResponseWriter, db *database.Database, r *http.Request, invID int64, status int) {
+	inv, err := db.Q.GetInvoiceById(r.Context(), invID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(newInvoiceResponse(inv, time.Now()))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func RotateCheckoutSecret(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		secret, err := accounts.RotateCheckoutSecret(r.Context(), db.Q, accData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		err = db.Q.UpdateAccountWebhookById(r.Context(), gensql.UpdateAccountWebhookByIdParams{
-			Webhook: &body.Webhook,
-			ID:      accData.Id,
+		type Response struct {
+			Secret                  string    `json:"secret"`
+			PreviousSecretExpiresAt time.Time `json:"previousSecretExpiresAt"`
+		}
+		data, err := json.Marshal(Response{
+			Secret:                  secret,
+			PreviousSecretExpiresAt: time.Now().Add(accounts.CheckoutSecretOverlap),
 		})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
 	}
 }
 
-func DeleteWebhook(db *database.Database) http.HandlerFunc {
+type allowanceResponse struct {
+	ID           int64                   `json:"id"`
+	OwnerAccId   int64                   `json:"ownerAccId"`
+	SpenderAccId int64                   `json:"spenderAccId"`
+	Amount       int64                   `json:"amount"`
+	PeriodDays   *int64                  `json:"periodDays"`
+	ExpiresAt    *time.Time              `json:"expiresAt"`
+	Active       bool                    `json:"active"`
+	Remaining    int64                   `json:"remaining"`
+	PeriodStart  time.Time               `json:"periodStart"`
+	RevokedAt    *time.Time              `json:"revokedAt,omitempty"`
+	CreatedAt    time.Time               `json:"createdAt"`
+	Pulls        []allowancePullResponse `json:"pulls,omitempty"`
+}
+
+type allowancePullResponse struct {
+	TransferID int64     `json:"transferId"`
+	Amount     int64     `json:"amount"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func newAllowanceResponse(a gensql.Allowance, now time.Time) allowanceResponse {
+	periodStart, _ := accounts.AllowancePeriod(a, now)
+	return allowanceResponse{
+		ID:           a.ID,
+		OwnerAccId:   a.OwnerAccountID,
+		SpenderAccId: a.SpenderAccountID,
+		Amount:       a.Amount,
+		PeriodDays:   a.PeriodDays,
+		ExpiresAt:    a.ExpiresAt,
+		Active:       accounts.IsAllowanceActive(a, now),
+		Remaining:    accounts.AllowanceRemaining(a, now),
+		PeriodStart:  periodStart,
+		RevokedAt:    a.RevokedAt,
+		CreatedAt:    a.CreatedAt,
+	}
+}
+
+func CreateAllowance(db *database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		accData := sessions.GetAccount(r.Context())
 
-		err := db.Q.UpdateAccountWebhookById(r.Context(), gensql.UpdateAccountWebhookByIdParams{
-			Webhook: nil,
-			ID:      accData.Id,
+		type Input struct {
+			SpenderId  int64      `json:"spenderId" validate:"required"`
+			Amount     int64      `json:"amount" validate:"min=1"`
+			PeriodDays *int64     `json:"periodDays"`
+			ExpiresAt  *time.Time `json:"expiresAt"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if validate.Struct(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		allowanceId, err := accounts.CreateAllowance(r.Context(), db.Q, accounts.CreateAllowanceInput{
+			OwnerId:    accData.Id,
+			SpenderId:  body.SpenderId,
+			Amount:     body.Amount,
+			PeriodDays: body.PeriodDays,
+			ExpiresAt:  body.ExpiresAt,
 		})
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				w.WriteHeader(http.StatusNotFound)
+			case errors.Is(err, accounts.ErrInvalidQuantity),
+				errors.Is(err, accounts.ErrMatchingSenderReceiver),
+				errors.Is(err, accounts.ErrIncompatibleLedgers),
+				errors.Is(err, accounts.ErrAllowanceInvalid):
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		writeAllowanceJSON(w, db, r, allowanceId, http.StatusCreated)
+	}
+}
+
+func Allowances(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		var allowances []gensql.Allowance
+		var err error
+		switch r.URL.Query().Get("role") {
+		case "", "owner":
+			allowances, err = db.Q.GetAllowancesByOwnerAccountId(r.Context(), accData.Id)
+		case "spender":
+			allowances, err = db.Q.GetAllowancesBySpenderAccountId(r.Context(), accData.Id)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		now := time.Now()
+		rsp := make([]allowanceResponse, 0, len(allowances))
+		for _, a := range allowances {
+			rsp = append(rsp, newAllowanceResponse(a, now))
+		}
+
+		data, err := json.Marshal(rsp)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func Allowance(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		allowanceId, err := strconv.ParseInt(chi.URLParam(r, "allowance_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		allowance, err := db.Q.GetAllowanceById(r.Context(), allowanceId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Both sides of the allowance can read it
+		if allowance.OwnerAccountID != accData.Id && allowance.SpenderAccountID != accData.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeAllowanceJSON(w, db, r, allowance.ID, http.StatusOK)
+	}
+}
+
+func RevokeAllowance(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		allowanceId, err := strconv.ParseInt(chi.URLParam(r, "allowance_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = accounts.RevokeAllowance(r.Context(), db.Q, accData.Id, allowanceId)
+		if err != nil {
+			if errors.Is(err, accounts.ErrAllowanceNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeAllowanceJSON(w, db, r, allowanceId, http.StatusOK)
+	}
+}
+
+func PullAllowance(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accData := sessions.GetAccount(r.Context())
+
+		allowanceId, err := strconv.ParseInt(chi.URLParam(r, "allowance_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		idemKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		if idemKey == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type Input struct {
+			Amount   int64             `json:"amount" validate:"min=1"`
+			Memo     *string           `json:"memo"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		var body Input
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if validate.Struct(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		input := accounts.PullTransferInput{
+			AllowanceId:    allowanceId,
+			SpenderId:      accData.Id,
+			Amount:         body.Amount,
+			Memo:           body.Memo,
+			Metadata:       body.Metadata,
+			IdempotencyKey: idemKey,
+			Initiator:      transferInitiator(r, accData.Id),
+		}
+
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		trResult, err := accounts.PullTransfer(r.Context(), db.Q.WithTx(tx), input)
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrAllowanceNotFound):
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case errors.Is(err, accounts.ErrIdempotencyConflict),
+				errors.Is(err, accounts.ErrAllowanceInactive),
+				errors.Is(err, accounts.ErrInvoiceNotOpen):
+				w.WriteHeader(http.StatusConflict)
+				return
+			case errors.Is(err, accounts.ErrIdempotencyRace):
+				// Roll back our partial write, then resolve against the winning claim.
+				_ = tx.Rollback()
+				trId, err := accounts.ResolvePullRace(r.Context(), db.Q, input)
+				if err != nil {
+					if errors.Is(err, accounts.ErrIdempotencyConflict) {
+						w.WriteHeader(http.StatusConflict)
+						return
+					}
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				writeTransferJSON(w, db, r, trId, http.StatusOK)
+				return
+			case errors.Is(err, accounts.ErrAllowanceExceeded),
+				errors.Is(err, accounts.ErrInvalidBalance),
+				errors.Is(err, accounts.ErrInvalidQuantity),
+				errors.Is(err, accounts.ErrIncompatibleAccCodes),
+				errors.Is(err, accounts.ErrIncompatibleLedgers),
+				errors.Is(err, accounts.ErrMemoExceedsLimit),
+				errors.Is(err, accounts.ErrMetadataInvalid),
+				errors.Is(err, accounts.ErrInvoiceNotFound),
+				errors.Is(err, accounts.ErrInvoiceMismatch),
+				errors.Is(err, accounts.ErrIdempotencyKeyRequired),
+				errors.Is(err, accounts.ErrIdempotencyKeyInvalid):
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if trResult.Created && outbox != nil {
+			outbox.Notify()
+		}
+
+		status := http.StatusOK
+		if trResult.Created {
+			status = http.StatusCreated
+		}
+		writeTransferJSON(w, db, r, trResult.TransferID, status)
+	}
+}
+
+func writeAllowanceJSON(w http.ResponseWriter, db *database.Database, r *http.Request, allowanceID int64, status int) {
+	allowance, err := db.Q.GetAllowanceById(r.Context(), allowanceID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pulls, err := db.Q.GetAllowancePulls(r.Context(), allowanceID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rsp := newAllowanceResponse(allowance, time.Now())
+	rsp.Pulls = make([]allowancePullResponse, 0, len(pulls))
+	for _, p := range pulls {
+		rsp.Pulls = append(rsp.Pulls, allowancePullResponse{
+			TransferID: p.TransferID,
+			Amount:     p.Amount,
+			CreatedAt:  p.CreatedAt,
+		})
+	}
+
+	data, err := json.Marshal(rsp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/stelofinance/stelofinance/database/gensql"
 	"github.com/stelofinance/stelofinance/internal/accounts"
 	"github.com/stelofinance/stelofinance/internal/sessions"
+	"github.com/stelofinance/stelofinance/internal/webhooks"
 	"github.com/stelofinance/stelofinance/web/templates"
 	"github.com/tylermmorton/tmpl"
 )
@@ -132,38 +133,51 @@ func AppAccountsUpdates(env string, db *database.Database, nc *nats.Conn) http.H
 
 		trChan := make(chan *nats.Msg)
 
-		subs := make([]*nats.Subscription, 0, len(accsResult)*2)
-		for _, acc := range accsResult {
-			senderSub, err := nc.ChanSubscribe(fmt.Sprintf("accounts.transfers.%v.*", acc.ID), trChan)
+		accSubs := make(map[int64][]*nats.Subscription, len(accsResult))
+		subscribe := func(accId int64) {
+			senderSub, err := nc.ChanSubscribe(fmt.Sprintf("accounts.transfers.%v.*", accId), trChan)
 			if err != nil {
 				// TODO?
-				continue
+				return
 			}
-			subs = append(subs, senderSub)
-
-			receiverSub, err := nc.ChanSubscribe(fmt.Sprintf("accounts.transfers.*.%v", acc.ID), trChan)
+			receiverSub, err := nc.ChanSubscribe(fmt.Sprintf("accounts.transfers.*.%v", accId), trChan)
 			if err != nil {
 				// TODO?
-				continue
+				senderSub.Unsubscribe()
+				return
 			}
-			subs = append(subs, receiverSub)
+			accSubs[accId] = []*nats.Subscription{senderSub, receiverSub}
+		}
+		for _, acc := range accsResult {
+			subscribe(acc.ID)
 		}
 
-		// TODO: Add new accounts when user gets added, and remove when they're removed
+		// Permission changes on every account, to add accounts when the user
+		// gets added, and remove them when they're removed
+		permChan := make(chan *nats.Msg, 16)
+		permSub, err := nc.ChanSubscribe("accounts.permissions.*", permChan)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
 		sse := datastar.NewSSE(w, r)
-		if r.Header.Get("Last-Event-Id") != "" {
+		render := func() {
 			tmplData, err := loadAppAccountsPageData(r.Context(), db, uData, env)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				// TODO: uhhh
 				return
 			}
+
 			buff := new(bytes.Buffer)
 			err = templates.AppAccounts.Render(buff, tmplData, tmpl.WithTarget("page-content"))
 			if err != nil {
 				panic(err)
 			}
 			sse.PatchElements(buff.String(), datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+		}
+		if r.Header.Get("Last-Event-Id") != "" {
+			render()
 		} else {
 			sse.PatchElements("", datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
 		}
@@ -172,21 +186,32 @@ func AppAccountsUpdates(env string, db *database.Database, nc *nats.Conn) http.H
 		for {
 			select {
 			case <-trChan:
-				tmplData, err := loadAppAccountsPageData(r.Context(), db, uData, env)
-				if err != nil {
-					// TODO: uhhh
+				render()
+			case msg := <-permChan:
+				var evt accounts.EventAccountPermission
+				if err := json.Unmarshal(msg.Data, &evt); err != nil {
 					continue
 				}
-
-				buff := new(bytes.Buffer)
-				err = templates.AppAccounts.Render(buff, tmplData, tmpl.WithTarget("page-content"))
-				if err != nil {
-					panic(err)
+				subs, onAcc := accSubs[evt.AccountId]
+				forUser := evt.UserId != nil && *evt.UserId == uData.Id
+				switch {
+				case forUser && evt.Type == accounts.PermissionCreated && !onAcc:
+					subscribe(evt.AccountId)
+				case forUser && evt.Type == accounts.PermissionDeleted && onAcc:
+					for _, s := range subs {
+						s.Unsubscribe()
+					}
+					delete(accSubs, evt.AccountId)
+				case !onAcc:
+					continue
 				}
-				sse.PatchElements(buff.String(), datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+				render()
 			case <-r.Context().Done():
-				for _, s := range subs {
-					s.Unsubscribe()
+				permSub.Unsubscribe()
+				for _, subs := range accSubs {
+					for _, s := range subs {
+						s.Unsubscribe()
+					}
 				}
 				close(trChan)
 				break loop
@@ -281,6 +306,65 @@ func loadAppAccountPageData(ctx context.Context, db *database.Database, sessions
 		tknQty++
 	}
 
+	endpoints, err := db.Q.GetWebhookEndpointsByAccountId(ctx, accId)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]templates.PageAppAccountWebhook, 0, len(endpoints))
+	for _, e := range endpoints {
+		webhooks = append(webhooks, templates.PageAppAccountWebhook{
+			Id:             e.ID,
+			Url:            e.Url,
+			Events:         strings.Join(accounts.WebhookEvent(e.Events).Names(), ", "),
+			Enabled:        e.Enabled != 0,
+			Ordered:        e.Ordered != 0,
+			PayloadVersion: e.PayloadVersion,
+			CloudEvents:    e.Cloudevents != 0,
+			Health:         string(accounts.WebhookEndpointHealth(e)),
+		})
+	}
+
+	recent, err := db.Q.GetAccountWebhookDeliveries(ctx, gensql.GetAccountWebhookDeliveriesParams{
+		AccountID: accId,
+		Limit:     10,
+	})
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]templates.PageAppAccountDelivery, 0, len(recent))
+	for _, d := range recent {
+		delivery := templates.PageAppAccountDelivery{
+			Id:        d.ID,
+			WebhookId: d.EndpointID,
+			Url:       d.Url,
+			Latency:   fmt.Sprintf("%dms", d.LatencyMs),
+			Time:      d.CreatedAt.UTC().Format("2006-01-02 15:04:05"),
+		}
+		switch {
+		case d.StatusCode != nil:
+			delivery.Status = strconv.FormatInt(*d.StatusCode, 10)
+			delivery.Ok = *d.StatusCode >= 200 && *d.StatusCode < 300
+		case d.Error != nil:
+			delivery.Status = *d.Error
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	stmts, err := db.Q.GetAccountStatements(ctx, accId)
+	if err != nil {
+		return nil, err
+	}
+	pageStmts := make([]templates.PageAppAccountStatement, 0, len(stmts))
+	for _, s := range stmts {
+		pageStmts = append(pageStmts, templates.PageAppAccountStatement{
+			Id:       s.ID,
+			Period:   s.PeriodStart.UTC().Format("2006-01"),
+			Opening:  accounts.FormatAmount(s.OpeningBalance, acc.AssetScale),
+			Closing:  accounts.FormatAmount(s.ClosingBalance, acc.AssetScale),
+			Adjusted: s.PreviousClosingBalance != nil && *s.PreviousClosingBalance != s.OpeningBalance,
+		})
+	}
+
 	return templates.AppLayout(
 		fmt.Sprintf("#%s / %s", acc.Address, acc.LedgerName),
 		"Account configuration",
@@ -293,9 +377,13 @@ func loadAppAccountPageData(ctx context.Context, db *database.Database, sessions
 			LedgerName:  acc.LedgerName,
 			IsAdmin:     userPerms.HasPerms(accounts.PermAdmin),
 			IsPrimary:   isPrimary,
+			IsPrivate:   accounts.AccountFlag(acc.Flags).Has(accounts.AccFlagPrivate),
 			UserId:      uData.Id,
 			Users:       users,
 			TotalTokens: tknQty,
+			Webhooks:    webhooks,
+			Deliveries:  deliveries,
+			Statements:  pageStmts,
 		},
 	), nil
 }
@@ -328,29 +416,71 @@ func AppPaymentRequest(env string, db *database.Database, sessionsKV jetstream.K
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 
-		ledgerIdStr := r.URL.Query().Get("ledgerid")
-		amountStr := r.URL.Query().Get("amount")
-		recipientIdStr := r.URL.Query().Get("recipientid")
-		memo := r.URL.Query().Get("memo")
-
-		if ledgerIdStr == "" || amountStr == "" || recipientIdStr == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		ledgerId, err := strconv.ParseInt(ledgerIdStr, 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		amount, err := strconv.ParseInt(amountStr, 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		pageData := templates.PageAppRequest{
+			IdempotencyKey: uuid.NewString(),
 		}
-		recipientId, err := strconv.ParseInt(recipientIdStr, 10, 64)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+
+		var ledgerId, amount, recipientId int64
+		var memo string
+		if r.URL.Query().Has("invoice") {
+			// Invoices are looked up by their token, so nothing in the link
+			// can be edited
+			inv, err := db.Q.GetInvoiceByToken(r.Context(), r.URL.Query().Get("invoice"))
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			invAcc, err := db.Q.GetAccountById(r.Context(), inv.AccountID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			ledgerId = invAcc.LedgerID
+			amount = inv.Amount
+			recipientId = inv.AccountID
+			memo = derefOrFallback(inv.Memo, "")
+			pageData.InvoiceToken = inv.Token
+			status := accounts.EffectiveInvoiceStatus(inv, time.Now())
+			pageData.InvoiceStatus = status.String()
+
+			// Checkout session links back to the merchant
+			if status == accounts.InvOpen && inv.CancelUrl != nil {
+				pageData.CancelUrl, _ = accounts.CheckoutCancelUrl(inv)
+			}
+			if status == accounts.InvPaid && inv.ReturnUrl != nil && inv.TransferID != nil {
+				pageData.ReturnUrl, _ = accounts.CheckoutReturnUrl(r.Context(), db.Q, inv, *inv.TransferID)
+			}
+		} else {
+			ledgerIdStr := r.URL.Query().Get("ledgerid")
+			amountStr := r.URL.Query().Get("amount")
+			recipientIdStr := r.URL.Query().Get("recipientid")
+			memo = r.URL.Query().Get("memo")
+
+			if ledgerIdStr == "" || amountStr == "" || recipientIdStr == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var err error
+			ledgerId, err = strconv.ParseInt(ledgerIdStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			amount, err = strconv.ParseInt(amountStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			recipientId, err = strconv.ParseInt(recipientIdStr, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 		}
 
 		// Get ledger info
@@ -384,9 +514,6 @@ func AppPaymentRequest(env string, db *database.Database, sessionsKV jetstream.K
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		pageData := templates.PageAppRequest{
-			IdempotencyKey: uuid.NewString(),
-		}
 		var accs []templates.PageAppRequestAccount
 		for _, acc := range accsResult {
 			// Don't let requests happen to credit accounts
@@ -434,7 +561,7 @@ func AppPaymentRequest(env string, db *database.Database, sessionsKV jetstream.K
 	}
 }
 
-func PostRequest(db *database.Database, nc *nats.Conn, webhooks accounts.WebhookEnqueuer) http.HandlerFunc {
+func PostRequest(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
@@ -466,6 +593,26 @@ func PostRequest(db *database.Database, nc *nats.Conn, webhooks accounts.Webhook
 			memo = &str
 		}
 
+		// Paying an invoice, the invoice is the source of truth rather than
+		// the form
+		var invoiceId *int64
+		var inv gensql.Invoice
+		if token := r.FormValue("invoice"); token != "" {
+			inv, err = db.Q.GetInvoiceByToken(r.Context(), token)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			recipientId = inv.AccountID
+			amount = inv.Amount
+			memo = inv.Memo
+			invoiceId = &inv.ID
+		}
+
 		acc, err := db.Q.GetAccountAndLedgerById(r.Context(), accId)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -489,17 +636,20 @@ func PostRequest(db *database.Database, nc *nats.Conn, webhooks accounts.Webhook
 		}
 		defer tx.Rollback()
 
-		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), nc, webhooks, accounts.CreateTransferInput{
+		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), accounts.CreateTransferInput{
 			SendingId:      accId,
 			ReceivingId:    recipientId,
 			Memo:           memo,
 			LedgerId:       acc.LedgerID,
 			Amount:         amount,
+			InvoiceId:      invoiceId,
 			IdempotencyKey: idemKey,
+			Initiator:      transferInitiator(r, accId),
 		})
 		if err != nil {
 			switch {
-			case errors.Is(err, accounts.ErrIdempotencyConflict):
+			case errors.Is(err, accounts.ErrIdempotencyConflict),
+				errors.Is(err, accounts.ErrInvoiceNotOpen):
 				w.WriteHeader(http.StatusConflict)
 				return
 			case errors.Is(err, accounts.ErrIdempotencyRace):
@@ -512,16 +662,18 @@ func PostRequest(db *database.Database, nc *nats.Conn, webhooks accounts.Webhook
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				if existing.RequestHash != accounts.TransferRequestHash(recipientId, amount, acc.LedgerID, memo) {
+				if existing.RequestHash != accounts.TransferRequestHash(recipientId, amount, acc.LedgerID, memo, nil, invoiceId) {
 					w.WriteHeader(http.StatusConflict)
 					return
 				}
+				trResult.TransferID = existing.TransferID
 			case errors.Is(err, accounts.ErrInvalidQuantity),
 				errors.Is(err, accounts.ErrMatchingSenderReceiver),
 				errors.Is(err, accounts.ErrInvalidBalance),
 				errors.Is(err, accounts.ErrIncompatibleAccCodes),
 				errors.Is(err, accounts.ErrIncompatibleLedgers),
 				errors.Is(err, accounts.ErrMemoExceedsLimit),
+				errors.Is(err, accounts.ErrInvoiceMismatch),
 				errors.Is(err, accounts.ErrIdempotencyKeyRequired),
 				errors.Is(err, accounts.ErrIdempotencyKeyInvalid):
 				w.WriteHeader(http.StatusBadRequest)
@@ -535,19 +687,29 @@ func PostRequest(db *database.Database, nc *nats.Conn, webhooks accounts.Webhook
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			if trResult.Created {
-				go trResult.Publish()
+			if trResult.Created && outbox != nil {
+				outbox.Notify()
 			}
 		}
 
 		sse := datastar.NewSSE(w, r)
+
+		// Checkout sessions send the user back to the merchant with proof
+		if inv.ReturnUrl != nil {
+			returnUrl, err := accounts.CheckoutReturnUrl(r.Context(), db.Q, inv, trResult.TransferID)
+			if err == nil {
+				sse.Redirect(returnUrl)
+				return
+			}
+		}
+
 		sse.MarshalAndPatchSignals(map[string]any{
 			"sentMessage": true,
 		})
 	}
 }
 
-func PutAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+func PutAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 		accIdStr := chi.URLParam(r, "account_id")
@@ -582,20 +744,80 @@ func PutAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyV
 			userId = &uData.Id
 		}
 
-		rows, err := db.Q.WithTx(tx).UpdateAccountUserId(r.Context(), gensql.UpdateAccountUserIdParams{
-			UserID: userId,
-			ID:     int64(accId),
-		})
-		if rows == 0 {
-			w.WriteHeader(http.StatusNotFound)
+		err = accounts.SetPrimaryUser(r.Context(), db.Q.WithTx(tx), int64(accId), userId, uData.Id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
+		// Update page
+		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		sse := datastar.NewSSE(w, r)
 
-		tx.Commit()
+		buff := new(bytes.Buffer)
+		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+		if err != nil {
+			panic(err)
+		}
+		sse.PatchElements(buff.String())
+	}
+}
+
+func PutAccountPrivacy(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type Body struct {
+			Private bool `json:"private"`
+		}
+		var body Body
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = accounts.SetAccountFlag(r.Context(), db.Q.WithTx(tx), int64(accId), accounts.AccFlagPrivate, body.Private)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
 		// Update page
 		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
@@ -614,7 +836,7 @@ func PutAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyV
 	}
 }
 
-func PostAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+func PostAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
@@ -652,17 +874,19 @@ func PostAccountUser(env string, db *database.Database, sessionsKV jetstream.Key
 			return
 		}
 
-		now := time.Now()
-
-		db.Q.WithTx(tx).InsertAccountPerm(r.Context(), gensql.InsertAccountPermParams{
-			AccountID:   int64(accId),
-			UserID:      usr.ID,
-			Permissions: int64(accounts.PermAdmin),
-			UpdatedAt:   now,
-			CreatedAt:   now,
-		})
+		err = accounts.SetAccountUserPerms(r.Context(), db.Q.WithTx(tx), int64(accId), usr.ID, accounts.PermAdmin, uData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-		tx.Commit()
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
 
 		// Update page
 		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
@@ -681,7 +905,7 @@ func PostAccountUser(env string, db *database.Database, sessionsKV jetstream.Key
 	}
 }
 
-func DeleteAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+func DeleteAccountUser(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
@@ -704,20 +928,23 @@ func DeleteAccountUser(env string, db *database.Database, sessionsKV jetstream.K
 		defer tx.Rollback()
 
 		// Remove user's perms from account
-		rows, err := db.Q.WithTx(tx).DeleteAccountPerm(r.Context(), gensql.DeleteAccountPermParams{
-			AccountID: int64(accId),
-			UserID:    int64(userId),
-		})
-		if rows == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+		err = accounts.RemoveAccountUser(r.Context(), db.Q.WithTx(tx), int64(accId), int64(userId), uData.Id)
 		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		tx.Commit()
+		if err := tx.Commit(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
 
 		// Update page
 		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
@@ -736,7 +963,7 @@ func DeleteAccountUser(env string, db *database.Database, sessionsKV jetstream.K
 	}
 }
 
-func PostAccountToken(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+func PostAccountToken(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
@@ -761,6 +988,15 @@ func PostAccountToken(env string, db *database.Database, sessionsKV jetstream.Ke
 			return
 		}
 
+		err = accounts.RecordTokenChange(r.Context(), db.Q, int64(accId), accounts.TokenCreated, 1, uData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
 		// Update page
 		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
 		if err != nil {
@@ -771,6 +1007,182 @@ func PostAccountToken(env string, db *database.Database, sessionsKV jetstream.Ke
 
 		// Add token data
 		tmplData.Content.Token = "stla_" + sid
+		tmplData.Content.TokenId = sessions.TokenID(sid)
+
+		buff := new(bytes.Buffer)
+		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+		if err != nil {
+			panic(err)
+		}
+		sse.PatchElements(buff.String())
+	}
+}
+
+func PostAccountWebhookSecret(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		webhookId, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		secret, err := accounts.RotateWebhookSecret(r.Context(), db.Q, int64(accId), webhookId)
+		if err != nil {
+			if errors.Is(err, accounts.ErrWebhookNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Update page
+		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sse := datastar.NewSSE(w, r)
+
+		// Add secret data
+		for i := range tmplData.Content.Webhooks {
+			if tmplData.Content.Webhooks[i].Id == webhookId {
+				tmplData.Content.Webhooks[i].Secret = secret
+			}
+		}
+
+		buff := new(bytes.Buffer)
+		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+		if err != nil {
+			panic(err)
+		}
+		sse.PatchElements(buff.String())
+	}
+}
+
+func PostAccountWebhookEnable(env string, db *database.Database, sessionsKV jetstream.KeyValue, webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		webhookId, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		e, err := db.Q.GetAccountWebhookEndpoint(r.Context(), gensql.GetAccountWebhookEndpointParams{
+			ID:        webhookId,
+			AccountID: int64(accId),
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Only enable it once it responds to a ping
+		res, pingErr := webhookSvc.Ping(r.Context(), e)
+		if testOk(res, pingErr) {
+			enabled := true
+			_, err = accounts.UpdateWebhook(r.Context(), db.Q, accounts.UpdateWebhookInput{
+				AccountId: int64(accId),
+				Id:        webhookId,
+				Enabled:   &enabled,
+				Pinged:    true,
+			})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Update page
+		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sse := datastar.NewSSE(w, r)
+
+		// Add test result
+		for i := range tmplData.Content.Webhooks {
+			if tmplData.Content.Webhooks[i].Id == webhookId {
+				tmplData.Content.Webhooks[i].TestResult = testResultText(res, pingErr)
+			}
+		}
+
+		buff := new(bytes.Buffer)
+		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+		if err != nil {
+			panic(err)
+		}
+		sse.PatchElements(buff.String())
+	}
+}
+
+func testResultText(res webhooks.TestResult, err error) string {
+	if err != nil {
+		return fmt.Sprintf("Test failed after %dms: %s", res.Latency.Milliseconds(), err)
+	}
+	return fmt.Sprintf("Test got %d in %dms", res.StatusCode, res.Latency.Milliseconds())
+}
+
+func PostAccountWebhookTest(env string, db *database.Database, sessionsKV jetstream.KeyValue, webhookSvc *webhooks.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		webhookId, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		e, err := db.Q.GetAccountWebhookEndpoint(r.Context(), gensql.GetAccountWebhookEndpointParams{
+			ID:        webhookId,
+			AccountID: int64(accId),
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res, testErr := webhookSvc.Ping(r.Context(), e)
+
+		// Update page
+		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sse := datastar.NewSSE(w, r)
+
+		// Add test result
+		for i := range tmplData.Content.Webhooks {
+			if tmplData.Content.Webhooks[i].Id == webhookId {
+				tmplData.Content.Webhooks[i].TestResult = testResultText(res, testErr)
+			}
+		}
 
 		buff := new(bytes.Buffer)
 		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
@@ -781,7 +1193,58 @@ func PostAccountToken(env string, db *database.Database, sessionsKV jetstream.Ke
 	}
 }
 
-func DeleteAccountTokens(env string, db *database.Database, sessionsKV jetstream.KeyValue) http.HandlerFunc {
+func PostAccountWebhookRedeliver(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		webhookId, err := strconv.ParseInt(chi.URLParam(r, "webhook_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deliveryId, err := strconv.ParseInt(chi.URLParam(r, "delivery_id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = accounts.RedeliverWebhook(r.Context(), db.Q, int64(accId), webhookId, deliveryId)
+		if err != nil {
+			switch {
+			case errors.Is(err, accounts.ErrWebhookNotFound),
+				errors.Is(err, accounts.ErrWebhookDeliveryNotFound):
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+		if outbox != nil {
+			outbox.Notify()
+		}
+
+		// Update page
+		tmplData, err := loadAppAccountPageData(r.Context(), db, sessionsKV, uData, int64(accId), env)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sse := datastar.NewSSE(w, r)
+
+		buff := new(bytes.Buffer)
+		err = templates.AppAccount.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+		if err != nil {
+			panic(err)
+		}
+		sse.PatchElements(buff.String())
+	}
+}
+
+func DeleteAccountTokens(env string, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
 		accId, err := strconv.Atoi(chi.URLParam(r, "account_id"))
@@ -797,8 +1260,22 @@ func DeleteAccountTokens(env string, db *database.Database, sessionsKV jetstream
 			return
 		}
 		defer keyLstnr.Stop()
+		revoked := 0
 		for key := range keyLstnr.Keys() {
-			sessionsKV.Delete(r.Context(), key)
+			if sessionsKV.Delete(r.Context(), key) == nil {
+				revoked++
+			}
+		}
+
+		if revoked > 0 {
+			err = accounts.RecordTokenChange(r.Context(), db.Q, int64(accId), accounts.TokensRevoked, revoked, uData.Id)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if outbox != nil {
+				outbox.Notify()
+			}
 		}
 
 		// Update page
@@ -826,49 +1303,34 @@ func derefOrFallback[T any](ref *T, fallback T) T {
 
 }
 
+const appTransfersPageSize = 25
+
 func loadAppTransfersPageData(ctx context.Context, db *database.Database, uData *sessions.UserData, accId *int64, env string) (*templates.LayoutPrimary[templates.PageAppTransfers], error) {
 	accsResult, err := db.Q.GetAccountsUserHasPerms(ctx, uData.Id)
 	if err != nil {
 		// TODO: do something here?
 		return nil, err
 	}
-	// If there is an account input, filter by that
-	var filterId *int64
-	if accId != nil && *accId != -1 {
-		filterId = accId
-	}
-	transferResult, err := db.Q.GetTransfersUserHasPermsOn(ctx, gensql.GetTransfersUserHasPermsOnParams{
-		UserID:    uData.Id,
-		AccountID: filterId,
-	})
+	list, _, err := loadAppTransfersList(ctx, db, uData, accsResult, accId, nil, nil)
 	if err != nil {
-		// TODO: do something here?
 		return nil, err
 	}
 
 	pageData := templates.PageAppTransfers{
 		IdempotencyKey: uuid.NewString(),
+		List:           list,
+	}
+	if len(list.Transfers) > 0 {
+		pageData.NewestId = list.Transfers[0].Id
 	}
 	if accId == nil || *accId == -1 {
 		pageData.SelectedAccount.Id = -1
 	} else {
-		// Get all the account info
-		pageData.SelectedAccount.Id = *accId
-		accResult, err := db.Q.GetAccountAndLedgerById(ctx, *accId)
+		pageData.SelectedAccount, err = loadAppTransfersSelectedAccount(ctx, db, *accId)
 		if err != nil {
 			// TODO: do something here?
 			return nil, err
 		}
-		pageData.SelectedAccount.LedgerName = accResult.LedgerName
-		var bal int64 = 0
-		if accounts.AccountCode(accResult.Code).IsDebit() {
-			bal = accResult.DebitsPosted - accResult.CreditsPosted - accResult.CreditsPending
-		} else {
-			bal = accResult.CreditsPosted - accResult.DebitsPosted - accResult.DebitsPending
-
-		}
-		pageData.SelectedAccount.Balance = float64(bal) / math.Pow(10, float64(accResult.AssetScale))
-		pageData.SelectedAccount.Step = 1.0 / math.Pow(10, float64(accResult.AssetScale))
 	}
 
 	// Transform data
@@ -879,8 +1341,76 @@ func loadAppTransfersPageData(ctx context.Context, db *database.Database, uData
 			Label: "#" + acc.Address + "/" + acc.LedgerName,
 		})
 	}
+
+	return templates.AppLayout(
+		"Transfers",
+		"All transfers on your accounts or selected account",
+		uData.BitCraftUsername,
+		"transfers",
+		env,
+		pageData,
+	), nil
+}
+
+func loadAppTransfersSelectedAccount(ctx context.Context, db *database.Database, accId int64) (templates.PageAppTransfersSelectedAccount, error) {
+	accResult, err := db.Q.GetAccountAndLedgerById(ctx, accId)
+	if err != nil {
+		return templates.PageAppTransfersSelectedAccount{}, err
+	}
+	var bal int64 = 0
+	if accounts.AccountCode(accResult.Code).IsDebit() {
+		bal = accResult.DebitsPosted - accResult.CreditsPosted - accResult.CreditsPending
+	} else {
+		bal = accResult.CreditsPosted - accResult.DebitsPosted - accResult.DebitsPending
+
+	}
+	return templates.PageAppTransfersSelectedAccount{
+		Id:         accId,
+		LedgerName: accResult.LedgerName,
+		Balance:    float64(bal) / math.Pow(10, float64(accResult.AssetScale)),
+		Step:       1.0 / math.Pow(10, float64(accResult.AssetScale)),
+	}, nil
+}
+
+// loadAppTransfersList loads a page of the transfers on the user's accounts,
+// newest first, older than beforeId or newer than afterId if set. The bool
+// is whether there were more than a page of them.
+func loadAppTransfersList(ctx context.Context, db *database.Database, uData *sessions.UserData, accsResult []gensql.GetAccountsUserHasPermsRow, accId *int64, beforeId *int64, afterId *int64) (templates.ComponentAppTransfersList, bool, error) {
+	var list templates.ComponentAppTransfersList
+
+	// If there is an account input, filter by that
+	var filterId *int64
+	if accId != nil && *accId != -1 {
+		filterId = accId
+	}
+	// Fetch one extra to know if there's more to load
+	transferResult, err := db.Q.GetTransfersUserHasPermsOn(ctx, gensql.GetTransfersUserHasPermsOnParams{
+		UserID:    uData.Id,
+		AccountID: filterId,
+		BeforeID:  beforeId,
+		AfterID:   afterId,
+		Limit:     appTransfersPageSize + 1,
+	})
+	if err != nil {
+		return list, false, err
+	}
+	more := len(transferResult) > appTransfersPageSize
+	if more {
+		// Transfers between two of the user's accounts come back as two rows,
+		// don't split them across pages
+		cutId := transferResult[appTransfersPageSize].ID
+		transferResult = transferResult[:appTransfersPageSize]
+		for len(transferResult) > 1 && transferResult[len(transferResult)-1].ID == cutId {
+			transferResult = transferResult[:len(transferResult)-1]
+		}
+		// Newer transfers are prepended, so only older ones get a cursor
+		if afterId == nil {
+			list.BeforeId = transferResult[len(transferResult)-1].ID
+		}
+	}
+
 	existingTransfers := make(map[int64]struct{})
-	pageData.Transfers = make([]templates.PageAppTransfersTransfer, 0, len(transferResult))
+	list.Transfers = make([]templates.PageAppTransfersTransfer, 0, len(transferResult))
 	for _, trn := range transferResult {
 		data := templates.PageAppTransfersTransfer{
 			Id:          trn.ID,
@@ -898,14 +1428,14 @@ func loadAppTransfersPageData(ctx context.Context, db *database.Database, uData
 		// If we're filtering by account (via DS), then we shouldn't have both ways,
 		// so filter out whichever side this account wasn't on
 		if bothWays && accId != nil && *accId != -1 {
-			oldLen := len(pageData.Transfers)
-			newTransfers := slices.DeleteFunc(pageData.Transfers, func(t templates.PageAppTransfersTransfer) bool {
+			oldLen := len(list.Transfers)
+			newTransfers := slices.DeleteFunc(list.Transfers, func(t templates.PageAppTransfersTransfer) bool {
 				return t.Received == (senderId == *accId) && t.Id == trn.ID
 			})
 			if len(newTransfers) == oldLen {
 				continue
 			}
-			pageData.Transfers = newTransfers
+			list.Transfers = newTransfers
 		}
 
 		if !bothWays {
@@ -933,18 +1463,24 @@ func loadAppTransfersPageData(ctx context.Context, db *database.Database, uData
 		if trn.Memo != nil {
 			data.Memo = *trn.Memo
 		}
-		pageData.Transfers = append(pageData.Transfers, data)
+		// Only show who initiated it to users of the initiating account
+		if trn.InitiatorAccountID != nil && trn.Channel != nil && slices.ContainsFunc(accsResult, func(a gensql.GetAccountsUserHasPermsRow) bool {
+			return a.ID == *trn.InitiatorAccountID
+		}) {
+			switch {
+			case trn.InitiatorTokenID != nil:
+				data.InitiatedBy = "by token " + *trn.InitiatorTokenID + " via " + *trn.Channel
+			case trn.InitiatorUsername != nil:
+				data.InitiatedBy = "by " + *trn.InitiatorUsername + " via " + *trn.Channel
+			default:
+				data.InitiatedBy = "via " + *trn.Channel
+			}
+		}
+		list.Transfers = append(list.Transfers, data)
 		existingTransfers[trn.ID] = struct{}{}
 	}
 
-	return templates.AppLayout(
-		"Transfers",
-		"All transfers on your accounts or selected account",
-		uData.BitCraftUsername,
-		"transfers",
-		env,
-		pageData,
-	), nil
+	return list, more, nil
 }
 
 func AppTransfers(env string, db *database.Database) http.HandlerFunc {
@@ -966,6 +1502,61 @@ func AppTransfers(env string, db *database.Database) http.HandlerFunc {
 	}
 }
 
+// AppTransfersMore appends the page of transfers older than the "before"
+// cursor to the list.
+func AppTransfersMore(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+
+		beforeId, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+		if err != nil || beforeId <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		type input struct {
+			AccountId *int64 `json:"accId"`
+		}
+		var ds input
+		if r.URL.Query().Has("datastar") {
+			err := json.Unmarshal([]byte(r.URL.Query().Get("datastar")), &ds)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		accsResult, err := db.Q.GetAccountsUserHasPerms(r.Context(), uData.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		list, _, err := loadAppTransfersList(r.Context(), db, uData, accsResult, ds.AccountId, &beforeId, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		buff := new(bytes.Buffer)
+		err = templates.AppTransfersListTmpl.Render(buff, &list)
+		if err != nil {
+			panic(err)
+		}
+		// The page brings its own "load more" button if there's more after it
+		sse := datastar.NewSSE(w, r)
+		sse.RemoveElementByID("transfers-more")
+		sse.PatchElements(buff.String(), datastar.WithSelectorID("transfers"), datastar.WithModeAppend())
+	}
+}
+
+// AppJournal exports the transfers on all of the user's accounts as a
+// Beancount or ledger-cli journal.
+func AppJournal(db *database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uData := sessions.GetUser(r.Context())
+		writeJournal(w, r, db, accounts.JournalInput{UserId: &uData.Id}, "journal")
+	}
+}
+
 func AppTransfersUpdates(env string, db *database.Database, nc *nats.Conn) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uData := sessions.GetUser(r.Context())
@@ -973,6 +1564,7 @@ func AppTransfersUpdates(env string, db *database.Database, nc *nats.Conn) http.
 		// If filtering by DS, get transfer updates for that, otherwise get all
 		type input struct {
 			AccountId *int64 `json:"accId"`
+			NewestId  int64  `json:"trNewest"`
 		}
 		var ds input
 		if r.URL.Query().Has("datastar") {
@@ -983,6 +1575,9 @@ func AppTransfersUpdates(env string, db *database.Database, nc *nats.Conn) http.
 			}
 		}
 
+		// Transfers newer than this get prepended to the list as they come in
+		newestId := ds.NewestId
+
 		sse := datastar.NewSSE(w, r)
 		if r.Header.Get("Last-Event-Id") != "" || r.Header.Get("Send-Initial-State") == "true" {
 			tmplData, err := loadAppTransfersPageData(r.Context(), db, uData, ds.AccountId, env)
@@ -996,6 +1591,7 @@ func AppTransfersUpdates(env string, db *database.Database, nc *nats.Conn) http.
 				panic(err)
 			}
 			sse.PatchElements(buff.String(), datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+			newestId = tmplData.Content.NewestId
 		} else {
 			sse.PatchElements("", datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
 		}
@@ -1047,18 +1643,55 @@ func AppTransfersUpdates(env string, db *database.Database, nc *nats.Conn) http.
 		for {
 			select {
 			case <-trChan:
-				tmplData, err := loadAppTransfersPageData(r.Context(), db, uData, ds.AccountId, env)
+				accsResult, err := db.Q.GetAccountsUserHasPerms(r.Context(), uData.Id)
+				if err != nil {
+					// TODO: uhhh
+					continue
+				}
+				list, more, err := loadAppTransfersList(r.Context(), db, uData, accsResult, ds.AccountId, nil, &newestId)
 				if err != nil {
 					// TODO: uhhh
 					continue
 				}
 
+				// Too far behind to prepend, start the list over
+				if more {
+					tmplData, err := loadAppTransfersPageData(r.Context(), db, uData, ds.AccountId, env)
+					if err != nil {
+						continue
+					}
+					buff := new(bytes.Buffer)
+					err = templates.AppTransfers.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+					if err != nil {
+						panic(err)
+					}
+					sse.PatchElements(buff.String(), datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+					newestId = tmplData.Content.NewestId
+					continue
+				}
+				if len(list.Transfers) == 0 {
+					continue
+				}
+
 				buff := new(bytes.Buffer)
-				err = templates.AppTransfers.Render(buff, tmplData, tmpl.WithTarget("page-content"))
+				err = templates.AppTransfersListTmpl.Render(buff, &list)
 				if err != nil {
 					panic(err)
 				}
-				sse.PatchElements(buff.String(), datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+				sse.PatchElements(buff.String(),
+					datastar.WithSelectorID("transfers"),
+					datastar.WithModePrepend(),
+					datastar.WithPatchElementsEventID(strconv.FormatInt(time.Now().UnixMilli(), 10)),
+				)
+				newestId = list.Transfers[0].Id
+
+				if ds.AccountId != nil && *ds.AccountId != -1 {
+					acc, err := loadAppTransfersSelectedAccount(r.Context(), db, *ds.AccountId)
+					if err != nil {
+						continue
+					}
+					sse.PatchElementf(`<span id="bal" class="text-neutral-300 text-sm">(bal: %v)</span>`, acc.Balance)
+				}
 			case <-r.Context().Done():
 				for _, s := range subs {
 					s.Unsubscribe()
@@ -1175,7 +1808,7 @@ func FormRecipient(db *database.Database) http.HandlerFunc {
 	}
 }
 
-func SubmitTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.WebhookEnqueuer) http.HandlerFunc {
+func SubmitTransfer(db *database.Database, outbox accounts.OutboxNotifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// TODO: Honestly, have the whole entire thing just be form data, then merge
 		// in a fragment of success. Or maybe fail message too?
@@ -1235,13 +1868,14 @@ func SubmitTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 		}
 		defer tx.Rollback()
 
-		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), nc, webhooks, accounts.CreateTransferInput{
+		trResult, err := accounts.CreateTransfer(r.Context(), db.Q.WithTx(tx), accounts.CreateTransferInput{
 			SendingId:      accId,
 			ReceivingId:    recipientId,
 			Memo:           memo,
 			LedgerId:       acc.LedgerID,
 			Amount:         qtyInt,
 			IdempotencyKey: idemKey,
+			Initiator:      transferInitiator(r, accId),
 		})
 		if err != nil {
 			switch {
@@ -1258,7 +1892,7 @@ func SubmitTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				if existing.RequestHash != accounts.TransferRequestHash(recipientId, qtyInt, acc.LedgerID, memo) {
+				if existing.RequestHash != accounts.TransferRequestHash(recipientId, qtyInt, acc.LedgerID, memo, nil, nil) {
 					w.WriteHeader(http.StatusConflict)
 					return
 				}
@@ -1281,8 +1915,8 @@ func SubmitTransfer(db *database.Database, nc *nats.Conn, webhooks accounts.Webh
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			if trResult.Created {
-				go trResult.Publish()
+			if trResult.Created && outbox != nil {
+				outbox.Notify()
 			}
 		}
 
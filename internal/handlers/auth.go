@@ -13,6 +13,7 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/stelofinance/stelofinance/database"
 	"github.com/stelofinance/stelofinance/database/gensql"
+	"github.com/stelofinance/stelofinance/internal/accounts"
 	"github.com/stelofinance/stelofinance/internal/logger"
 	"github.com/stelofinance/stelofinance/internal/sessions"
 )
@@ -22,11 +23,12 @@ type LoginKV struct {
 	PlayerId string `json:"playerId"`
 }
 
-func Auth(lgr *logger.Logger, db *database.Database, sessionsKV jetstream.KeyValue, getenv func(string) string) http.HandlerFunc {
+func Auth(lgr *logger.Logger, db *database.Database, sessionsKV jetstream.KeyValue, outbox accounts.OutboxNotifier, getenv func(string) string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var playerInfo LoginKV
 		// Check if it's an admin bypass, otherwise handle normally
-		if r.URL.Query().Get("adminkey") == getenv("ADMIN_KEY") {
+		adminBypass := r.URL.Query().Get("adminkey") == getenv("ADMIN_KEY")
+		if adminBypass {
 			playerInfo.PlayerId = r.URL.Query().Get("playerid")
 			playerInfo.Username = r.URL.Query().Get("username")
 		} else {
@@ -64,8 +66,25 @@ func Auth(lgr *logger.Logger, db *database.Database, sessionsKV jetstream.KeyVal
 
 		var userId int64
 
+		// The user is created in the same transaction as an admin bypass is
+		// recorded, so neither happens without the other
+		tx, err := db.Pool.BeginTx(r.Context(), nil)
+		if err != nil {
+			lgr.Log(logger.Log{
+				Message: "error beginning auth transaction",
+				Data: map[string]any{
+					"error": err.Error(),
+				},
+				Level: logger.ErrorLevel,
+			})
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		qtx := db.Q.WithTx(tx)
+
 		// Check if user already exists, if not, create user
-		dbUser, err := db.Q.GetUserByBitCraftId(r.Context(), playerInfo.PlayerId)
+		dbUser, err := qtx.GetUserByBitCraftId(r.Context(), playerInfo.PlayerId)
 		if err != nil && !errors.Is(err, sql.ErrNoRows) {
 			lgr.Log(logger.Log{
 				Message: "error getting user for auth",
@@ -79,7 +98,7 @@ func Auth(lgr *logger.Logger, db *database.Database, sessionsKV jetstream.KeyVal
 		}
 		userId = dbUser.ID
 		if errors.Is(err, sql.ErrNoRows) {
-			insertedId, err := db.Q.InsertUser(r.Context(), gensql.InsertUserParams{
+			insertedId, err := qtx.InsertUser(r.Context(), gensql.InsertUserParams{
 				BitcraftUsername: playerInfo.Username,
 				BitcraftID:       playerInfo.PlayerId,
 				CreatedAt:        time.Now(),
@@ -98,6 +117,36 @@ func Auth(lgr *logger.Logger, db *database.Database, sessionsKV jetstream.KeyVal
 			userId = insertedId
 		}
 
+		if adminBypass {
+			err := accounts.RecordAdminAction(r.Context(), qtx, adminAudit(r, accounts.AdminLoginBypassed, "user:"+strconv.FormatInt(userId, 10), nil, playerInfo))
+			if err != nil {
+				lgr.Log(logger.Log{
+					Message: "error recording admin login bypass",
+					Data: map[string]any{
+						"error": err.Error(),
+					},
+					Level: logger.ErrorLevel,
+				})
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			lgr.Log(logger.Log{
+				Message: "error committing auth transaction",
+				Data: map[string]any{
+					"error": err.Error(),
+				},
+				Level: logger.ErrorLevel,
+			})
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if adminBypass && outbox != nil {
+			outbox.Notify()
+		}
+
 		// Create session and respond with cookie
 		sid := uniuri.NewLen(28)
 		cookie := http.Cookie{
@@ -1,7 +1,15 @@
 package handlers
 
 import (
+	"encoding/json"
+	"net"
+	"net/http"
 	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stelofinance/stelofinance/internal/accounts"
+	midware "github.com/stelofinance/stelofinance/internal/middlewares"
+	"github.com/stelofinance/stelofinance/internal/sessions"
 )
 
 func isValidRedirectURL(rawurl string) bool {
@@ -17,3 +25,70 @@ func isValidRedirectURL(rawurl string) bool {
 
 	return true
 }
+
+// transferInitiator records who is making a transfer from the request's
+// session: an account token over the API, otherwise the user in the app.
+func transferInitiator(r *http.Request, accId int64) accounts.Initiator {
+	init := accounts.Initiator{AccountId: accId}
+	if reqId := middleware.GetReqID(r.Context()); reqId != "" {
+		init.RequestId = &reqId
+	}
+	if clientId := midware.GetClientRequestID(r.Context()); clientId != "" {
+		init.ClientRequestId = &clientId
+	}
+	if accData := sessions.GetAccount(r.Context()); accData != nil && accData.TokenId != "" {
+		init.TokenId = &accData.TokenId
+		init.Channel = accounts.ChannelAPI
+		return init
+	}
+	if sData := sessions.GetUser(r.Context()); sData != nil {
+		init.UserId = &sData.Id
+	}
+	init.Channel = accounts.ChannelApp
+	return init
+}
+
+// adminAudit describes an admin action for the audit log, from the request
+// it was made in.
+func adminAudit(r *http.Request, action accounts.AdminAction, target string, before, after any) accounts.AdminAuditInput {
+	input := accounts.AdminAuditInput{
+		Action:   action,
+		Target:   target,
+		Before:   before,
+		After:    after,
+		SourceIp: sourceIp(r),
+	}
+	if reqId := middleware.GetReqID(r.Context()); reqId != "" {
+		input.RequestId = &reqId
+	}
+	if clientId := midware.GetClientRequestID(r.Context()); clientId != "" {
+		input.ClientRequestId = &clientId
+	}
+	return input
+}
+
+// sourceIp is the client's IP. Fly's proxy sets Fly-Client-IP, replacing any
+// the client sent.
+func sourceIp(r *http.Request) string {
+	if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeJSON responds with rsp marshalled to JSON.
+func writeJSON(w http.ResponseWriter, rsp any, status int) {
+	data, err := json.Marshal(rsp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
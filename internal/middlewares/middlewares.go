@@ -11,6 +11,8 @@ import (
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/stelofinance/stelofinance/database"
 	"github.com/stelofinance/stelofinance/database/gensql"
@@ -203,7 +205,8 @@ func AuthAccountToken(sessionsKV jetstream.KeyValue) func(http.Handler) http.Han
 
 			// Add account data to session
 			r = r.WithContext(sessions.WithAccount(r.Context(), &sessions.AccountData{
-				Id: accData.Id,
+				Id:      accData.Id,
+				TokenId: sessions.TokenID(tVal),
 			}))
 
 			next.ServeHTTP(w, r)
@@ -230,6 +233,30 @@ func AuthAdmin(getenv func(string) string) func(http.Handler) http.Handler {
 	}
 }
 
+type clientRequestIdCtxKey struct{}
+
+// RequestID gives every request an ID generated here, for chi's
+// middleware.GetReqID, and returns it in the X-Request-Id header. Clients
+// can't choose it, so it's safe to trust in logs and records. An X-Request-Id
+// the client sent is kept apart, see GetClientRequestID.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqId := uuid.NewString()
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, reqId)
+		if clientId := r.Header.Get(middleware.RequestIDHeader); clientId != "" {
+			ctx = context.WithValue(ctx, clientRequestIdCtxKey{}, clientId)
+		}
+		w.Header().Set(middleware.RequestIDHeader, reqId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetClientRequestID returns the X-Request-Id the client sent, or "" if none.
+func GetClientRequestID(ctx context.Context) string {
+	clientId, _ := ctx.Value(clientRequestIdCtxKey{}).(string)
+	return clientId
+}
+
 var ErrKeyNotFound = errors.New("middlewares: key not found")
 
 // TODO: replace with ListKeysFiltered maybe?
@@ -0,0 +1,257 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stelofinance/stelofinance/database"
+	"github.com/stelofinance/stelofinance/database/gensql"
+	"github.com/stelofinance/stelofinance/internal/accounts"
+	"github.com/stelofinance/stelofinance/internal/logger"
+)
+
+const (
+	pollInterval   = 2 * time.Second
+	batchSize      = 100
+	publishTimeout = 5 * time.Second
+	// Long enough for a publish to finish, after which another relay may
+	// retry the entry
+	leaseDuration = 30 * time.Second
+	maxBackoff    = 5 * time.Minute
+	// Published entries are kept around this long for debugging
+	retention      = 7 * 24 * time.Hour
+	pruneInterval  = time.Hour
+	maxErrorLength = 500
+)
+
+// Relay publishes committed outbox entries, retrying each until it's
+// acknowledged. Entries can be published more than once (e.g. if the process
+// dies before marking one), so delivery is at least once.
+type Relay struct {
+	db       *database.Database
+	js       jetstream.JetStream
+	webhooks accounts.WebhookEnqueuer
+	lgr      *logger.Logger
+	wake     chan struct{}
+}
+
+func New(db *database.Database, js jetstream.JetStream, webhooks accounts.WebhookEnqueuer, lgr *logger.Logger) *Relay {
+	return &Relay{
+		db:       db,
+		js:       js,
+		webhooks: webhooks,
+		lgr:      lgr,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay. Implements accounts.OutboxNotifier.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes due entries until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	for {
+		if err := r.publishDue(ctx); err != nil && ctx.Err() == nil {
+			r.log(logger.ErrorLevel, "outbox: reading entries failed", map[string]any{
+				"error": err.Error(),
+			})
+		}
+
+		if time.Since(lastPrune) > pruneInterval {
+			lastPrune = time.Now()
+			before := lastPrune.Add(-retention)
+			if _, err := r.db.Q.DeleteOutboxPublishedBefore(ctx, &before); err != nil && ctx.Err() == nil {
+				r.log(logger.WarnLevel, "outbox: pruning published entries failed", map[string]any{
+					"error": err.Error(),
+				})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) publishDue(ctx context.Context) error {
+	for {
+		now := time.Now()
+		entries, err := r.db.Q.GetDueOutboxEntries(ctx, gensql.GetDueOutboxEntriesParams{
+			Now:   now,
+			Limit: batchSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Endpoints an entry wasn't published for this batch, whose later
+		// entries are held back in case the endpoint is ordered
+		held := make(map[int64]struct{})
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if entry.EndpointID != nil {
+				if _, ok := held[*entry.EndpointID]; ok {
+					continue
+				}
+			}
+
+			// Claim the entry, so concurrent relays don't both publish it
+			rows, err := r.db.Q.ClaimOutboxEntry(ctx, gensql.ClaimOutboxEntryParams{
+				LeaseUntil:   now.Add(leaseDuration),
+				ID:           entry.ID,
+				FromAttempts: entry.Attempts,
+			})
+			if err != nil {
+				return err
+			}
+			if rows == 0 || !r.publishEntry(ctx, entry) {
+				if entry.EndpointID != nil {
+					held[*entry.EndpointID] = struct{}{}
+				}
+			}
+		}
+
+		if len(entries) < batchSize {
+			return nil
+		}
+	}
+}
+
+// publishEntry publishes the claimed entry, and reports whether it was.
+func (r *Relay) publishEntry(ctx context.Context, entry gensql.Outbox) bool {
+	err := r.publish(ctx, entry)
+	if err == nil {
+		now := time.Now()
+		err = r.db.Q.UpdateOutboxPublished(ctx, gensql.UpdateOutboxPublishedParams{
+			PublishedAt: &now,
+			ID:          entry.ID,
+		})
+		if err != nil {
+			// The lease runs out and it's published again
+			r.log(logger.WarnLevel, "outbox: marking entry published failed", map[string]any{
+				"error":   err.Error(),
+				"entryId": entry.ID,
+			})
+		}
+		return true
+	}
+
+	attempt := entry.Attempts + 1
+	msg := err.Error()
+	if len(msg) > maxErrorLength {
+		msg = msg[:maxErrorLength]
+	}
+	r.log(logger.WarnLevel, "outbox: publishing entry failed, will retry", map[string]any{
+		"error":   msg,
+		"entryId": entry.ID,
+		"attempt": attempt,
+	})
+
+	err = r.db.Q.UpdateOutboxFailed(ctx, gensql.UpdateOutboxFailedParams{
+		NextAttemptAt: time.Now().Add(backoffForAttempt(attempt)),
+		LastError:     &msg,
+		ID:            entry.ID,
+	})
+	if err != nil {
+		r.log(logger.WarnLevel, "outbox: recording failed attempt failed", map[string]any{
+			"error":   err.Error(),
+			"entryId": entry.ID,
+		})
+	}
+	return false
+}
+
+func (r *Relay) publish(ctx context.Context, entry gensql.Outbox) error {
+	switch accounts.OutboxKind(entry.Kind) {
+	case accounts.OutboxEvent:
+		// Acknowledged once stored in the TRANSFERS stream, and still seen
+		// by plain subscribers of the subject
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		_, err := r.js.Publish(ctx, entry.Subject, []byte(entry.Payload),
+			jetstream.WithMsgID(fmt.Sprintf("outbox-%d", entry.ID)),
+			jetstream.WithExpectStream(TransfersStream),
+		)
+		return err
+	case accounts.OutboxWebhook:
+		if r.webhooks == nil {
+			return nil
+		}
+		if entry.AccountID == nil || entry.EndpointID == nil || entry.Url == nil {
+			return fmt.Errorf("outbox: webhook entry %d has no target", entry.ID)
+		}
+		var transfer accounts.WebhookTransfer
+		if err := json.Unmarshal([]byte(entry.Payload), &transfer); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		return r.webhooks.EnqueueTransferWebhook(ctx, fmt.Sprintf("outbox-%d", entry.ID), *entry.AccountID, *entry.EndpointID, *entry.Url, transfer)
+	case accounts.OutboxAuditEvent:
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		_, err := r.js.Publish(ctx, entry.Subject, []byte(entry.Payload),
+			jetstream.WithMsgID(fmt.Sprintf("outbox-%d", entry.ID)),
+			jetstream.WithExpectStream(AuditStream),
+		)
+		return err
+	case accounts.OutboxLiveEvent:
+		return r.js.Conn().Publish(entry.Subject, []byte(entry.Payload))
+	case accounts.OutboxPermissionWebhook:
+		if r.webhooks == nil {
+			return nil
+		}
+		if entry.AccountID == nil || entry.EndpointID == nil || entry.Url == nil {
+			return fmt.Errorf("outbox: webhook entry %d has no target", entry.ID)
+		}
+		var event accounts.EventAccountPermission
+		if err := json.Unmarshal([]byte(entry.Payload), &event); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		return r.webhooks.EnqueuePermissionWebhook(ctx, fmt.Sprintf("outbox-%d", entry.ID), *entry.AccountID, *entry.EndpointID, *entry.Url, event)
+	default:
+		return fmt.Errorf("outbox: unknown entry kind %d", entry.Kind)
+	}
+}
+
+// backoffForAttempt doubles from a second, up to maxBackoff.
+func backoffForAttempt(attempt int64) time.Duration {
+	delay := time.Second
+	for range min(attempt-1, 20) {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+func (r *Relay) log(level logger.Level, msg string, data map[string]any) {
+	if r.lgr == nil {
+		return
+	}
+	_ = r.lgr.Log(logger.Log{
+		Message: msg,
+		Data:    data,
+		Level:   level,
+	})
+}
@@ -0,0 +1,60 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// TransfersStream keeps transfer events, so integrations can catch up on
+	// the ones they missed
+	TransfersStream   = "TRANSFERS"
+	transfersSubjects = "accounts.transfers.>"
+	transfersMaxAge   = 30 * 24 * time.Hour
+
+	// AuditStream keeps the admin audit log, so it can be checked against
+	// the database's copy. Messages can't be deleted or purged from it.
+	AuditStream   = "ADMIN_AUDIT"
+	auditSubjects = "admin.audit.>"
+)
+
+// EnsureStream creates or updates the TRANSFERS stream. Call it before
+// running the relay, as events are published to it.
+func EnsureStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      TransfersStream,
+		Subjects:  []string{transfersSubjects},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    transfersMaxAge,
+		Replicas:  1,
+		// Long enough to catch relays retrying an entry after their lease
+		Duplicates: 10 * time.Minute,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: create stream: %w", err)
+	}
+	return stream, nil
+}
+
+// EnsureAuditStream creates or updates the ADMIN_AUDIT stream. Call it before
+// running the relay, as admin audit events are published to it.
+func EnsureAuditStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       AuditStream,
+		Subjects:   []string{auditSubjects},
+		Retention:  jetstream.LimitsPolicy,
+		Storage:    jetstream.FileStorage,
+		Replicas:   1,
+		DenyDelete: true,
+		DenyPurge:  true,
+		Duplicates: 10 * time.Minute,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outbox: create audit stream: %w", err)
+	}
+	return stream, nil
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/stelofinance/stelofinance/internal/handlers"
 	"github.com/stelofinance/stelofinance/internal/logger"
 	midware "github.com/stelofinance/stelofinance/internal/middlewares"
+	"github.com/stelofinance/stelofinance/internal/webhooks"
 )
 
 func AddRoutes(
@@ -19,8 +20,11 @@ func AddRoutes(
 	lgr *logger.Logger,
 	db *database.Database,
 	sessionsKV jetstream.KeyValue,
+	statementsOS jetstream.ObjectStore,
+	transfersStream jetstream.Stream,
 	nc *nats.Conn,
-	webhooks accounts.WebhookEnqueuer,
+	outbox accounts.OutboxNotifier,
+	webhookSvc *webhooks.Service,
 	getenv func(string) string,
 ) {
 	assets.HttpHandler(mux)
@@ -34,7 +38,7 @@ func AddRoutes(
 	// Login/Auth routes
 	// TODO: These routes should be guest protected
 	mux.Handle("GET /login", handlers.Login(env, sessionsKV))
-	mux.Handle("GET /auth/{key}", handlers.Auth(lgr, db, sessionsKV, getenv))
+	mux.Handle("GET /auth/{key}", handlers.Auth(lgr, db, sessionsKV, outbox, getenv))
 
 	// App related routes
 	mux.Route("/app", func(mux chi.Router) {
@@ -47,22 +51,31 @@ func AddRoutes(
 		mux.Handle("POST /accounts", handlers.AppCreateAccount(env, db))
 
 		mux.Handle("GET /request", handlers.AppPaymentRequest(env, db, sessionsKV))
-		mux.With(midware.AuthUserAccount(db, accounts.PermAdmin)).Handle("POST /request/{account_id}/transfers", handlers.PostRequest(db, nc, webhooks))
+		mux.With(midware.AuthUserAccount(db, accounts.PermAdmin)).Handle("POST /request/{account_id}/transfers", handlers.PostRequest(db, outbox))
 
 		mux.Group(func(mux chi.Router) {
 			mux.Use(midware.AuthUserAccount(db, accounts.PermAdmin))
 
 			mux.Handle("GET /accounts/{account_id}", handlers.AppAccount(env, db, sessionsKV))
-			mux.Handle("PUT /accounts/{account_id}/user-id", handlers.PutAccountUser(env, db, sessionsKV))
-			mux.Handle("POST /accounts/{account_id}/users", handlers.PostAccountUser(env, db, sessionsKV))
-			mux.Handle("DELETE /accounts/{account_id}/users/{user_id}", handlers.DeleteAccountUser(env, db, sessionsKV))
-			mux.Handle("POST /accounts/{account_id}/tokens", handlers.PostAccountToken(env, db, sessionsKV))
-			mux.Handle("DELETE /accounts/{account_id}/tokens", handlers.DeleteAccountTokens(env, db, sessionsKV))
-			mux.Handle("POST /accounts/{account_id}/transfers", handlers.SubmitTransfer(db, nc, webhooks))
+			mux.Handle("PUT /accounts/{account_id}/user-id", handlers.PutAccountUser(env, db, sessionsKV, outbox))
+			mux.Handle("PUT /accounts/{account_id}/privacy", handlers.PutAccountPrivacy(env, db, sessionsKV))
+			mux.Handle("POST /accounts/{account_id}/users", handlers.PostAccountUser(env, db, sessionsKV, outbox))
+			mux.Handle("DELETE /accounts/{account_id}/users/{user_id}", handlers.DeleteAccountUser(env, db, sessionsKV, outbox))
+			mux.Handle("POST /accounts/{account_id}/tokens", handlers.PostAccountToken(env, db, sessionsKV, outbox))
+			mux.Handle("DELETE /accounts/{account_id}/tokens", handlers.DeleteAccountTokens(env, db, sessionsKV, outbox))
+			mux.Handle("POST /accounts/{account_id}/webhooks/{webhook_id}/secret", handlers.PostAccountWebhookSecret(env, db, sessionsKV))
+			mux.Handle("POST /accounts/{account_id}/webhooks/{webhook_id}/enable", handlers.PostAccountWebhookEnable(env, db, sessionsKV, webhookSvc))
+			mux.Handle("POST /accounts/{account_id}/webhooks/{webhook_id}/test", handlers.PostAccountWebhookTest(env, db, sessionsKV, webhookSvc))
+			mux.Handle("POST /accounts/{account_id}/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", handlers.PostAccountWebhookRedeliver(env, db, sessionsKV, outbox))
+			mux.Handle("POST /accounts/{account_id}/transfers", handlers.SubmitTransfer(db, outbox))
+			mux.Handle("GET /accounts/{account_id}/statement", handlers.Statement(db))
+			mux.Handle("GET /accounts/{account_id}/statements/{statement_id}", handlers.ArchivedStatement(db, statementsOS))
 		})
 
 		mux.Handle("GET /transfers", handlers.AppTransfers(env, db))
 		mux.Handle("GET /transfers/updates", handlers.AppTransfersUpdates(env, db, nc))
+		mux.Handle("GET /transfers/more", handlers.AppTransfersMore(db))
+		mux.Handle("GET /transfers/journal", handlers.AppJournal(db))
 
 		mux.Handle("GET /transfers/form-recipient", handlers.FormRecipient(db))
 
@@ -72,21 +85,33 @@ func AddRoutes(
 	// API related routes
 	mux.Route("/api", func(mux chi.Router) {
 		mux.Handle("GET /ledgers", handlers.Ledgers(db))
-		mux.With(midware.AuthAdmin(getenv)).Handle("POST /ledgers", handlers.CreateLedger(db))
+		mux.With(midware.AuthAdmin(getenv)).Handle("POST /ledgers", handlers.CreateLedger(db, outbox))
 		mux.With(midware.AuthAdmin(getenv)).Handle("GET /ledgers/{ledger_id}/audit", handlers.LedgerAudit(db))
+		mux.Handle("GET /ledgers/{ledger_id}/holders", handlers.LedgerHolders(db))
 
 		// Simple no-auth ping route
 		mux.Handle("GET /ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("pong"))
 		}))
 
-		mux.With(midware.AuthAdmin(getenv)).Handle("GET /users/{user_id}", handlers.User(db))
+		mux.With(midware.AuthAdmin(getenv)).Handle("GET /users/{user_id}", handlers.User(db, outbox))
 
 		mux.Handle("GET /accounts", handlers.Accounts(db))
 
-		mux.With(midware.AuthAdmin(getenv)).Handle("POST /accounts", handlers.CreateAccount(db))
-		mux.With(midware.AuthAdmin(getenv)).Handle("PUT /accounts/{account_id}/address", handlers.UpdateAddress(db))
-		mux.With(midware.AuthAdmin(getenv)).Handle("PATCH /accounts/{account_id}/balance", handlers.PatchBalance(db))
+		mux.With(midware.AuthAdmin(getenv)).Handle("POST /accounts", handlers.CreateAccount(db, outbox))
+		mux.With(midware.AuthAdmin(getenv)).Handle("PUT /accounts/{account_id}/address", handlers.UpdateAddress(db, outbox))
+		mux.With(midware.AuthAdmin(getenv)).Handle("PATCH /accounts/{account_id}/balance", handlers.PatchBalance(db, outbox))
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(midware.AuthAdmin(getenv))
+
+			mux.Handle("GET /webhooks/dead-letters", handlers.DeadLetters(webhookSvc))
+			mux.Handle("GET /webhooks/dead-letters/{dead_letter_id}", handlers.DeadLetter(webhookSvc))
+			mux.Handle("POST /webhooks/dead-letters/{dead_letter_id}/replay", handlers.ReplayDeadLetter(db, webhookSvc, outbox))
+			mux.Handle("DELETE /webhooks/dead-letters/{dead_letter_id}", handlers.DiscardDeadLetter(db, webhookSvc, outbox))
+
+			mux.Handle("GET /admin/audit", handlers.AdminAudit(db))
+		})
 
 		mux.Route("/accounts/{account_id}", func(mux chi.Router) {
 			mux.Use(midware.AuthAccountToken(sessionsKV))
@@ -100,11 +125,54 @@ func AddRoutes(
 
 			mux.Handle("GET /transfers", handlers.Transfers(db))
 			mux.Handle("GET /transfers/{tr_id}", handlers.Transfer(db))
-			mux.Handle("POST /transfers", handlers.CreateTransfer(db, nc, webhooks))
+			mux.Handle("POST /transfers", handlers.CreateTransfer(db, outbox))
+			mux.Handle("GET /statement", handlers.Statement(db))
+			mux.Handle("GET /journal", handlers.Journal(db))
+			mux.Handle("GET /statements", handlers.ArchivedStatements(db))
+			mux.Handle("GET /statements/{statement_id}", handlers.ArchivedStatement(db, statementsOS))
+
+			mux.Handle("GET /events", handlers.AccountEvents(transfersStream))
+			mux.Handle("GET /stream", handlers.AccountStream(transfersStream, nc))
+
+			mux.Handle("GET /distributions", handlers.Distributions(db))
+			mux.Handle("GET /distributions/{distribution_id}", handlers.Distribution(db))
+			mux.Handle("POST /distributions", handlers.CreateDistribution(db, outbox))
+
+			mux.Handle("GET /invoices", handlers.Invoices(db))
+			mux.Handle("GET /invoices/{invoice_id}", handlers.Invoice(db))
+			mux.Handle("POST /invoices", handlers.CreateInvoice(db))
+			mux.Handle("DELETE /invoices/{invoice_id}", handlers.CancelInvoice(db))
+			mux.Handle("POST /checkout-secret", handlers.RotateCheckoutSecret(db))
+
+			mux.Handle("GET /allowances", handlers.Allowances(db))
+			mux.Handle("GET /allowances/{allowance_id}", handlers.Allowance(db))
+			mux.Handle("POST /allowances", handlers.CreateAllowance(db))
+			mux.Handle("DELETE /allowances/{allowance_id}", handlers.RevokeAllowance(db))
+			mux.Handle("POST /allowances/{allowance_id}/pulls", handlers.PullAllowance(db, outbox))
 
 			mux.Handle("GET /webhook", handlers.GetWebhook(db))
 			mux.Handle("PUT /webhook", handlers.PutWebhook(db))
 			mux.Handle("DELETE /webhook", handlers.DeleteWebhook(db))
+			mux.Handle("POST /webhook/secret", handlers.RotateWebhookSecret(db))
+			mux.Handle("POST /webhook/test", handlers.TestWebhook(db, webhookSvc))
+
+			mux.Handle("GET /webhooks", handlers.Webhooks(db))
+			mux.Handle("POST /webhooks", handlers.CreateWebhook(db))
+			mux.Handle("GET /webhooks/{webhook_id}", handlers.Webhook(db))
+			mux.Handle("PATCH /webhooks/{webhook_id}", handlers.UpdateWebhook(db))
+			mux.Handle("DELETE /webhooks/{webhook_id}", handlers.DeleteWebhook(db))
+			mux.Handle("POST /webhooks/{webhook_id}/secret", handlers.RotateWebhookSecret(db))
+			mux.Handle("POST /webhooks/{webhook_id}/enable", handlers.EnableWebhook(db, webhookSvc))
+			mux.Handle("POST /webhooks/{webhook_id}/test", handlers.TestWebhook(db, webhookSvc))
+			mux.Handle("GET /webhooks/{webhook_id}/deliveries", handlers.WebhookDeliveries(db))
+			mux.Handle("GET /webhooks/{webhook_id}/deliveries/{delivery_id}", handlers.WebhookDelivery(db))
+			mux.Handle("POST /webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", handlers.RedeliverWebhook(db, outbox))
+			mux.Handle("GET /webhooks/dead-letters", handlers.DeadLetters(webhookSvc))
+			mux.Handle("GET /webhooks/dead-letters/{dead_letter_id}", handlers.DeadLetter(webhookSvc))
+			mux.Handle("POST /webhooks/dead-letters/{dead_letter_id}/replay", handlers.ReplayDeadLetter(db, webhookSvc, outbox))
+			mux.Handle("DELETE /webhooks/dead-letters/{dead_letter_id}", handlers.DiscardDeadLetter(db, webhookSvc, outbox))
+
+			mux.Handle("PUT /privacy", handlers.PutPrivacy(db))
 		})
 
 	})
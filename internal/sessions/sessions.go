@@ -2,6 +2,8 @@ package sessions
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 )
 
 type userCtxKey struct{}
@@ -38,7 +40,15 @@ type accountCtxKey struct{}
 var accountContextKey = accountCtxKey{}
 
 type AccountData struct {
-	Id int64 // The account's id
+	Id      int64  // The account's id
+	TokenId string `json:"-"` // Set when authed with an account token
+}
+
+// TokenID is the public id of an account token. It identifies the token in
+// audit trails without revealing the secret.
+func TokenID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "tok_" + hex.EncodeToString(sum[:8])
 }
 
 func WithAccount(ctx context.Context, data *AccountData) context.Context {
@@ -0,0 +1,351 @@
+package statements
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stelofinance/stelofinance/database"
+	"github.com/stelofinance/stelofinance/database/gensql"
+	"github.com/stelofinance/stelofinance/internal/accounts"
+	"github.com/stelofinance/stelofinance/internal/logger"
+)
+
+const (
+	BucketName = "statements"
+
+	runInterval      = time.Hour
+	accountsPageSize = 100
+)
+
+// Service generates monthly account statements once each month (UTC) has
+// closed, archiving them in a JetStream object store. Statements are never
+// regenerated, so changes made to an account afterwards show up as a
+// difference between a statement's opening balance and the previous
+// statement's closing balance.
+type Service struct {
+	db  *database.Database
+	obs jetstream.ObjectStore
+	lgr *logger.Logger
+}
+
+// New creates a statement service. Call Ensure before Run.
+func New(db *database.Database, lgr *logger.Logger) *Service {
+	return &Service{
+		db:  db,
+		lgr: lgr,
+	}
+}
+
+// Ensure creates the statements object store bucket, returning it so
+// statements can be downloaded.
+func (s *Service) Ensure(ctx context.Context, js jetstream.JetStream) (jetstream.ObjectStore, error) {
+	obs, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      BucketName,
+		Description: "Monthly account statements",
+		Storage:     jetstream.FileStorage,
+		Replicas:    1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("statements: create bucket: %w", err)
+	}
+	s.obs = obs
+	return obs, nil
+}
+
+// Run generates due statements now and then every hour, until ctx is
+// cancelled.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(runInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.GenerateDue(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			s.log(logger.ErrorLevel, "statements: generating failed", map[string]any{
+				"error": err.Error(),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GenerateDue generates every account's statements for the months closed
+// before now that don't have one yet, starting from the month the account was
+// created in.
+func (s *Service) GenerateDue(ctx context.Context, now time.Time) error {
+	current := MonthStart(now)
+
+	var afterId int64
+	for {
+		accs, err := s.db.Q.GetAccountsPage(ctx, gensql.GetAccountsPageParams{
+			AfterID: afterId,
+			Limit:   accountsPageSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, acc := range accs {
+			if err := s.generateAccount(ctx, acc.ID, acc.CreatedAt, current); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// Don't let one account hold up the others
+				s.log(logger.ErrorLevel, "statements: generating account statement failed", map[string]any{
+					"error":     err.Error(),
+					"accountId": acc.ID,
+				})
+			}
+		}
+
+		if len(accs) < accountsPageSize {
+			return nil
+		}
+		afterId = accs[len(accs)-1].ID
+	}
+}
+
+func (s *Service) generateAccount(ctx context.Context, accId int64, createdAt, current time.Time) error {
+	start := MonthStart(createdAt)
+	var prevClosing *int64
+
+	latest, err := s.db.Q.GetLatestAccountStatement(ctx, accId)
+	if err == nil {
+		start = latest.PeriodEnd.UTC()
+		prevClosing = &latest.ClosingBalance
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	for start.Before(current) {
+		end := start.AddDate(0, 1, 0)
+		closing, err := s.generate(ctx, accId, start, end, prevClosing)
+		if err != nil {
+			return err
+		}
+		prevClosing = &closing
+		start = end
+	}
+	return nil
+}
+
+// generate renders and archives one statement, returning its closing balance.
+func (s *Service) generate(ctx context.Context, accId int64, start, end time.Time, prevClosing *int64) (int64, error) {
+	// Each statement gets its own object, so a statement recorded by another
+	// instance is never overwritten
+	name := fmt.Sprintf("accounts/%d/%s/%s.json", accId, start.Format("2006-01"), uniuri.NewLen(8))
+
+	doc, info, err := s.render(ctx, accId, start, end, prevClosing, name)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := s.db.Q.InsertAccountStatement(ctx, gensql.InsertAccountStatementParams{
+		AccountID:              accId,
+		PeriodStart:            start.In(time.Local),
+		PeriodEnd:              end.In(time.Local),
+		ObjectName:             name,
+		Digest:                 info.Digest,
+		OpeningBalance:         doc.Statement.OpeningBalance,
+		ClosingBalance:         doc.Summary.ClosingBalance,
+		PreviousClosingBalance: prevClosing,
+		TotalIn:                doc.Summary.TotalIn,
+		TotalOut:               doc.Summary.TotalOut,
+		TransferCount:          doc.Summary.TransferCount,
+		CreatedAt:              time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		// Another instance got there first, so keep its statement
+		_ = s.obs.Delete(ctx, name)
+		latest, err := s.db.Q.GetLatestAccountStatement(ctx, accId)
+		if err != nil {
+			return 0, err
+		}
+		return latest.ClosingBalance, nil
+	}
+
+	return doc.Summary.ClosingBalance, nil
+}
+
+// render streams the statement into the object store, reading the transfers
+// within a single read transaction.
+func (s *Service) render(ctx context.Context, accId int64, start, end time.Time, prevClosing *int64, name string) (Document, *jetstream.ObjectInfo, error) {
+	var doc Document
+
+	tx, err := s.db.Pool.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return doc, nil, err
+	}
+	defer tx.Rollback()
+	q := s.db.Q.WithTx(tx)
+
+	// Times are stored in the server's zone, so compare in it as well
+	from, to := start.In(time.Local), end.In(time.Local)
+	stmt, err := accounts.OpenStatement(ctx, q, accounts.StatementInput{
+		AccountId: accId,
+		From:      &from,
+		To:        &to,
+	})
+	if err != nil {
+		return doc, nil, err
+	}
+
+	doc.Statement = DocumentHeader{
+		AccountID:              accId,
+		Address:                stmt.Account.Address,
+		LedgerID:               stmt.Account.LedgerID,
+		LedgerName:             stmt.Account.LedgerName,
+		AssetScale:             stmt.Account.AssetScale,
+		PeriodStart:            start,
+		PeriodEnd:              end,
+		OpeningBalance:         stmt.OpeningBalance,
+		PreviousClosingBalance: prevClosing,
+		GeneratedAt:            time.Now().UTC(),
+	}
+	doc.Summary.ClosingBalance = stmt.OpeningBalance
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeDocument(ctx, q, pw, stmt, &doc))
+	}()
+
+	info, err := s.obs.Put(ctx, jetstream.ObjectMeta{
+		Name:        name,
+		Description: fmt.Sprintf("Statement for account %d, %s", accId, start.Format("2006-01")),
+	}, pr)
+	// Unblock the writer if the put gave up early
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return doc, nil, err
+	}
+
+	return doc, info, nil
+}
+
+// Document is the archived statement, a JSON object whose transfers are
+// written as they're read. Amounts are integers, in the ledger's asset scale.
+type Document struct {
+	Statement DocumentHeader     `json:"statement"`
+	Transfers []DocumentTransfer `json:"transfers"`
+	Summary   DocumentSummary    `json:"summary"`
+}
+
+type DocumentHeader struct {
+	AccountID              int64     `json:"accountId"`
+	Address                string    `json:"address"`
+	LedgerID               int64     `json:"ledgerId"`
+	LedgerName             string    `json:"ledgerName"`
+	AssetScale             int64     `json:"assetScale"`
+	PeriodStart            time.Time `json:"periodStart"`
+	PeriodEnd              time.Time `json:"periodEnd"`
+	OpeningBalance         int64     `json:"openingBalance"`
+	PreviousClosingBalance *int64    `json:"previousClosingBalance"`
+	GeneratedAt            time.Time `json:"generatedAt"`
+}
+
+type DocumentTransfer struct {
+	TransferID           int64           `json:"transferId"`
+	CreatedAt            time.Time       `json:"createdAt"`
+	Code                 accounts.TrCode `json:"code"`
+	CounterpartyID       int64           `json:"counterpartyId"`
+	CounterpartyAddress  string          `json:"counterpartyAddress"`
+	CounterpartyUsername *string         `json:"counterpartyUsername"`
+	Amount               int64           `json:"amount"` // Signed, negative when sent
+	Balance              int64           `json:"balance"`
+	Memo                 *string         `json:"memo"`
+}
+
+type DocumentSummary struct {
+	ClosingBalance int64 `json:"closingBalance"`
+	TotalIn        int64 `json:"totalIn"`
+	TotalOut       int64 `json:"totalOut"`
+	TransferCount  int64 `json:"transferCount"`
+}
+
+// writeDocument writes the document, filling in its summary. doc.Transfers
+// is left empty, as transfers are only ever held one at a time.
+func writeDocument(ctx context.Context, q *gensql.Queries, w io.Writer, stmt *accounts.Statement, doc *Document) error {
+	header, err := json.Marshal(doc.Statement)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `{"statement":%s,"transfers":[`, header); err != nil {
+		return err
+	}
+
+	err = stmt.Each(ctx, q, func(row accounts.StatementRow) error {
+		data, err := json.Marshal(DocumentTransfer{
+			TransferID:           row.TransferID,
+			CreatedAt:            row.CreatedAt.UTC(),
+			Code:                 row.Code,
+			CounterpartyID:       row.CounterpartyID,
+			CounterpartyAddress:  row.CounterpartyAddress,
+			CounterpartyUsername: row.CounterpartyUsername,
+			Amount:               row.Amount,
+			Balance:              row.Balance,
+			Memo:                 row.Memo,
+		})
+		if err != nil {
+			return err
+		}
+		if doc.Summary.TransferCount > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+
+		if row.Amount > 0 {
+			doc.Summary.TotalIn += row.Amount
+		} else {
+			doc.Summary.TotalOut -= row.Amount
+		}
+		doc.Summary.TransferCount++
+		doc.Summary.ClosingBalance = row.Balance
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	summary, err := json.Marshal(doc.Summary)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `],"summary":%s}`+"\n", summary)
+	return err
+}
+
+// MonthStart is the start of the month (UTC) t is in.
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *Service) log(level logger.Level, msg string, data map[string]any) {
+	if s.lgr == nil {
+		return
+	}
+	_ = s.lgr.Log(logger.Log{
+		Message: msg,
+		Data:    data,
+		Level:   level,
+	})
+}
@@ -0,0 +1,222 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stelofinance/stelofinance/database/gensql"
+)
+
+const (
+	DLQStreamName = "WEBHOOKS_DLQ"
+	dlqSubjects   = "webhooks.dlq.>"
+	dlqMaxAge     = 90 * 24 * time.Hour
+)
+
+var ErrDeadLetterNotFound = errors.New("webhooks: dead letter not found")
+var ErrEndpointUnavailable = errors.New("webhooks: endpoint deleted or disabled")
+
+// DeadLetter is a delivery job that ran out of attempts, kept in the
+// WEBHOOKS_DLQ stream until it's replayed or discarded.
+type DeadLetter struct {
+	ID       uint64            `json:"id"` // Sequence in the DLQ stream
+	Job      DeliveryJob       `json:"job"`
+	Failures []DeliveryFailure `json:"failures"` // Oldest first
+	DeadAt   time.Time         `json:"deadAt"`
+}
+
+type DeliveryFailure struct {
+	Attempt    int64     `json:"attempt"`
+	StatusCode *int64    `json:"statusCode"`
+	Error      *string   `json:"error"`
+	LatencyMs  int64     `json:"latencyMs"`
+	At         time.Time `json:"at"`
+}
+
+func dlqSubject(accountID int64) string {
+	return "webhooks.dlq." + strconv.FormatInt(accountID, 10)
+}
+
+func (s *Service) ensureDLQ(ctx context.Context) error {
+	stream, err := s.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      DLQStreamName,
+		Subjects:  []string{dlqSubjects},
+		Retention: jetstream.LimitsPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    dlqMaxAge,
+		Replicas:  1,
+	})
+	if err != nil {
+		return fmt.Errorf("webhooks: create dlq stream: %w", err)
+	}
+	s.dlq = stream
+	return nil
+}
+
+// deadLetter moves an exhausted job into the DLQ, with its failed attempts
+// from the delivery log (or only the last one, for legacy jobs).
+func (s *Service) deadLetter(ctx context.Context, msg jetstream.Msg, job DeliveryJob, attempt uint64, res deliveryResult, deliverErr error) error {
+	dl := DeadLetter{
+		Job:    job,
+		DeadAt: time.Now(),
+	}
+
+	if job.EndpointID != 0 {
+		attempts, err := s.db.Q.GetWebhookDeliveryAttempts(ctx, gensql.GetWebhookDeliveryAttemptsParams{
+			EndpointID: job.EndpointID,
+			EventID:    job.eventID(),
+			Limit:      int64(attempt),
+		})
+		if err != nil {
+			return err
+		}
+		for _, a := range slices.Backward(attempts) {
+			dl.Failures = append(dl.Failures, DeliveryFailure{
+				Attempt:    a.Attempt,
+				StatusCode: a.StatusCode,
+				Error:      a.Error,
+				LatencyMs:  a.LatencyMs,
+				At:         a.CreatedAt,
+			})
+		}
+	} else {
+		f := DeliveryFailure{
+			Attempt:   int64(attempt),
+			LatencyMs: res.latency.Milliseconds(),
+			At:        dl.DeadAt,
+		}
+		if res.status != 0 {
+			status := int64(res.status)
+			f.StatusCode = &status
+		}
+		if deliverErr != nil {
+			e := deliverErr.Error()
+			f.Error = &e
+		}
+		dl.Failures = append(dl.Failures, f)
+	}
+
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	// Dedupe on the job, in case acking it fails after the move
+	opts := []jetstream.PublishOpt{}
+	if meta, err := msg.Metadata(); err == nil {
+		opts = append(opts, jetstream.WithMsgID(fmt.Sprintf("dlq-%d", meta.Sequence.Stream)))
+	}
+	_, err = s.js.Publish(ctx, dlqSubject(job.AccountID), data, opts...)
+	return err
+}
+
+// DeadLetters lists dead letters after the given ID, oldest first. An
+// accountID of zero lists them for all accounts.
+func (s *Service) DeadLetters(ctx context.Context, accountID int64, after uint64, limit int) ([]DeadLetter, error) {
+	filter := dlqSubjects
+	if accountID != 0 {
+		filter = dlqSubject(accountID)
+	}
+
+	dls := make([]DeadLetter, 0, limit)
+	seq := after + 1
+	for len(dls) < limit {
+		msg, err := s.dlq.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(filter))
+		if err != nil {
+			if errors.Is(err, jetstream.ErrMsgNotFound) {
+				break
+			}
+			return nil, err
+		}
+		seq = msg.Sequence + 1
+
+		var dl DeadLetter
+		if err := json.Unmarshal(msg.Data, &dl); err != nil {
+			continue
+		}
+		dl.ID = msg.Sequence
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+// DeadLetter gets a dead letter, which must belong to accountID unless it's
+// zero.
+func (s *Service) DeadLetter(ctx context.Context, accountID int64, id uint64) (DeadLetter, error) {
+	var dl DeadLetter
+	msg, err := s.dlq.GetMsg(ctx, id)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return dl, ErrDeadLetterNotFound
+		}
+		return dl, err
+	}
+	if accountID != 0 && msg.Subject != dlqSubject(accountID) {
+		return dl, ErrDeadLetterNotFound
+	}
+
+	if err := json.Unmarshal(msg.Data, &dl); err != nil {
+		return dl, err
+	}
+	dl.ID = msg.Sequence
+	return dl, nil
+}
+
+// ReplayDeadLetter queues the dead letter's job again with a fresh set of
+// attempts, at its endpoint's current URL, and removes it from the DLQ.
+func (s *Service) ReplayDeadLetter(ctx context.Context, accountID int64, id uint64) error {
+	dl, err := s.DeadLetter(ctx, accountID, id)
+	if err != nil {
+		return err
+	}
+
+	job := dl.Job
+	if job.EndpointID != 0 {
+		e, err := s.db.Q.GetWebhookEndpointById(ctx, job.EndpointID)
+		if err == nil && e.Enabled == 0 {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrEndpointUnavailable
+			}
+			return err
+		}
+		job.URL = e.Url
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// Ordered endpoints get it back in line behind their queued jobs
+	subject, err := s.jobSubject(ctx, job.EndpointID)
+	if err != nil {
+		return fmt.Errorf("webhooks: get endpoint: %w", err)
+	}
+	_, err = s.js.Publish(ctx, subject, data, jetstream.WithMsgID(fmt.Sprintf("dlq-replay-%d", id)))
+	if err != nil {
+		return fmt.Errorf("webhooks: publish: %w", err)
+	}
+	if subject != Subject {
+		s.startOrdered(job.EndpointID)
+	}
+
+	return s.dlq.DeleteMsg(ctx, id)
+}
+
+// DiscardDeadLetter removes the dead letter from the DLQ without delivering
+// it.
+func (s *Service) DiscardDeadLetter(ctx context.Context, accountID int64, id uint64) error {
+	if _, err := s.DeadLetter(ctx, accountID, id); err != nil {
+		return err
+	}
+	return s.dlq.DeleteMsg(ctx, id)
+}
@@ -0,0 +1,122 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhooks can only be sent to these schemes and ports, unless private
+// addresses are allowed (for testing against localhost), which allows any
+// port.
+var (
+	allowedSchemes = []string{"https", "http"}
+	allowedPorts   = []uint16{443, 80, 8443, 8080}
+)
+
+var ErrAddressBlocked = errors.New("webhooks: address not allowed")
+
+// Addresses that aren't on the public internet, or are special use, such as
+// cloud metadata services (169.254.169.254, fd00:ec2::254) or Fly's private
+// network (fdaa::/16).
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+func blockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURL ensures a webhook URL's scheme and port are allowed. Its host is
+// checked when it's dialed.
+func checkURL(u *url.URL, allowPrivate bool) error {
+	if !slices.Contains(allowedSchemes, u.Scheme) {
+		return fmt.Errorf("%w: scheme %q", ErrAddressBlocked, u.Scheme)
+	}
+	if allowPrivate || u.Port() == "" {
+		return nil
+	}
+
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || !slices.Contains(allowedPorts, uint16(port)) {
+		return fmt.Errorf("%w: port %s", ErrAddressBlocked, u.Port())
+	}
+	return nil
+}
+
+// newClient makes the client webhooks are sent with. It checks the address
+// of every connection it makes once resolved, so hostnames can't be
+// (re)pointed at internal addresses, and never uses a proxy, which would be
+// dialed instead.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrAddressBlocked, address)
+			}
+			if allowPrivate {
+				return nil
+			}
+			if blockedAddr(addr.Addr()) || !slices.Contains(allowedPorts, addr.Port()) {
+				return fmt.Errorf("%w: %s", ErrAddressBlocked, address)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: httpTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
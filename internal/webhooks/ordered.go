@@ -0,0 +1,166 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stelofinance/stelofinance/internal/logger"
+)
+
+// startOrdered has the worker consume the ordered endpoint's jobs, if it
+// isn't already.
+func (s *Service) startOrdered(endpointID int64) {
+	select {
+	case s.orderedStart <- endpointID:
+	default:
+		// Started on the next refresh instead
+	}
+}
+
+// runOrdered runs a consumer for every ordered endpoint, and every endpoint
+// that still has ordered jobs queued, until ctx is cancelled. Consumers are
+// removed once their endpoint isn't ordered and its jobs are done.
+func (s *Service) runOrdered(ctx context.Context) {
+	running := make(map[int64]context.CancelFunc)
+	start := func(endpointID int64) {
+		if _, ok := running[endpointID]; ok {
+			return
+		}
+		consumerCtx, cancel := context.WithCancel(ctx)
+		running[endpointID] = cancel
+		go s.consumeOrdered(consumerCtx, endpointID)
+	}
+
+	ticker := time.NewTicker(orderedRefresh)
+	defer ticker.Stop()
+
+	for {
+		if err := s.refreshOrdered(ctx, running, start); err != nil && ctx.Err() == nil {
+			s.log(logger.WarnLevel, "webhooks: refreshing ordered consumers failed", map[string]any{
+				"error": err.Error(),
+			})
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case endpointID := <-s.orderedStart:
+				start(endpointID)
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+func (s *Service) refreshOrdered(ctx context.Context, running map[int64]context.CancelFunc, start func(int64)) error {
+	ids, err := s.db.Q.GetOrderedWebhookEndpointIds(ctx)
+	if err != nil {
+		return err
+	}
+	ordered := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		ordered[id] = true
+		start(id)
+	}
+
+	stream, err := s.js.Stream(ctx, StreamName)
+	if err != nil {
+		return err
+	}
+	info, err := stream.Info(ctx, jetstream.WithSubjectFilter(orderedSubjects))
+	if err != nil {
+		return err
+	}
+	queued := make(map[int64]bool, len(info.State.Subjects))
+	for subject := range info.State.Subjects {
+		id, err := strconv.ParseInt(strings.TrimPrefix(subject, "webhooks.ordered."), 10, 64)
+		if err != nil {
+			continue
+		}
+		queued[id] = true
+		start(id)
+	}
+
+	// Remove consumers with nothing left to do, including ones left by a
+	// previous run
+	stale := make(map[int64]bool)
+	for id := range running {
+		stale[id] = true
+	}
+	names := stream.ConsumerNames(ctx)
+	for name := range names.Name() {
+		id, err := strconv.ParseInt(strings.TrimPrefix(name, orderedConsumerPrefix), 10, 64)
+		if err == nil && strings.HasPrefix(name, orderedConsumerPrefix) {
+			stale[id] = true
+		}
+	}
+	if err := names.Err(); err != nil {
+		return err
+	}
+	for id := range stale {
+		if ordered[id] || queued[id] {
+			continue
+		}
+		if cancel, ok := running[id]; ok {
+			cancel()
+			delete(running, id)
+		}
+		err := stream.DeleteConsumer(ctx, orderedConsumerPrefix+strconv.FormatInt(id, 10))
+		if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumeOrdered delivers the endpoint's ordered jobs one at a time until ctx
+// is cancelled. The consumer only lets one job be in flight, so a failing
+// job is retried before any later ones are delivered.
+func (s *Service) consumeOrdered(ctx context.Context, endpointID int64) {
+	cfg := consumerConfig(orderedConsumerPrefix+strconv.FormatInt(endpointID, 10), orderedSubject(endpointID))
+	cfg.MaxAckPending = 1
+
+	var cons jetstream.Consumer
+	for cons == nil {
+		var err error
+		cons, err = s.js.CreateOrUpdateConsumer(ctx, StreamName, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.log(logger.WarnLevel, "webhooks: create ordered consumer failed", map[string]any{
+				"error":      err.Error(),
+				"endpointId": endpointID,
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(orderedRefresh):
+			}
+		}
+	}
+
+	for ctx.Err() == nil {
+		msgs, err := cons.Fetch(1, jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		for msg := range msgs.Messages() {
+			s.sem <- struct{}{}
+			s.handleMsg(ctx, msg)
+			<-s.sem
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/stelofinance/stelofinance/database/gensql"
+	"github.com/stelofinance/stelofinance/internal/accounts"
+)
+
+const (
+	contentTypeJSON        = "application/json"
+	contentTypeCloudEvents = "application/cloudevents+json; charset=utf-8"
+
+	cloudEventsTypePrefix = "finance.stelo."
+)
+
+// TransferPayloadV2 is what's sent for transfers to endpoints on payload
+// version 2.
+type TransferPayloadV2 struct {
+	Version   int                        `json:"version"` // Always 2
+	Type      string                     `json:"type"`    // transfer.incoming or transfer.outgoing
+	ID        int64                      `json:"id"`
+	Direction accounts.TransferDirection `json:"direction"`
+	Amount    int64                      `json:"amount"`
+	Code      accounts.TrCode            `json:"code"`
+	Memo      *string                    `json:"memo"`
+	Metadata  map[string]string          `json:"metadata"`
+	Sender    accounts.TransferParty     `json:"sender"`
+	Receiver  accounts.TransferParty     `json:"receiver"`
+	Ledger    accounts.TransferLedger    `json:"ledger"`
+	// Of the endpoint's account after the transfer. Null for the few
+	// deliveries queued before it was recorded
+	Balance   *int64    `json:"balance"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CloudEvent is the structured mode CloudEvents 1.0 envelope, for endpoints
+// that want one.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"` // Always "1.0"
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+}
+
+// jobPayload is the body for the job, in the endpoint's format.
+func (s *Service) jobPayload(ctx context.Context, job DeliveryJob, endpoint *gensql.WebhookEndpoint) ([]byte, string, error) {
+	if job.Permission != nil && endpoint != nil {
+		return permissionPayload(*endpoint, *job.Permission)
+	}
+	return s.transferPayload(ctx, job, endpoint)
+}
+
+// transferPayload is the body for the job's transfer, in the endpoint's
+// format. Jobs without an endpoint get version 1.
+func (s *Service) transferPayload(ctx context.Context, job DeliveryJob, endpoint *gensql.WebhookEndpoint) ([]byte, string, error) {
+	if endpoint == nil {
+		body, err := json.Marshal(job.Event)
+		return body, contentTypeJSON, err
+	}
+
+	var data any = job.Event
+	if endpoint.PayloadVersion == accounts.WebhookPayloadV2 {
+		p, err := s.transferPayloadV2(ctx, job)
+		if err != nil {
+			return nil, "", err
+		}
+		data = p
+	}
+
+	if endpoint.Cloudevents == 0 {
+		body, err := json.Marshal(data)
+		return body, contentTypeJSON, err
+	}
+
+	direction := accounts.TransferIncoming
+	if sender, _ := accounts.DetermineSenderReceiver(job.Event.Code, job.Event.CreditAccId, job.Event.DebitAccId); sender == job.AccountID {
+		direction = accounts.TransferOutgoing
+	}
+	return cloudEvent(CloudEvent{
+		ID:     job.eventID(),
+		Source: accountSource(job.AccountID),
+		Type:   cloudEventsTypePrefix + "transfer." + string(direction) + ".v" + strconv.FormatInt(endpoint.PayloadVersion, 10),
+		Time:   job.Event.CreatedAt,
+		Data:   data,
+	})
+}
+
+func (s *Service) transferPayloadV2(ctx context.Context, job DeliveryJob) (TransferPayloadV2, error) {
+	var balance *int64
+	if job.Details != nil {
+		balance = &job.Details.Balance
+	} else {
+		details, err := accounts.TransferDetailsFor(ctx, s.db.Q, job.Event, job.AccountID)
+		if err != nil {
+			return TransferPayloadV2{}, fmt.Errorf("webhooks: load transfer details: %w", err)
+		}
+		job.Details = &details
+	}
+	return newTransferPayloadV2(job.Event, *job.Details, balance), nil
+}
+
+func newTransferPayloadV2(e accounts.EventTransfer, d accounts.TransferDetails, balance *int64) TransferPayloadV2 {
+	metadata := e.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return TransferPayloadV2{
+		Version:   accounts.WebhookPayloadV2,
+		Type:      "transfer." + string(d.Direction),
+		ID:        e.ID,
+		Direction: d.Direction,
+		Amount:    e.Amount,
+		Code:      e.Code,
+		Memo:      e.Memo,
+		Metadata:  metadata,
+		Sender:    d.Sender,
+		Receiver:  d.Receiver,
+		Ledger:    d.Ledger,
+		Balance:   balance,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// permissionPayload is the body for a permission change, in the endpoint's
+// format. It's the same in every payload version.
+func permissionPayload(e gensql.WebhookEndpoint, event accounts.EventAccountPermission) ([]byte, string, error) {
+	if e.Cloudevents == 0 {
+		body, err := json.Marshal(event)
+		return body, contentTypeJSON, err
+	}
+	return cloudEvent(CloudEvent{
+		ID:     event.ID,
+		Source: accountSource(event.AccountId),
+		Type:   cloudEventsTypePrefix + string(event.Type),
+		Time:   event.CreatedAt,
+		Data:   event,
+	})
+}
+
+// pingPayload is the body for a PingEvent, in the endpoint's format.
+func pingPayload(e gensql.WebhookEndpoint, ping PingEvent) ([]byte, string, error) {
+	if e.Cloudevents == 0 {
+		body, err := json.Marshal(ping)
+		return body, contentTypeJSON, err
+	}
+	return cloudEvent(CloudEvent{
+		ID:     "ping-" + strconv.FormatInt(ping.CreatedAt.UnixNano(), 10),
+		Source: accountSource(e.AccountID),
+		Type:   cloudEventsTypePrefix + "ping",
+		Time:   ping.CreatedAt,
+		Data:   ping,
+	})
+}
+
+func cloudEvent(ce CloudEvent) ([]byte, string, error) {
+	ce.SpecVersion = "1.0"
+	ce.DataContentType = contentTypeJSON
+	body, err := json.Marshal(ce)
+	return body, contentTypeCloudEvents, err
+}
+
+func accountSource(accountID int64) string {
+	return "/accounts/" + strconv.FormatInt(accountID, 10)
+}
+
+// testTransferDetails makes up details for a test transfer with the account,
+// from a counterparty that doesn't exist.
+func (s *Service) testTransferDetails(ctx context.Context, accountID int64, direction accounts.TransferDirection) (accounts.TransferDetails, error) {
+	acc, err := s.db.Q.GetAccountAndLedgerById(ctx, accountID)
+	if err != nil {
+		return accounts.TransferDetails{}, err
+	}
+
+	self := accounts.TransferParty{
+		AccountId: acc.ID,
+		Address:   acc.Address,
+	}
+	other := accounts.TransferParty{Address: "test"}
+	d := accounts.TransferDetails{
+		Direction: direction,
+		Sender:    other,
+		Receiver:  self,
+		Ledger: accounts.TransferLedger{
+			Id:    acc.LedgerID,
+			Name:  acc.LedgerName,
+			Code:  acc.LedgerCode,
+			Scale: acc.AssetScale,
+		},
+	}
+	if direction == accounts.TransferOutgoing {
+		d.Sender, d.Receiver = self, other
+	}
+	return d, nil
+}
@@ -3,13 +3,19 @@ package webhooks
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stelofinance/stelofinance/database"
+	"github.com/stelofinance/stelofinance/database/gensql"
 	"github.com/stelofinance/stelofinance/internal/accounts"
 	"github.com/stelofinance/stelofinance/internal/logger"
 )
@@ -19,47 +25,86 @@ const (
 	Subject      = "webhooks.deliver"
 	ConsumerName = "webhook-deliverer"
 
+	// Jobs for ordered endpoints each get a subject, and a consumer that
+	// only has one of them in flight at a time
+	orderedSubjects       = "webhooks.ordered.>"
+	orderedConsumerPrefix = "webhook-ordered-"
+	orderedRefresh        = time.Minute
+
 	httpTimeout = 10 * time.Second
 	ackWait     = 45 * time.Second
 	maxDeliver  = 10
 	maxAge      = 7 * 24 * time.Hour
 	maxInFlight = 8
 	userAgent   = "Stelo-Webhooks/1.0"
+
+	SignatureHeader = "Stelo-Signature"
+	TestHeader      = "Stelo-Test" // Set on test events
+
+	// Delivery log
+	maxLoggedBody     = 2048
+	deliveryRetention = 30 * 24 * time.Hour
 )
 
+var ErrTestEventUnsupported = errors.New("webhooks: no test for event")
+
 // DeliveryJob is a durable webhook delivery task stored in JetStream.
 type DeliveryJob struct {
-	AccountID int64                  `json:"accountId"`
-	URL       string                 `json:"url"`
-	Event     accounts.EventTransfer `json:"event"`
+	AccountID int64 `json:"accountId"`
+	// Zero for jobs queued before accounts could have several endpoints,
+	// which are delivered unsigned
+	EndpointID int64                  `json:"endpointId,omitempty"`
+	URL        string                 `json:"url"`
+	Event      accounts.EventTransfer `json:"event"`
+	// Nil for jobs queued before payloads had versions
+	Details *accounts.TransferDetails `json:"details,omitempty"`
+	// Set instead of Event for permission.changed deliveries
+	Permission *accounts.EventAccountPermission `json:"permission,omitempty"`
+}
+
+// eventID identifies the job's event, like the id of its CloudEvent.
+func (job DeliveryJob) eventID() string {
+	if job.Permission != nil {
+		return job.Permission.ID
+	}
+	return "transfer-" + strconv.FormatInt(job.Event.ID, 10)
 }
 
 // Service enqueues transfer webhooks and runs the delivery worker.
 type Service struct {
 	js     jetstream.JetStream
+	dlq    jetstream.Stream
+	db     *database.Database
 	lgr    *logger.Logger
 	client *http.Client
+
+	allowPrivate bool
+
+	sem          chan struct{} // A slot per delivery in flight
+	orderedStart chan int64    // Ordered endpoints jobs were just queued for
 }
 
 // New creates a webhook service. Call Ensure before Enqueue or RunWorker.
-func New(js jetstream.JetStream, lgr *logger.Logger) *Service {
+// allowPrivate lets webhooks be sent to private addresses and any port, for
+// testing against localhost, and must never be set in production.
+func New(js jetstream.JetStream, db *database.Database, lgr *logger.Logger, allowPrivate bool) *Service {
 	return &Service{
-		js:  js,
-		lgr: lgr,
-		client: &http.Client{
-			Timeout: httpTimeout,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-		},
+		js:           js,
+		db:           db,
+		lgr:          lgr,
+		allowPrivate: allowPrivate,
+		client:       newClient(allowPrivate),
+		sem:          make(chan struct{}, maxInFlight),
+		orderedStart: make(chan int64, 64),
 	}
 }
 
-// Ensure creates or updates the WEBHOOKS stream and durable pull consumer.
+// Ensure creates or updates the WEBHOOKS stream and durable pull consumer,
+// and the WEBHOOKS_DLQ stream.
 func (s *Service) Ensure(ctx context.Context) error {
 	_, err := s.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
 		Name:      StreamName,
-		Subjects:  []string{Subject},
+		Subjects:  []string{Subject, orderedSubjects},
 		Retention: jetstream.WorkQueuePolicy,
 		Storage:   jetstream.FileStorage,
 		MaxAge:    maxAge,
@@ -69,49 +114,94 @@ func (s *Service) Ensure(ctx context.Context) error {
 		return fmt.Errorf("webhooks: create stream: %w", err)
 	}
 
-	_, err = s.js.CreateOrUpdateConsumer(ctx, StreamName, jetstream.ConsumerConfig{
-		Durable:       ConsumerName,
-		FilterSubject: Subject,
-		AckPolicy:     jetstream.AckExplicitPolicy,
-		AckWait:       ackWait,
-		MaxDeliver:    maxDeliver,
-		// Progressive redelivery delays after AckWait / explicit Nak.
-		// MaxDeliver is 10; last interval is reused for remaining attempts.
-		BackOff: []time.Duration{
-			time.Second,
-			5 * time.Second,
-			30 * time.Second,
-			2 * time.Minute,
-			5 * time.Minute,
-			15 * time.Minute,
-			30 * time.Minute,
-			time.Hour,
-			2 * time.Hour,
-		},
-	})
+	_, err = s.js.CreateOrUpdateConsumer(ctx, StreamName, consumerConfig(ConsumerName, Subject))
 	if err != nil {
 		return fmt.Errorf("webhooks: create consumer: %w", err)
 	}
-	return nil
+	return s.ensureDLQ(ctx)
 }
 
-// EnqueueTransferWebhook publishes a durable delivery job for one account webhook.
-// Implements accounts.WebhookEnqueuer.
-func (s *Service) EnqueueTransferWebhook(ctx context.Context, accountID int64, url string, event accounts.EventTransfer) error {
+// Progressive redelivery delays after AckWait / explicit Nak. The last
+// interval is reused for remaining attempts.
+var retryBackoff = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+}
+
+func consumerConfig(name, subject string) jetstream.ConsumerConfig {
+	return jetstream.ConsumerConfig{
+		Durable:       name,
+		FilterSubject: subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       ackWait,
+		// Jobs are moved to the DLQ after maxDeliver attempts by the worker,
+		// so the server must never give up on them itself.
+		MaxDeliver: -1,
+		BackOff:    retryBackoff,
+	}
+}
+
+func orderedSubject(endpointID int64) string {
+	return "webhooks.ordered." + strconv.FormatInt(endpointID, 10)
+}
+
+// EnqueueTransferWebhook publishes a durable delivery job for one webhook
+// endpoint. Implements accounts.WebhookEnqueuer.
+func (s *Service) EnqueueTransferWebhook(ctx context.Context, dedupeID string, accountID, endpointID int64, url string, transfer accounts.WebhookTransfer) error {
 	job := DeliveryJob{
-		AccountID: accountID,
-		URL:       url,
-		Event:     event,
+		AccountID:  accountID,
+		EndpointID: endpointID,
+		URL:        url,
+		Event:      transfer.EventTransfer,
+		Details:    transfer.Details,
 	}
+	return s.enqueue(ctx, dedupeID, job, map[string]any{
+		"transferId": transfer.ID,
+	})
+}
+
+// EnqueuePermissionWebhook publishes a durable delivery job for one webhook
+// endpoint. Implements accounts.WebhookEnqueuer.
+func (s *Service) EnqueuePermissionWebhook(ctx context.Context, dedupeID string, accountID, endpointID int64, url string, event accounts.EventAccountPermission) error {
+	job := DeliveryJob{
+		AccountID:  accountID,
+		EndpointID: endpointID,
+		URL:        url,
+		Permission: &event,
+	}
+	return s.enqueue(ctx, dedupeID, job, map[string]any{
+		"eventId": event.ID,
+	})
+}
+
+// enqueue publishes the job, with logData added to what's logged if it fails.
+func (s *Service) enqueue(ctx context.Context, dedupeID string, job DeliveryJob, logData map[string]any) error {
 	data, err := json.Marshal(job)
 	if err != nil {
 		return fmt.Errorf("webhooks: marshal job: %w", err)
 	}
 
+	subject, err := s.jobSubject(ctx, job.EndpointID)
+	if err != nil {
+		return fmt.Errorf("webhooks: get endpoint: %w", err)
+	}
+
 	var pubErr error
 	for attempt := range 3 {
-		_, pubErr = s.js.Publish(ctx, Subject, data)
+		// The outbox may enqueue a delivery more than once, so dedupe on
+		// its entry (redeliveries get their own)
+		_, pubErr = s.js.Publish(ctx, subject, data, jetstream.WithMsgID(dedupeID))
 		if pubErr == nil {
+			if subject != Subject {
+				s.startOrdered(job.EndpointID)
+			}
 			return nil
 		}
 		select {
@@ -121,15 +211,33 @@ func (s *Service) EnqueueTransferWebhook(ctx context.Context, accountID int64, u
 		}
 	}
 
-	s.log(logger.ErrorLevel, "webhooks: failed to enqueue delivery", map[string]any{
-		"error":      pubErr.Error(),
-		"transferId": event.ID,
-		"accountId":  accountID,
-		"url":        url,
-	})
+	logData["error"] = pubErr.Error()
+	logData["accountId"] = job.AccountID
+	logData["endpointId"] = job.EndpointID
+	logData["url"] = job.URL
+	s.log(logger.ErrorLevel, "webhooks: failed to enqueue delivery", logData)
 	return fmt.Errorf("webhooks: publish: %w", pubErr)
 }
 
+// jobSubject is the subject to queue the endpoint's jobs on.
+func (s *Service) jobSubject(ctx context.Context, endpointID int64) (string, error) {
+	if endpointID == 0 {
+		return Subject, nil
+	}
+	e, err := s.db.Q.GetWebhookEndpointById(ctx, endpointID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Acked without being delivered
+		return Subject, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if e.Ordered != 0 {
+		return orderedSubject(endpointID), nil
+	}
+	return Subject, nil
+}
+
 // RunWorker consumes webhook jobs and POSTs them until ctx is cancelled.
 func (s *Service) RunWorker(ctx context.Context) {
 	cons, err := s.js.Consumer(ctx, StreamName, ConsumerName)
@@ -140,7 +248,8 @@ func (s *Service) RunWorker(ctx context.Context) {
 		return
 	}
 
-	sem := make(chan struct{}, maxInFlight)
+	go s.pruneDeliveries(ctx)
+	go s.runOrdered(ctx)
 
 	for {
 		if ctx.Err() != nil {
@@ -162,10 +271,10 @@ func (s *Service) RunWorker(ctx context.Context) {
 				// Leave message unacked for redelivery after restart.
 				return
 			}
-			sem <- struct{}{}
+			s.sem <- struct{}{}
 			go func(m jetstream.Msg) {
-				defer func() { <-sem }()
-				s.handleMsg(m)
+				defer func() { <-s.sem }()
+				s.handleMsg(ctx, m)
 			}(msg)
 		}
 		if err := msgs.Error(); err != nil && ctx.Err() == nil {
@@ -176,7 +285,7 @@ func (s *Service) RunWorker(ctx context.Context) {
 	}
 }
 
-func (s *Service) handleMsg(msg jetstream.Msg) {
+func (s *Service) handleMsg(ctx context.Context, msg jetstream.Msg) {
 	var job DeliveryJob
 	if err := json.Unmarshal(msg.Data(), &job); err != nil {
 		s.log(logger.ErrorLevel, "webhooks: invalid job payload, terminating", map[string]any{
@@ -193,7 +302,33 @@ func (s *Service) handleMsg(msg jetstream.Msg) {
 		delivered = meta.NumDelivered
 	}
 
-	status, err := s.deliver(job)
+	// Endpoints removed or disabled since the transfer don't get it, though
+	// ones disabled for failing keep it in the DLQ, to replay once fixed
+	var endpoint *gensql.WebhookEndpoint
+	if job.EndpointID != 0 {
+		e, err := s.db.Q.GetWebhookEndpointById(ctx, job.EndpointID)
+		if err == nil && e.Enabled == 0 {
+			if e.DisabledReason != nil && s.deadLetter(ctx, msg, job, delivered, deliveryResult{}, nil) != nil {
+				_ = msg.NakWithDelay(backoffForAttempt(int(delivered)))
+				return
+			}
+			err = sql.ErrNoRows
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = msg.Ack()
+			return
+		}
+		if err == nil {
+			endpoint = &e
+		}
+	}
+
+	res, err := s.deliver(ctx, job, endpoint)
+	status := res.status
+	if endpoint != nil {
+		s.recordDelivery(ctx, job, delivered, res, err)
+		s.recordHealth(ctx, *endpoint, err == nil && status >= 200 && status < 300)
+	}
 	if err == nil && status >= 200 && status < 300 {
 		if ackErr := msg.Ack(); ackErr != nil {
 			s.log(logger.WarnLevel, "webhooks: ack failed", map[string]any{
@@ -218,7 +353,21 @@ func (s *Service) handleMsg(msg jetstream.Msg) {
 	}
 
 	if delivered >= uint64(maxDeliver) {
-		s.log(logger.ErrorLevel, "webhooks: max deliveries exhausted", data)
+		dlqErr := s.deadLetter(ctx, msg, job, delivered, res, err)
+		if dlqErr == nil {
+			s.log(logger.ErrorLevel, "webhooks: max deliveries exhausted, moved to dead letter queue", data)
+			if ackErr := msg.Ack(); ackErr != nil {
+				s.log(logger.WarnLevel, "webhooks: ack failed", map[string]any{
+					"error":      ackErr.Error(),
+					"transferId": job.Event.ID,
+					"accountId":  job.AccountID,
+				})
+			}
+			return
+		}
+		// Keep retrying the job until it can be moved
+		data["dlqError"] = dlqErr.Error()
+		s.log(logger.ErrorLevel, "webhooks: moving to dead letter queue failed", data)
 	} else {
 		s.log(logger.WarnLevel, "webhooks: delivery failed, will retry", data)
 	}
@@ -232,47 +381,271 @@ func (s *Service) handleMsg(msg jetstream.Msg) {
 	}
 }
 
-func (s *Service) deliver(job DeliveryJob) (status int, err error) {
-	body, err := json.Marshal(job.Event)
+type deliveryResult struct {
+	body     []byte // What was sent
+	status   int    // Zero when there was no response
+	latency  time.Duration
+	respBody string // Truncated to maxLoggedBody
+}
+
+func (s *Service) deliver(ctx context.Context, job DeliveryJob, endpoint *gensql.WebhookEndpoint) (deliveryResult, error) {
+	if endpoint == nil && job.EndpointID != 0 {
+		body, _ := json.Marshal(job.Event)
+		return deliveryResult{body: body}, fmt.Errorf("webhooks: endpoint %d could not be loaded", job.EndpointID)
+	}
+	body, contentType, err := s.jobPayload(ctx, job, endpoint)
+	if err != nil {
+		return deliveryResult{}, err
+	}
+	return s.post(ctx, job.URL, body, contentType, endpoint, false)
+}
+
+// PingEvent is sent to test an endpoint, never for anything real.
+type PingEvent struct {
+	Type      string    `json:"type"` // Always "ping"
+	Test      bool      `json:"test"` // Always true
+	WebhookID int64     `json:"webhookId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type TestResult struct {
+	StatusCode   int // Zero when there was no response
+	Latency      time.Duration
+	ResponseBody string // Truncated to maxLoggedBody
+}
+
+// Ping sends the endpoint a PingEvent, see Test.
+func (s *Service) Ping(ctx context.Context, e gensql.WebhookEndpoint) (TestResult, error) {
+	return s.Test(ctx, e, accounts.WebhookEventNone)
+}
+
+// Test sends the endpoint a test event the same way as deliveries, in its
+// payload format, and returns how it responded. With no event it's a
+// PingEvent, otherwise a made up transfer with an ID of 0, or permission
+// change for a user with an ID of 0. Tests have the TestHeader set, aren't
+// logged or retried, and are sent to disabled endpoints too.
+func (s *Service) Test(ctx context.Context, e gensql.WebhookEndpoint, event accounts.WebhookEvent) (TestResult, error) {
+	var body []byte
+	var contentType string
+	var err error
+	switch event {
+	case accounts.WebhookEventNone:
+		body, contentType, err = pingPayload(e, PingEvent{
+			Type:      "ping",
+			Test:      true,
+			WebhookID: e.ID,
+			CreatedAt: time.Now(),
+		})
+	case accounts.WebhookEventTransferIncoming, accounts.WebhookEventTransferOutgoing:
+		memo := "Stelo webhook test"
+		tr := accounts.EventTransfer{
+			Amount:    100,
+			Code:      accounts.TrLiability,
+			Memo:      &memo,
+			Metadata:  map[string]string{"test": "true"},
+			CreatedAt: time.Now(),
+		}
+		// Liability transfers credit the receiver
+		direction := accounts.TransferIncoming
+		if event == accounts.WebhookEventTransferIncoming {
+			tr.CreditAccId = e.AccountID
+		} else {
+			tr.DebitAccId = e.AccountID
+			direction = accounts.TransferOutgoing
+		}
+
+		var details accounts.TransferDetails
+		details, err = s.testTransferDetails(ctx, e.AccountID, direction)
+		if err != nil {
+			return TestResult{}, err
+		}
+		body, contentType, err = s.transferPayload(ctx, DeliveryJob{
+			AccountID:  e.AccountID,
+			EndpointID: e.ID,
+			URL:        e.Url,
+			Event:      tr,
+			Details:    &details,
+		}, &e)
+	case accounts.WebhookEventPermission:
+		var userId int64
+		perms := int64(accounts.PermAdmin)
+		body, contentType, err = permissionPayload(e, accounts.EventAccountPermission{
+			ID:          "evt_test",
+			Type:        accounts.PermissionCreated,
+			AccountId:   e.AccountID,
+			UserId:      &userId,
+			Permissions: &perms,
+			CreatedAt:   time.Now(),
+		})
+	default:
+		return TestResult{}, ErrTestEventUnsupported
+	}
 	if err != nil {
-		return 0, err
+		return TestResult{}, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, job.URL, bytes.NewReader(body))
+	res, err := s.post(ctx, e.Url, body, contentType, &e, true)
+	return TestResult{
+		StatusCode:   res.status,
+		Latency:      res.latency,
+		ResponseBody: res.respBody,
+	}, err
+}
+
+// post sends body to url, signed when there's an endpoint (legacy jobs have
+// none).
+func (s *Service) post(ctx context.Context, url string, body []byte, contentType string, endpoint *gensql.WebhookEndpoint, test bool) (res deliveryResult, err error) {
+	res.body = body
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return 0, err
+		return res, err
+	}
+	if err := checkURL(req.URL, s.allowPrivate); err != nil {
+		return res, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("User-Agent", userAgent)
+	if test {
+		req.Header.Set(TestHeader, "true")
+	}
+
+	// Signed with the endpoint's secret at delivery time, so retries pick up
+	// rotations
+	if endpoint != nil {
+		req.Header.Set(SignatureHeader, accounts.WebhookSignatureHeader(*endpoint, time.Now(), body))
+	}
 
+	start := time.Now()
 	resp, err := s.client.Do(req)
+	res.latency = time.Since(start)
 	if err != nil {
-		return 0, err
+		return res, err
 	}
 	defer resp.Body.Close()
+	res.status = resp.StatusCode
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody))
+	res.respBody = strings.ToValidUTF8(string(respBody), "")
 	_, _ = io.Copy(io.Discard, resp.Body)
 
-	return resp.StatusCode, nil
+	return res, nil
+}
+
+// recordDelivery adds the attempt to the endpoint's delivery log.
+func (s *Service) recordDelivery(ctx context.Context, job DeliveryJob, attempt uint64, res deliveryResult, deliverErr error) {
+	params := gensql.InsertWebhookDeliveryParams{
+		EndpointID:  job.EndpointID,
+		AccountID:   job.AccountID,
+		EventID:     job.eventID(),
+		Attempt:     int64(attempt),
+		Url:         job.URL,
+		RequestBody: string(res.body),
+		LatencyMs:   res.latency.Milliseconds(),
+		CreatedAt:   time.Now(),
+	}
+	if res.status != 0 {
+		status := int64(res.status)
+		params.StatusCode = &status
+		params.ResponseBody = &res.respBody
+	}
+	// Kept so redeliveries can be sent in the endpoint's format at the time
+	var payload []byte
+	var err error
+	if job.Permission != nil {
+		payload, err = json.Marshal(accounts.WebhookPermission{Permission: job.Permission})
+	} else {
+		params.TransferID = &job.Event.ID
+		payload, err = json.Marshal(accounts.WebhookTransfer{
+			EventTransfer: job.Event,
+			Details:       job.Details,
+		})
+	}
+	if err == nil {
+		p := string(payload)
+		params.Payload = &p
+	}
+	if deliverErr != nil {
+		msg := deliverErr.Error()
+		if len(msg) > maxLoggedBody {
+			msg = msg[:maxLoggedBody]
+		}
+		params.Error = &msg
+	}
+
+	if err := s.db.Q.InsertWebhookDelivery(ctx, params); err != nil {
+		s.log(logger.WarnLevel, "webhooks: recording delivery failed", map[string]any{
+			"error":      err.Error(),
+			"eventId":    job.eventID(),
+			"endpointId": job.EndpointID,
+		})
+	}
+}
+
+// recordHealth tracks the endpoint's failure streak, and announces it being
+// disabled when it gets too long.
+func (s *Service) recordHealth(ctx context.Context, e gensql.WebhookEndpoint, ok bool) {
+	streak, disabled, err := accounts.RecordWebhookAttempt(ctx, s.db.Q, e, ok)
+	if err != nil {
+		s.log(logger.WarnLevel, "webhooks: recording endpoint health failed", map[string]any{
+			"error":      err.Error(),
+			"endpointId": e.ID,
+		})
+		return
+	}
+	if !disabled {
+		return
+	}
+
+	s.log(logger.WarnLevel, "webhooks: endpoint disabled after failing", map[string]any{
+		"endpointId":    e.ID,
+		"accountId":     e.AccountID,
+		"url":           e.Url,
+		"failureStreak": streak,
+	})
+	err = accounts.PublishEvent(s.js.Conn(), accounts.EventWebhookDisabled{
+		WebhookID:     e.ID,
+		AccountId:     e.AccountID,
+		Url:           e.Url,
+		FailureStreak: streak,
+		DisabledAt:    time.Now(),
+	})
+	if err != nil {
+		s.log(logger.WarnLevel, "webhooks: publishing endpoint disabled failed", map[string]any{
+			"error":      err.Error(),
+			"endpointId": e.ID,
+		})
+	}
+}
+
+// pruneDeliveries removes delivery log entries older than deliveryRetention,
+// every hour until ctx is cancelled.
+func (s *Service) pruneDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		_, err := s.db.Q.DeleteWebhookDeliveriesBefore(ctx, time.Now().Add(-deliveryRetention))
+		if err != nil && ctx.Err() == nil {
+			s.log(logger.WarnLevel, "webhooks: pruning delivery log failed", map[string]any{
+				"error": err.Error(),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func backoffForAttempt(attempt int) time.Duration {
 	// attempt is NumDelivered (1-based on first failure path after first try).
-	delays := []time.Duration{
-		time.Second,
-		5 * time.Second,
-		30 * time.Second,
-		2 * time.Minute,
-		5 * time.Minute,
-		15 * time.Minute,
-		30 * time.Minute,
-		time.Hour,
-		2 * time.Hour,
-	}
 	idx := max(attempt-1, 0)
-	if idx >= len(delays) {
-		return delays[len(delays)-1]
+	if idx >= len(retryBackoff) {
+		return retryBackoff[len(retryBackoff)-1]
 	}
-	return delays[idx]
+	return retryBackoff[idx]
 }
 
 func (s *Service) log(level logger.Level, msg string, data map[string]any) {
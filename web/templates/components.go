@@ -64,3 +64,30 @@ func (*ComponentTransferRecipient) TemplateText() string { return tmplComponentT
 
 // Standalone compile for Datastar SSE patches of #recipient-input.
 var TransferRecipientTmpl = tmpl.MustCompile(&ComponentTransferRecipient{})
+
+//go:embed components/app-transfers-list.html.tmpl
+var tmplComponentAppTransfersList string
+
+// ComponentAppTransfersList is a page of the app transfers list.
+// Also compiled standalone for Datastar patches into #transfers.
+type ComponentAppTransfersList struct {
+	Transfers []PageAppTransfersTransfer
+	BeforeId  int64 // Cursor for "load more", 0 when there's nothing older
+}
+
+type PageAppTransfersTransfer struct {
+	Id          int64
+	Received    bool
+	DisplayTime string
+	From        string
+	To          string
+	QtyFmtd     string
+	LedgerName  string
+	Memo        string
+	InitiatedBy string
+}
+
+func (*ComponentAppTransfersList) TemplateText() string { return tmplComponentAppTransfersList }
+
+// Standalone compile for Datastar SSE patches into #transfers.
+var AppTransfersListTmpl = tmpl.MustCompile(&ComponentAppTransfersList{})
@@ -92,16 +92,49 @@ type PageAppAccount struct {
 	LedgerName  string
 	IsAdmin     bool
 	IsPrimary   bool
+	IsPrivate   bool
 	UserId      int64
 	Users       []PageAppAccountUser
 	TotalTokens int
 	Token       string
+	TokenId     string // Shown on transfers the token makes
+	Webhooks    []PageAppAccountWebhook
+	Deliveries  []PageAppAccountDelivery
+	Statements  []PageAppAccountStatement
 }
 type PageAppAccountUser struct {
 	UserId   int64
 	APId     int64
 	Username string
 }
+type PageAppAccountWebhook struct {
+	Id             int64
+	Url            string
+	Events         string
+	Enabled        bool
+	Ordered        bool
+	PayloadVersion int64
+	CloudEvents    bool
+	Health         string // healthy, degraded or disabled
+	Secret         string // Set when the secret was just rotated
+	TestResult     string // Set when it was just tested
+}
+type PageAppAccountDelivery struct {
+	Id        int64
+	WebhookId int64
+	Url       string
+	Status    string // Response status code, or the error if there wasn't one
+	Ok        bool
+	Latency   string
+	Time      string
+}
+type PageAppAccountStatement struct {
+	Id       int64
+	Period   string // e.g. 2024-01
+	Opening  string
+	Closing  string
+	Adjusted bool // Opening balance differs from the previous closing balance
+}
 
 func (PageAppAccount) TemplateText() string { return tmplPageAppAccount }
 
@@ -115,7 +148,8 @@ type PageAppTransfers struct {
 	RecipientInput  ComponentTransferRecipient `tmpl:"components/transfer-recipient"`
 	SelectedAccount PageAppTransfersSelectedAccount
 	Accounts        []PageAppTransfersAccount
-	Transfers       []PageAppTransfersTransfer
+	List            ComponentAppTransfersList `tmpl:"components/app-transfers-list"`
+	NewestId        int64                     // Live updates prepend transfers after this
 }
 
 type PageAppTransfersSelectedAccount struct {
@@ -130,17 +164,6 @@ type PageAppTransfersAccount struct {
 	Label string
 }
 
-type PageAppTransfersTransfer struct {
-	Id          int64
-	Received    bool
-	DisplayTime string
-	From        string
-	To          string
-	QtyFmtd     string
-	LedgerName  string
-	Memo        string
-}
-
 func (PageAppTransfers) TemplateText() string { return tmplPageAppTransfers }
 
 var AppTransfers = tmpl.MustCompile(&LayoutPrimary[PageAppTransfers]{})
@@ -156,6 +179,10 @@ type PageAppRequest struct {
 	RecipientFmtd  string
 	Recipient      int64
 	Memo           string
+	InvoiceToken   string // Set when paying an invoice
+	InvoiceStatus  string
+	CancelUrl      string // Checkout session links back to the merchant
+	ReturnUrl      string
 	PrimaryAccount PageAppRequestAccount
 	Accounts       []PageAppRequestAccount
 }
@@ -26,7 +26,10 @@ import (
 	"github.com/stelofinance/stelofinance/database/gensql"
 	"github.com/stelofinance/stelofinance/internal/accounts"
 	"github.com/stelofinance/stelofinance/internal/logger"
+	midware "github.com/stelofinance/stelofinance/internal/middlewares"
+	"github.com/stelofinance/stelofinance/internal/outbox"
 	"github.com/stelofinance/stelofinance/internal/routes"
+	"github.com/stelofinance/stelofinance/internal/statements"
 	"github.com/stelofinance/stelofinance/internal/webhooks"
 
 	_ "modernc.org/sqlite"
@@ -91,22 +94,45 @@ func Run(ctx context.Context, getenv func(string) string, stdout, stderr io.Writ
 		return err
 	}
 
+	// Connect up db and create db struct
+	dbConn, err := sql.Open("sqlite", getenv("DB_FILE"))
+	if err != nil {
+		return err
+	}
+	db := database.New(dbConn, gensql.New(dbConn))
+
 	// Durable transfer webhook delivery (JetStream work queue)
-	webhookSvc := webhooks.New(js, lgr)
+	// Private addresses can only be allowed outside of prod, for testing
+	// webhooks against localhost
+	allowPrivateWebhooks := getenv("ENV") != "prod" && getenv("WEBHOOKS_ALLOW_PRIVATE") == "true"
+	webhookSvc := webhooks.New(js, db, lgr, allowPrivateWebhooks)
 	if err := webhookSvc.Ensure(ctx); err != nil {
 		return err
 	}
 	go webhookSvc.RunWorker(ctx)
 
-	// Connect up db and create db struct
-	dbConn, err := sql.Open("sqlite", getenv("DB_FILE"))
+	// Monthly statements, archived in a JetStream object store
+	statementSvc := statements.New(db, lgr)
+	statementsOS, err := statementSvc.Ensure(ctx, js)
 	if err != nil {
 		return err
 	}
-	db := database.New(dbConn, gensql.New(dbConn))
+	go statementSvc.Run(ctx)
+
+	// Publishes transfer events, admin audit events and webhook deliveries
+	// committed to the outbox
+	transfersStream, err := outbox.EnsureStream(ctx, js)
+	if err != nil {
+		return err
+	}
+	if _, err := outbox.EnsureAuditStream(ctx, js); err != nil {
+		return err
+	}
+	relay := outbox.New(db, js, webhookSvc, lgr)
+	go relay.Run(ctx)
 
 	// Create and run server
-	srv := NewServer(lgr, db, sessionsKV, nc, webhookSvc, getenv)
+	srv := NewServer(lgr, db, sessionsKV, statementsOS, transfersStream, nc, relay, webhookSvc, getenv)
 	httpServer := &http.Server{
 		Addr:         ":" + cfg.Port,
 		Handler:      srv,
@@ -156,26 +182,31 @@ func NewServer(
 	lgr *logger.Logger,
 	db *database.Database,
 	sessionsKV jetstream.KeyValue,
+	statementsOS jetstream.ObjectStore,
+	transfersStream jetstream.Stream,
 	nc *nats.Conn,
-	webhooks accounts.WebhookEnqueuer,
+	relay accounts.OutboxNotifier,
+	webhookSvc *webhooks.Service,
 	getenv func(string) string,
 ) http.Handler {
 	mux := chi.NewMux()
 
 	// mux.Use(middleware.Logger)
 	// mux.Use(sloghttp.New(logger))
+	mux.Use(midware.RequestID) // Always generated, the client's X-Request-Id is kept apart
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		ExposedHeaders:   []string{"X-Request-Id"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 	mux.Use(middleware.Heartbeat("/heartbeat"))
 	mux.Use(Compressor(2))
 
-	routes.AddRoutes(mux, lgr, db, sessionsKV, nc, webhooks, getenv)
+	routes.AddRoutes(mux, lgr, db, sessionsKV, statementsOS, transfersStream, nc, relay, webhookSvc, getenv)
 
 	return mux
 }